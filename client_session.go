@@ -447,7 +447,7 @@ func (cs *clientSession) processFrameFromReader(fg frameAndGate, fgValid bool) b
   var err error
   if !fgValid {
     err = <-cs.readFrameErrCh
-    if err == ErrFrameTooLarge {
+    if _, ok := err.(dataTooLargeError); ok || err == ErrFrameTooLarge {
       cs.goAway(ErrCodeFrameSize)
       return true // goAway will close the loop
     }
@@ -1121,7 +1121,7 @@ func (cs *clientSession) readFrames() {
       close(cs.readFrameCh)
       return
     }
-    cs.readFrameCh <- frameAndGate{f, g}
+    cs.readFrameCh <- frameAndGate{f: f, g: g}
     // We can't read another frame until this one is
     // processed, as the ReadFrame interface doesn't copy
     // memory.  The Frame accessor methods access the last
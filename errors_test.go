@@ -9,12 +9,29 @@ package http2
 
 import "testing"
 
+func TestErrorStrings(t *testing.T) {
+	tests := []struct {
+		err  error
+		want string
+	}{
+		{ConnectionError(ErrCodeFlowControl), "connection error: FLOW_CONTROL_ERROR"},
+		{StreamError{3, ErrCodeRefusedStream}, "stream error: stream ID 3; REFUSED_STREAM"},
+	}
+	for i, tt := range tests {
+		if got := tt.err.Error(); got != tt.want {
+			t.Errorf("%d. Error = %q; want %q", i, got, tt.want)
+		}
+	}
+}
+
 func TestErrCodeString(t *testing.T) {
 	tests := []struct {
 		err  ErrCode
 		want string
 	}{
 		{ErrCodeProtocol, "PROTOCOL_ERROR"},
+		{ErrCodeFlowControl, "FLOW_CONTROL_ERROR"},
+		{ErrCodeFrameSize, "FRAME_SIZE_ERROR"},
 		{0xd, "HTTP_1_1_REQUIRED"},
 		{0xf, "unknown error code 0xf"},
 	}
@@ -41,11 +41,14 @@ func (f *flow) take(n int32) {
 
 // add adds n bytes (positive or negative) to the flow control window.
 // It returns false if the sum would exceed 2^31-1.
+// The window may be negative, after the peer shrinks
+// SETTINGS_INITIAL_WINDOW_SIZE, so the sum is checked for int32
+// overflow rather than compared against the space remaining.
 func (f *flow) add(n int32) bool {
-	remain := (1<<31 - 1) - f.n
-	if n > remain {
-		return false
+	sum := f.n + n
+	if (sum > n) == (f.n > 0) {
+		f.n = sum
+		return true
 	}
-	f.n += n
-	return true
+	return false
 }
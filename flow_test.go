@@ -52,3 +52,19 @@ func TestFlowAdd(t *testing.T) {
 	}
 
 }
+
+func TestFlowAddNegativeWindow(t *testing.T) {
+	f := flow{n: -100}
+	if !f.add(1<<31 - 1) {
+		t.Fatal("failed to add 2^31-1 to a negative window")
+	}
+	if got, want := f.available(), int32(1<<31-1-100); got != want {
+		t.Fatalf("size = %d; want %d", got, want)
+	}
+	if !f.add(100) {
+		t.Fatal("failed to add up to 2^31-1")
+	}
+	if f.add(1) {
+		t.Fatal("adding 1 to max shouldn't be allowed")
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"sync"
 )
 
@@ -266,11 +267,19 @@ type Framer struct {
 	getReadBuf func(size uint32) []byte
 	readBuf    []byte // cache for default getReadBuf
 
-	maxWriteSize uint32 // zero means unlimited; TODO: implement
+	maxWriteSize uint32 // zero means unlimited; see SetMaxWriteFrameSize
 
 	w    io.Writer
 	wbuf []byte
 
+	// debugWriteHook, if non-nil, is called with a copy of each
+	// frame after it's written.
+	debugWriteHook func(Frame)
+
+	// countWrite, if non-nil, is called with the type of each
+	// frame after it's written.
+	countWrite func(FrameType)
+
 	// AllowIllegalWrites permits the Framer's Write methods to
 	// write frames that do not conform to the HTTP/2 spec.  This
 	// permits using the Framer to test other HTTP/2
@@ -304,7 +313,7 @@ func (f *Framer) endWrite() error {
 	// Now that we know the final size, fill in the FrameHeader in
 	// the space previously reserved for it. Abuse append.
 	length := len(f.wbuf) - frameHeaderLen
-	if length >= (1 << 24) {
+	if length >= (1<<24) || (f.maxWriteSize != 0 && uint32(length) > f.maxWriteSize) {
 		return ErrFrameTooLarge
 	}
 	_ = append(f.wbuf[:0],
@@ -315,9 +324,31 @@ func (f *Framer) endWrite() error {
 	if err == nil && n != len(f.wbuf) {
 		err = io.ErrShortWrite
 	}
+	if err == nil && f.countWrite != nil {
+		f.countWrite(FrameType(f.wbuf[3]))
+	}
+	if err == nil && f.debugWriteHook != nil {
+		f.logWrite()
+	}
 	return err
 }
 
+// logWrite parses the frame just written back into a Frame for
+// debugWriteHook. Frames that don't parse, as AllowIllegalWrites
+// permits, are skipped.
+func (f *Framer) logWrite() {
+	fh, err := readFrameHeader(make([]byte, frameHeaderLen), bytes.NewReader(f.wbuf))
+	if err != nil {
+		return
+	}
+	payload := append([]byte(nil), f.wbuf[frameHeaderLen:]...) // wbuf is reused
+	fr, err := typeFrameParser(fh.Type)(fh, payload)
+	if err != nil {
+		return
+	}
+	f.debugWriteHook(fr)
+}
+
 func (f *Framer) writeByte(v byte)     { f.wbuf = append(f.wbuf, v) }
 func (f *Framer) writeBytes(v []byte)  { f.wbuf = append(f.wbuf, v...) }
 func (f *Framer) writeUint16(v uint16) { f.wbuf = append(f.wbuf, byte(v>>8), byte(v)) }
@@ -358,14 +389,41 @@ func (fr *Framer) SetMaxReadFrameSize(v uint32) {
 	fr.maxReadSize = v
 }
 
+// SetMaxWriteFrameSize sets the maximum frame payload size the
+// Write methods will write, such as the SETTINGS_MAX_FRAME_SIZE the
+// peer advertised. A frame above it, padding included, isn't written
+// and ErrFrameTooLarge is returned instead. Zero, the default,
+// leaves only the protocol's limit of 2^24-1 bytes.
+func (fr *Framer) SetMaxWriteFrameSize(v uint32) {
+	if v > maxFrameSize {
+		v = maxFrameSize
+	}
+	fr.maxWriteSize = v
+}
+
 // ErrFrameTooLarge is returned from Framer.ReadFrame when the peer
-// sends a frame that is larger than declared with SetMaxReadFrameSize.
+// sends a frame that is larger than declared with SetMaxReadFrameSize,
+// and from the Write methods for a frame larger than declared with
+// SetMaxWriteFrameSize.
 var ErrFrameTooLarge = errors.New("http2: frame too large")
 
+// dataTooLargeError is returned from Framer.ReadFrame in place of
+// ErrFrameTooLarge for a DATA frame on a stream. Section 4.2 only
+// makes an oversized frame a connection error if it could alter the
+// state of the whole connection, so the DATA frame's payload has
+// been skipped and the peer may be sent a stream error instead.
+// The payload still counts against the connection's flow control.
+type dataTooLargeError struct {
+	FrameHeader
+}
+
+func (e dataTooLargeError) Error() string { return ErrFrameTooLarge.Error() }
+
 // ReadFrame reads a single frame. The returned Frame is only valid
 // until the next call to ReadFrame.
 // If the frame is larger than previously set with SetMaxReadFrameSize,
-// the returned error is ErrFrameTooLarge.
+// the returned error is ErrFrameTooLarge, or for a DATA frame an
+// error whose payload has been skipped; see dataTooLargeError.
 func (fr *Framer) ReadFrame() (Frame, error) {
 	if fr.lastFrame != nil {
 		fr.lastFrame.invalidate()
@@ -375,6 +433,12 @@ func (fr *Framer) ReadFrame() (Frame, error) {
 		return nil, err
 	}
 	if fh.Length > fr.maxReadSize {
+		if fh.Type == FrameData && fh.StreamID != 0 {
+			if _, err := io.CopyN(ioutil.Discard, fr.r, int64(fh.Length)); err != nil {
+				return nil, err
+			}
+			return nil, dataTooLargeError{fh}
+		}
 		return nil, ErrFrameTooLarge
 	}
 	payload := fr.getReadBuf(fh.Length)
@@ -452,16 +516,50 @@ func validStreamID(streamID uint32) bool {
 // It will perform exactly one Write to the underlying Writer.
 // It is the caller's responsibility to not call other Write methods concurrently.
 func (f *Framer) WriteData(streamID uint32, endStream bool, data []byte) error {
-	// TODO: ignoring padding for now. will add when somebody cares.
+	return f.WriteDataPadded(streamID, endStream, data, nil)
+}
+
+var (
+	errPadLength = errors.New("pad length too large")
+	errPadBytes  = errors.New("padding bytes must all be zeros unless AllowIllegalWrites is enabled")
+)
+
+// WriteDataPadded writes a DATA frame with optional padding.
+//
+// If pad is nil, the padding bit is not sent.
+// The length of pad must not exceed 255 bytes.
+// The bytes of pad must all be zero, unless f.AllowIllegalWrites is set.
+//
+// It will perform exactly one Write to the underlying Writer.
+// It is the caller's responsibility to not call other Write methods concurrently.
+func (f *Framer) WriteDataPadded(streamID uint32, endStream bool, data, pad []byte) error {
 	if !validStreamID(streamID) && !f.AllowIllegalWrites {
 		return errStreamID
 	}
+	if len(pad) > 255 {
+		return errPadLength
+	}
+	if !f.AllowIllegalWrites {
+		for _, b := range pad {
+			if b != 0 {
+				// "Padding octets MUST be set to zero when sending."
+				return errPadBytes
+			}
+		}
+	}
 	var flags Flags
 	if endStream {
 		flags |= FlagDataEndStream
 	}
+	if pad != nil {
+		flags |= FlagDataPadded
+	}
 	f.startWrite(FrameData, flags, streamID)
+	if pad != nil {
+		f.wbuf = append(f.wbuf, byte(len(pad)))
+	}
 	f.wbuf = append(f.wbuf, data...)
+	f.wbuf = append(f.wbuf, pad...)
 	return f.endWrite()
 }
 
@@ -761,8 +859,11 @@ func parseHeadersFrame(fh FrameHeader, p []byte) (_ Frame, err error) {
 			return nil, err
 		}
 	}
-	if len(p)-int(padLength) <= 0 {
-		return nil, StreamError{fh.StreamID, ErrCodeProtocol}
+	if int(padLength) > len(p) {
+		// "Padding that exceeds the size remaining for the
+		// header block fragment MUST be treated as a
+		// PROTOCOL_ERROR."
+		return nil, ConnectionError(ErrCodeProtocol)
 	}
 	hf.headerFragBuf = p[:len(p)-int(padLength)]
 	return hf, nil
@@ -895,6 +996,11 @@ func (f *Framer) WritePriority(streamID uint32, p PriorityParam) error {
 	if !validStreamID(streamID) && !f.AllowIllegalWrites {
 		return errStreamID
 	}
+	if p.StreamDep&(1<<31) != 0 && !f.AllowIllegalWrites {
+		// The high bit is the exclusive flag; the
+		// dependency itself is only 31 bits.
+		return errors.New("invalid dependent stream id")
+	}
 	f.startWrite(FramePriority, 0, streamID)
 	v := p.StreamDep
 	if p.Exclusive {
@@ -1020,6 +1126,10 @@ func parsePushPromise(fh FrameHeader, p []byte) (_ Frame, err error) {
 		return
 	}
 	pp.PromiseID = pp.PromiseID & (1<<31 - 1)
+	if pp.PromiseID == 0 {
+		// There's no stream 0 to promise.
+		return nil, ConnectionError(ErrCodeProtocol)
+	}
 
 	if int(padLength) > len(p) {
 		// like the DATA frame, error out if padding is longer than the body.
@@ -1062,6 +1172,9 @@ func (f *Framer) WritePushPromise(p PushPromiseParam) error {
 	if !validStreamID(p.StreamID) && !f.AllowIllegalWrites {
 		return errStreamID
 	}
+	if !validStreamID(p.PromiseID) && !f.AllowIllegalWrites {
+		return errStreamID
+	}
 	var flags Flags
 	if p.PadLength != 0 {
 		flags |= FlagPushPromisePadded
@@ -1073,9 +1186,6 @@ func (f *Framer) WritePushPromise(p PushPromiseParam) error {
 	if p.PadLength != 0 {
 		f.writeByte(p.PadLength)
 	}
-	if !validStreamID(p.PromiseID) && !f.AllowIllegalWrites {
-		return errStreamID
-	}
 	f.writeUint32(p.PromiseID)
 	f.wbuf = append(f.wbuf, p.BlockFragment...)
 	f.wbuf = append(f.wbuf, padZeros[:p.PadLength]...)
@@ -77,6 +77,125 @@ func TestWriteData(t *testing.T) {
 	}
 }
 
+func TestWriteDataPadded(t *testing.T) {
+	tests := [...]struct {
+		streamID   uint32
+		endStream  bool
+		data       []byte
+		pad        []byte
+		wantHeader FrameHeader
+	}{
+		// Unpadded:
+		0: {
+			streamID:  1,
+			endStream: true,
+			data:      []byte("foo"),
+			pad:       nil,
+			wantHeader: FrameHeader{
+				Type:     FrameData,
+				Flags:    FlagDataEndStream,
+				Length:   3,
+				StreamID: 1,
+			},
+		},
+
+		// Padded bit set, but no padding:
+		1: {
+			streamID:  1,
+			endStream: true,
+			data:      []byte("foo"),
+			pad:       []byte{},
+			wantHeader: FrameHeader{
+				Type:     FrameData,
+				Flags:    FlagDataEndStream | FlagDataPadded,
+				Length:   4,
+				StreamID: 1,
+			},
+		},
+
+		// Padded bit set, with padding:
+		2: {
+			streamID:  1,
+			endStream: false,
+			data:      []byte("bar"),
+			pad:       []byte{0, 0, 0},
+			wantHeader: FrameHeader{
+				Type:     FrameData,
+				Flags:    FlagDataPadded,
+				Length:   7,
+				StreamID: 1,
+			},
+		},
+	}
+	for i, tt := range tests {
+		fr, _ := testFramer()
+		if err := fr.WriteDataPadded(tt.streamID, tt.endStream, tt.data, tt.pad); err != nil {
+			t.Errorf("%d. WriteDataPadded = %v", i, err)
+			continue
+		}
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Errorf("%d. ReadFrame = %v", i, err)
+			continue
+		}
+		got := f.Header()
+		tt.wantHeader.valid = true
+		if got != tt.wantHeader {
+			t.Errorf("%d. read %+v; want %+v", i, got, tt.wantHeader)
+			continue
+		}
+		df := f.(*DataFrame)
+		if !bytes.Equal(df.Data(), tt.data) {
+			t.Errorf("%d. got %q; want %q", i, df.Data(), tt.data)
+		}
+	}
+}
+
+func TestWriteDataPadded_Invalid(t *testing.T) {
+	fr, _ := testFramer()
+	if err := fr.WriteDataPadded(1, false, nil, make([]byte, 256)); err != errPadLength {
+		t.Errorf("256 bytes of padding: WriteDataPadded = %v; want errPadLength", err)
+	}
+	if err := fr.WriteDataPadded(1, false, nil, []byte{0, 1}); err != errPadBytes {
+		t.Errorf("non-zero padding: WriteDataPadded = %v; want errPadBytes", err)
+	}
+	fr.AllowIllegalWrites = true
+	if err := fr.WriteDataPadded(1, false, nil, []byte{0, 1}); err != nil {
+		t.Errorf("non-zero padding with AllowIllegalWrites: WriteDataPadded = %v", err)
+	}
+
+	// The padding counts against the frame size.
+	fr.SetMaxWriteFrameSize(8)
+	if err := fr.WriteDataPadded(1, false, make([]byte, 4), make([]byte, 3)); err != nil {
+		t.Errorf("8 byte frame: WriteDataPadded = %v", err)
+	}
+	if err := fr.WriteDataPadded(1, false, make([]byte, 4), make([]byte, 4)); err != ErrFrameTooLarge {
+		t.Errorf("9 byte frame: WriteDataPadded = %v; want ErrFrameTooLarge", err)
+	}
+}
+
+func TestSetMaxWriteFrameSize(t *testing.T) {
+	fr, buf := testFramer()
+	fr.SetMaxWriteFrameSize(minMaxFrameSize)
+	p := HeadersFrameParam{StreamID: 1, BlockFragment: make([]byte, minMaxFrameSize), EndHeaders: true}
+	if err := fr.WriteHeaders(p); err != nil {
+		t.Errorf("%d byte HEADERS: %v", minMaxFrameSize, err)
+	}
+	buf.Reset()
+	p.BlockFragment = make([]byte, minMaxFrameSize+1)
+	if err := fr.WriteHeaders(p); err != ErrFrameTooLarge {
+		t.Errorf("%d byte HEADERS: %v; want ErrFrameTooLarge", minMaxFrameSize+1, err)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %d bytes of a frame that's too large", buf.Len())
+	}
+
+	fr.SetMaxWriteFrameSize(1 << 30)
+	if fr.maxWriteSize != maxFrameSize {
+		t.Errorf("max write frame size = %d; want it capped at %d", fr.maxWriteSize, maxFrameSize)
+	}
+}
+
 func TestWriteHeaders(t *testing.T) {
 	tests := []struct {
 		name      string
@@ -200,6 +319,18 @@ func TestWriteHeaders(t *testing.T) {
 	}
 }
 
+func TestReadHeaders_PaddingTooLong(t *testing.T) {
+	fr, _ := testFramer()
+	// Pad Length of 4, but only 3 bytes follow it.
+	if err := fr.WriteRawFrame(FrameHeaders, FlagHeadersPadded|FlagHeadersEndHeaders, 1, []byte{4, 'a', 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := fr.ReadFrame()
+	if err != ConnectionError(ErrCodeProtocol) {
+		t.Errorf("ReadFrame = %v; want %v", err, ConnectionError(ErrCodeProtocol))
+	}
+}
+
 func TestWriteContinuation(t *testing.T) {
 	const streamID = 42
 	tests := []struct {
@@ -324,6 +455,19 @@ func TestWritePriority(t *testing.T) {
 	}
 }
 
+func TestWritePriority_Invalid(t *testing.T) {
+	fr, buf := testFramer()
+	if err := fr.WritePriority(0, PriorityParam{StreamDep: 1}); err != errStreamID {
+		t.Errorf("stream 0: err = %v; want %v", err, errStreamID)
+	}
+	if err := fr.WritePriority(1, PriorityParam{StreamDep: 1 << 31}); err == nil {
+		t.Error("32-bit dependency: got nil error")
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %q after errors; want nothing", buf.Bytes())
+	}
+}
+
 func TestWriteSettings(t *testing.T) {
 	fr, buf := testFramer()
 	settings := []Setting{{1, 2}, {3, 4}}
@@ -396,6 +540,14 @@ func TestWriteWindowUpdate(t *testing.T) {
 func TestWritePing(t *testing.T)    { testWritePing(t, false) }
 func TestWritePingAck(t *testing.T) { testWritePing(t, true) }
 
+func TestReadPing_BadLength(t *testing.T) {
+	fr, _ := testFramer()
+	fr.WriteRawFrame(FramePing, 0, 0, make([]byte, 4))
+	if _, err := fr.ReadFrame(); err != ConnectionError(ErrCodeFrameSize) {
+		t.Errorf("ReadFrame of 4-byte PING = %v; want %v", err, ConnectionError(ErrCodeFrameSize))
+	}
+}
+
 func testWritePing(t *testing.T, ack bool) {
 	fr, buf := testFramer()
 	if err := fr.WritePing(ack, [8]byte{1, 2, 3, 4, 5, 6, 7, 8}); err != nil {
@@ -505,6 +657,30 @@ func TestWriteTooLargeFrame(t *testing.T) {
 	}
 }
 
+func TestReadTooLargeFrame(t *testing.T) {
+	fr, _ := testFramer()
+	fr.SetMaxReadFrameSize(minMaxFrameSize)
+	big := make([]byte, minMaxFrameSize+1)
+
+	// DATA is skipped, so the next frame can still be read.
+	fr.WriteData(1, false, big)
+	fr.WritePing(false, [8]byte{1})
+	_, err := fr.ReadFrame()
+	if e, ok := err.(dataTooLargeError); !ok || e.StreamID != 1 || e.Length != uint32(len(big)) {
+		t.Fatalf("ReadFrame = %#v; want dataTooLargeError for stream 1", err)
+	}
+	if f, err := fr.ReadFrame(); err != nil {
+		t.Fatalf("ReadFrame after skipped DATA = %v", err)
+	} else if _, ok := f.(*PingFrame); !ok {
+		t.Fatalf("ReadFrame after skipped DATA = %T; want *PingFrame", f)
+	}
+
+	fr.WriteRawFrame(FrameHeaders, 0, 1, big)
+	if _, err := fr.ReadFrame(); err != ErrFrameTooLarge {
+		t.Errorf("ReadFrame of HEADERS = %v; want ErrFrameTooLarge", err)
+	}
+}
+
 func TestWriteGoAway(t *testing.T) {
 	const debug = "foo"
 	fr, buf := testFramer()
@@ -576,3 +752,72 @@ func TestWritePushPromise(t *testing.T) {
 		t.Fatalf("parsed back:\n%#v\nwant:\n%#v", f, want)
 	}
 }
+
+func TestWritePushPromise_Padded(t *testing.T) {
+	pp := PushPromiseParam{
+		StreamID:      1,
+		PromiseID:     2,
+		BlockFragment: []byte("abc"),
+		EndHeaders:    true,
+		PadLength:     5,
+	}
+	fr, buf := testFramer()
+	if err := fr.WritePushPromise(pp); err != nil {
+		t.Fatal(err)
+	}
+	const wantEnc = "\x00\x00\x0d\x05\x0c\x00\x00\x00\x01\x05\x00\x00\x00\x02abc\x00\x00\x00\x00\x00"
+	if buf.String() != wantEnc {
+		t.Errorf("encoded as %q; want %q", buf.Bytes(), wantEnc)
+	}
+	f, err := fr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &PushPromiseFrame{
+		FrameHeader: FrameHeader{
+			valid:    true,
+			Type:     FramePushPromise,
+			Flags:    FlagPushPromiseEndHeaders | FlagPushPromisePadded,
+			Length:   13,
+			StreamID: 1,
+		},
+		PromiseID:     2,
+		headerFragBuf: []byte("abc"),
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Fatalf("parsed back:\n%#v\nwant:\n%#v", f, want)
+	}
+	if !f.(*PushPromiseFrame).HeadersEnded() {
+		t.Error("HeadersEnded = false; want true")
+	}
+}
+
+func TestWritePushPromise_InvalidPromiseID(t *testing.T) {
+	fr, buf := testFramer()
+	if err := fr.WritePushPromise(PushPromiseParam{StreamID: 1}); err != errStreamID {
+		t.Errorf("err = %v; want %v", err, errStreamID)
+	}
+	if buf.Len() != 0 {
+		t.Errorf("wrote %q after error; want nothing", buf.Bytes())
+	}
+}
+
+func TestReadPushPromise_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		flags   Flags
+		payload []byte
+	}{
+		{"zero promise ID", 0, []byte("\x00\x00\x00\x00abc")},
+		{"padding longer than payload", FlagPushPromisePadded, []byte("\x09\x00\x00\x00\x02abc")},
+	}
+	for _, tt := range tests {
+		fr, _ := testFramer()
+		if err := fr.WriteRawFrame(FramePushPromise, tt.flags, 1, tt.payload); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := fr.ReadFrame(); err != ConnectionError(ErrCodeProtocol) {
+			t.Errorf("%s: err = %v; want PROTOCOL_ERROR", tt.name, err)
+		}
+	}
+}
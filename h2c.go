@@ -0,0 +1,263 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Cleartext HTTP/2 (h2c)
+
+package http2
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// NewH2CHandler returns an http.Handler for a cleartext HTTP/1
+// server that serves cleartext HTTP/2 (h2c) connections with s,
+// and every other request with h.
+//
+// A client with prior knowledge of HTTP/2 support starts its
+// connection with the HTTP/2 preface, which the HTTP/1 server reads
+// as a "PRI * HTTP/2.0" request. The handler takes over that
+// connection and serves it as HTTP/2.
+//
+// A client without prior knowledge sends an HTTP/1.1 request with
+// "Upgrade: h2c" and an HTTP2-Settings header (RFC 7540, 3.2). The
+// handler answers "101 Switching Protocols", serves HTTP/2 on the
+// connection, and serves the request itself as stream 1.
+//
+// s may be nil.
+func NewH2CHandler(h http.Handler, s *Server) http.Handler {
+	if s == nil {
+		s = new(Server)
+	}
+	return &h2cHandler{h: h, s: s}
+}
+
+type h2cHandler struct {
+	h http.Handler
+	s *Server
+}
+
+// prefaceRequestLine is the part of ClientPreface that an HTTP/1
+// server reads as a request, ahead of the "SM\r\n\r\n" body.
+const prefaceRequestLine = "PRI * HTTP/2.0\r\n\r\n"
+
+func (h *h2cHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if isH2CUpgrade(r) {
+		h.serveUpgrade(w, r)
+		return
+	}
+	if r.Method != "PRI" || r.RequestURI != "*" || r.Proto != "HTTP/2.0" || len(r.Header) != 0 {
+		h.h.ServeHTTP(w, r)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "h2c not supported", http.StatusInternalServerError)
+		return
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	hs, _ := r.Context().Value(http.ServerContextKey).(*http.Server)
+	// Hand the server the whole preface, request line and all,
+	// followed by whatever the HTTP/1 server had buffered.
+	c = &bufferedConn{c, io.MultiReader(strings.NewReader(prefaceRequestLine), rw.Reader)}
+	h.s.ServeConn(hs, c, h.h)
+}
+
+// bufferedConn is a net.Conn whose reads come from r, which drains
+// data already read from the Conn before reading the Conn itself.
+type bufferedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// maxH2CUpgradeBody is how much of an upgrade request's body is
+// buffered, to be replayed as the body of stream 1.
+const maxH2CUpgradeBody = 1 << 20
+
+// h2cUpgrade is an HTTP/1.1 request that upgraded its connection
+// to h2c.
+type h2cUpgrade struct {
+	settings []Setting // from HTTP2-Settings
+	req      *http.Request
+	body     []byte
+}
+
+// isH2CUpgrade reports whether r asks to upgrade to h2c.
+func isH2CUpgrade(r *http.Request) bool {
+	return r.ProtoMajor == 1 && r.ProtoMinor == 1 && r.Method != "CONNECT" &&
+		headerHasToken(r.Header["Upgrade"], "h2c") &&
+		headerHasToken(r.Header["Connection"], "Upgrade") &&
+		headerHasToken(r.Header["Connection"], "HTTP2-Settings")
+}
+
+// headerHasToken reports whether any of the comma-separated header
+// values vv contains token, case-insensitively.
+func headerHasToken(vv []string, token string) bool {
+	for _, v := range vv {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *h2cHandler) serveUpgrade(w http.ResponseWriter, r *http.Request) {
+	// 3.2.1: "A request that upgrades from HTTP/1.1 to HTTP/2
+	// MUST include exactly one HTTP2-Settings header field."
+	vv := r.Header["Http2-Settings"]
+	if len(vv) != 1 {
+		http.Error(w, "h2c upgrade needs exactly one HTTP2-Settings header", http.StatusBadRequest)
+		return
+	}
+	settings, err := decodeH2CSettings(vv[0])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "h2c not supported", http.StatusInternalServerError)
+		return
+	}
+	// The body has to be read before the protocol switches, to
+	// be served as stream 1's.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxH2CUpgradeBody))
+	if err != nil {
+		http.Error(w, "h2c upgrade request body too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	c, rw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		c.Close()
+		return
+	}
+	hs, _ := r.Context().Value(http.ServerContextKey).(*http.Server)
+	if hs == nil {
+		hs = new(http.Server)
+	}
+	h.s.handleConn(hs, &bufferedConn{c, rw.Reader}, h.h, &h2cUpgrade{
+		settings: settings,
+		req:      r,
+		body:     body,
+	})
+}
+
+// decodeH2CSettings decodes an HTTP2-Settings header value, a
+// SETTINGS frame payload in base64url.
+func decodeH2CSettings(v string) ([]Setting, error) {
+	// 3.2.1: "[...] with any trailing '=' characters omitted",
+	// but be lenient about them.
+	p, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(v, "="))
+	if err != nil {
+		return nil, errors.New("invalid HTTP2-Settings encoding")
+	}
+	if len(p)%6 != 0 {
+		return nil, errors.New("invalid HTTP2-Settings length")
+	}
+	var settings []Setting
+	for ; len(p) > 0; p = p[6:] {
+		s := Setting{
+			ID:  SettingID(binary.BigEndian.Uint16(p[:2])),
+			Val: binary.BigEndian.Uint32(p[2:6]),
+		}
+		if err := s.Valid(); err != nil {
+			return nil, errors.New("invalid HTTP2-Settings value")
+		}
+		settings = append(settings, s)
+	}
+	return settings, nil
+}
+
+// h2cHopHeaders are the upgrade request's HTTP/1.1 connection
+// headers, which stream 1's request doesn't carry.
+var h2cHopHeaders = []string{
+	"Connection",
+	"Http2-Settings",
+	"Keep-Alive",
+	"Proxy-Connection",
+	"Te",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// serveUpgrade applies the settings the client sent in its upgrade
+// request, and starts serving the request itself as stream 1.
+func (sc *serverConn) serveUpgrade() error {
+	sc.serveG.check()
+	up := sc.upgrade
+	for _, s := range up.settings {
+		if err := sc.processSetting(s); err != nil {
+			return err
+		}
+	}
+
+	// 3.2: "The HTTP/1.1 request that is sent prior to upgrade
+	// is assigned a stream identifier of 1 [...] with default
+	// priority values. Stream 1 is implicitly "half-closed"
+	// from the client toward the server".
+	st := &stream{
+		id:        1,
+		state:     stateHalfClosedRemote,
+		weight:    defaultStreamWeight,
+		startTime: time.Now(),
+	}
+	st.cw.Init()
+	st.flow.conn = &sc.flow
+	st.flow.add(sc.initialWindowSize)
+	st.inflow.conn = &sc.inflow
+	st.inflow.add(sc.srv.initialStreamRecvWindowSize())
+
+	r := up.req
+	h := cloneHeader(r.Header)
+	for _, v := range r.Header["Connection"] {
+		for _, k := range strings.Split(v, ",") {
+			delete(h, textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(k)))
+		}
+	}
+	for _, k := range h2cHopHeaders {
+		delete(h, k)
+	}
+	rw, req, cancel, err := sc.newWriterAndRequest(&requestParam{
+		stream:    st,
+		header:    h,
+		method:    r.Method,
+		path:      r.URL.RequestURI(),
+		scheme:    "http",
+		authority: r.Host,
+	})
+	if err != nil {
+		return err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(up.body))
+	req.ContentLength = int64(len(up.body))
+
+	sc.maxStreamID = 1
+	sc.lastProcessedStreamID = 1
+	sc.streams[1] = st
+	sc.curOpenStreams++
+	sc.srv.stats.streamsOpened.Add(1)
+	st.cancelCtx = cancel
+	go sc.runHandler(rw, req, cancel)
+	return nil
+}
@@ -0,0 +1,276 @@
+// Copyright 2015 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package http2
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bradfitz/http2/hpack"
+)
+
+// h2cTestHandler is the handler behind the h2c tests' servers. It
+// replies with the request's protocol version.
+func h2cTestHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor == 2 && (r.TLS != nil || r.URL.Scheme != "http") {
+			t.Errorf("request TLS = %v, scheme %q; want no TLS and http", r.TLS, r.URL.Scheme)
+		}
+		io.WriteString(w, r.Proto)
+	})
+}
+
+// h2cGet makes a GET request for / over c, a cleartext HTTP/2
+// connection with prior knowledge, and returns the response body.
+func h2cGet(t *testing.T, c net.Conn) string {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fr := NewFramer(c, c)
+	errc := make(chan error, 1)
+	go func() {
+		// Write while reading, in case c is unbuffered.
+		if _, err := c.Write(clientPreface); err != nil {
+			errc <- err
+			return
+		}
+		if err := fr.WriteSettings(); err != nil {
+			errc <- err
+			return
+		}
+		var buf bytes.Buffer
+		enc := hpack.NewEncoder(&buf)
+		enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+		enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+		enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "http"})
+		enc.WriteField(hpack.HeaderField{Name: ":authority", Value: "example.com"})
+		errc <- fr.WriteHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: buf.Bytes(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	}()
+
+	var body bytes.Buffer
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		// The server's SETTINGS go unacknowledged: the
+		// writing goroutine owns fr's write side.
+		df, ok := f.(*DataFrame)
+		if !ok {
+			continue
+		}
+		body.Write(df.Data())
+		if df.StreamEnded() {
+			if err := <-errc; err != nil {
+				t.Fatalf("writing request: %v", err)
+			}
+			return body.String()
+		}
+	}
+}
+
+func TestServeConn_H2C(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	hs := &http.Server{ErrorLog: log.New(ioutil.Discard, "", 0)}
+	go new(Server).ServeConn(hs, serverConn, h2cTestHandler(t))
+
+	if got := h2cGet(t, clientConn); got != "HTTP/2.0" {
+		t.Errorf("body = %q; want HTTP/2.0", got)
+	}
+}
+
+func TestH2CHandler_PriorKnowledge(t *testing.T) {
+	ts := httptest.NewServer(NewH2CHandler(h2cTestHandler(t), nil))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := h2cGet(t, c); got != "HTTP/2.0" {
+		t.Errorf("h2c body = %q; want HTTP/2.0", got)
+	}
+
+	// Everything else is still HTTP/1.
+	res, err := http.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	slurp, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(slurp) != "HTTP/1.1" {
+		t.Errorf("HTTP/1 body = %q; want HTTP/1.1", slurp)
+	}
+}
+
+func TestH2CHandler_Upgrade(t *testing.T) {
+	ts := httptest.NewServer(NewH2CHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, _ := StreamIDFromContext(r.Context())
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading body: %v", err)
+		}
+		if v := r.Header.Get("Upgrade") + r.Header.Get("Http2-Settings"); v != "" {
+			t.Errorf("upgrade headers reached the handler: %v", r.Header)
+		}
+		pushErr := w.(http.Pusher).Push("/pushed", nil)
+		fmt.Fprintf(w, "%s stream=%d %s %s body=%q push=%v",
+			r.Proto, id, r.Method, r.URL.RequestURI(), body, pushErr)
+	}), nil))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// SETTINGS_ENABLE_PUSH = 0, which Push should honor.
+	settings := base64.RawURLEncoding.EncodeToString([]byte{0, byte(SettingEnablePush), 0, 0, 0, 0})
+	const body = "hello"
+	fmt.Fprintf(c, "POST /foo?x=1 HTTP/1.1\r\nHost: example.com\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: %s\r\n"+
+		"Content-Length: %d\r\n\r\n%s", settings, len(body), body)
+
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "h2c" {
+		t.Fatalf("got %v, Upgrade %q; want 101 to h2c", res.Status, res.Header.Get("Upgrade"))
+	}
+
+	fr := NewFramer(c, br)
+	if _, err := c.Write(clientPreface); err != nil {
+		t.Fatal(err)
+	}
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	for {
+		f, err := fr.ReadFrame()
+		if err != nil {
+			t.Fatalf("reading response: %v", err)
+		}
+		if f.Header().StreamID != 0 && f.Header().StreamID != 1 {
+			t.Fatalf("unexpected frame %v", f.Header())
+		}
+		if df, ok := f.(*DataFrame); ok {
+			got.Write(df.Data())
+			if df.StreamEnded() {
+				break
+			}
+		}
+	}
+	want := fmt.Sprintf("HTTP/2.0 stream=1 POST /foo?x=1 body=%q push=%v", body, http.ErrNotSupported)
+	if got.String() != want {
+		t.Errorf("got %q\nwant %q", got.String(), want)
+	}
+}
+
+// weightRecorder is a WriteScheduler that records the weight of
+// each stream it's given frames for.
+type weightRecorder struct {
+	WriteScheduler
+	weights chan<- uint8
+}
+
+func (ws weightRecorder) add(wm frameWriteMsg) {
+	if wm.stream != nil {
+		select {
+		case ws.weights <- wm.stream.weight:
+		default:
+		}
+	}
+	ws.WriteScheduler.add(wm)
+}
+
+// Test that the upgraded request's stream 1 gets the default
+// priority, like any other new stream (3.2).
+func TestH2CHandler_Upgrade_StreamWeight(t *testing.T) {
+	weights := make(chan uint8, 1)
+	srv := &Server{NewWriteScheduler: func() WriteScheduler {
+		return weightRecorder{NewPriorityWriteScheduler(), weights}
+	}}
+	ts := httptest.NewServer(NewH2CHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}), srv))
+	defer ts.Close()
+
+	c, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\n"+
+		"Connection: Upgrade, HTTP2-Settings\r\nUpgrade: h2c\r\nHTTP2-Settings: \r\n\r\n")
+	br := bufio.NewReader(c)
+	res, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("got %v; want 101", res.Status)
+	}
+	if _, err := c.Write(clientPreface); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewFramer(c, br).WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case w := <-weights:
+		if w != defaultStreamWeight {
+			t.Errorf("stream 1 weight = %d; want %d", w, defaultStreamWeight)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for stream 1's response")
+	}
+}
+
+func TestH2CHandler_Upgrade_BadSettings(t *testing.T) {
+	ts := httptest.NewServer(NewH2CHandler(http.NotFoundHandler(), nil))
+	defer ts.Close()
+	for _, settings := range []string{"!!!", "AAAA", strings.Repeat("x", 5)} {
+		req, err := http.NewRequest("GET", ts.URL, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Connection", "Upgrade, HTTP2-Settings")
+		req.Header.Set("Upgrade", "h2c")
+		req.Header.Set("HTTP2-Settings", settings)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusBadRequest {
+			t.Errorf("HTTP2-Settings %q: status = %v; want 400", settings, res.Status)
+		}
+	}
+}
@@ -10,6 +10,8 @@ package http2
 import (
 	"net/http"
 	"strings"
+	"sync"
+	"sync/atomic"
 )
 
 var (
@@ -72,9 +74,106 @@ func init() {
 	}
 }
 
+const (
+	// maxSharedCanonHeaders and maxSharedLowerHeaders bound
+	// sharedCanonHeader and sharedLowerHeader, so peers and
+	// handlers using made-up header names can't grow them forever.
+	maxSharedCanonHeaders = 1000
+	maxSharedLowerHeaders = 1000
+
+	// maxConnCanonHeaders bounds a serverConn's own cache, for
+	// names sharedCanonHeader hasn't taken.
+	maxConnCanonHeaders = 32
+)
+
+var (
+	// sharedCanonHeader caches, for all connections, the
+	// canonical forms of header names that aren't in
+	// commonCanonHeader.
+	sharedCanonHeader = &headerNameCache{max: maxSharedCanonHeaders}
+
+	// sharedLowerHeader does the same for the lower-case forms
+	// of names that aren't in commonLowerHeader.
+	sharedLowerHeader = &headerNameCache{max: maxSharedLowerHeaders}
+)
+
+// A headerNameCache is a bounded, concurrency-safe map from one
+// form of header names to another. Since names may come straight
+// from peers, one that's only been offered once is just a
+// candidate; it's cached once it's offered again, by a different
+// owner if it was given one. That keeps one peer's made-up names
+// from filling the cache for everybody.
+type headerNameCache struct {
+	max int
+
+	full atomic.Bool // len(m) reached max; checked before locking
+
+	mu         sync.RWMutex
+	m          map[string]string
+	candidates map[string]uint64 // name -> owner that first offered it
+}
+
+func (c *headerNameCache) get(v string) (cv string, ok bool) {
+	c.mu.RLock()
+	cv, ok = c.m[v]
+	c.mu.RUnlock()
+	return
+}
+
+// add offers cv as the other form of v, on behalf of owner, such as
+// a connection's ID, or 0 if there's no owner to tell apart. It
+// reports whether v is now cached.
+func (c *headerNameCache) add(v, cv string, owner uint64) bool {
+	if c.full.Load() {
+		return false
+	}
+	c.mu.RLock()
+	first, seen := c.candidates[v]
+	c.mu.RUnlock()
+	if seen && owner != 0 && first == owner {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.m) >= c.max {
+		c.full.Store(true)
+		return false
+	}
+	first, seen = c.candidates[v]
+	if !seen {
+		if len(c.candidates) >= c.max {
+			// Start over rather than grow.
+			c.candidates = nil
+		}
+		if c.candidates == nil {
+			c.candidates = make(map[string]uint64)
+		}
+		c.candidates[v] = owner
+		return false
+	}
+	if owner != 0 && first == owner {
+		return false
+	}
+	delete(c.candidates, v)
+	if c.m == nil {
+		c.m = make(map[string]string)
+	}
+	c.m[v] = cv
+	if len(c.m) >= c.max {
+		c.full.Store(true)
+	}
+	return true
+}
+
 func lowerHeader(v string) string {
 	if s, ok := commonLowerHeader[v]; ok {
 		return s
 	}
-	return strings.ToLower(v)
+	if s, ok := sharedLowerHeader.get(v); ok {
+		return s
+	}
+	s := strings.ToLower(v)
+	sharedLowerHeader.add(v, s, 0)
+	return s
 }
@@ -0,0 +1,109 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// See https://code.google.com/p/go/source/browse/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://code.google.com/p/go/source/browse/LICENSE
+
+package http2
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestHeaderNameCache_Bounded(t *testing.T) {
+	c := &headerNameCache{max: 2}
+	for _, v := range []string{"x-a", "x-b", "x-c"} {
+		c.add(v, http.CanonicalHeaderKey(v), 1)
+		c.add(v, http.CanonicalHeaderKey(v), 2)
+	}
+	if len(c.m) != 2 {
+		t.Errorf("cache has %d entries; want 2", len(c.m))
+	}
+	if cv, ok := c.get("x-a"); !ok || cv != "X-A" {
+		t.Errorf("get(x-a) = %q, %v; want X-A, true", cv, ok)
+	}
+	if _, ok := c.get("x-c"); ok {
+		t.Error("x-c cached past the limit")
+	}
+	if !c.full.Load() {
+		t.Error("full cache not flagged as full")
+	}
+}
+
+func TestHeaderNameCache_Admission(t *testing.T) {
+	c := &headerNameCache{max: 10}
+	for _, tt := range []struct {
+		v     string
+		owner uint64
+		want  bool
+	}{
+		{"x-a", 1, false}, // a candidate
+		{"x-a", 1, false}, // same owner again
+		{"x-a", 2, true},  // a second owner
+		{"x-b", 0, false}, // a candidate
+		{"x-b", 0, true},  // no owners to tell apart
+	} {
+		if got := c.add(tt.v, http.CanonicalHeaderKey(tt.v), tt.owner); got != tt.want {
+			t.Errorf("add(%q, owner %d) = %v; want %v", tt.v, tt.owner, got, tt.want)
+		}
+	}
+	if len(c.m) != 2 || len(c.candidates) != 0 {
+		t.Errorf("cache has %d entries and %d candidates; want 2 and 0", len(c.m), len(c.candidates))
+	}
+
+	// One owner's junk names never get in, and don't grow the
+	// candidates past max.
+	for i := 0; i < 100; i++ {
+		v := fmt.Sprintf("x-junk-%d", i)
+		for j := 0; j < 2; j++ {
+			if c.add(v, http.CanonicalHeaderKey(v), 3) {
+				t.Fatalf("%s from a single owner was cached", v)
+			}
+		}
+	}
+	if len(c.candidates) > c.max {
+		t.Errorf("%d candidates; want at most %d", len(c.candidates), c.max)
+	}
+}
+
+func TestLowerHeader(t *testing.T) {
+	defer func(c *headerNameCache) { sharedLowerHeader = c }(sharedLowerHeader)
+	sharedLowerHeader = &headerNameCache{max: 1}
+	for _, tt := range []struct{ in, want string }{
+		{"Content-Type", "content-type"}, // common
+		{"X-Foo", "x-foo"},               // a candidate
+		{"X-Foo", "x-foo"},               // seen again; cached
+		{"X-Foo", "x-foo"},               // from the cache
+		{"X-Bar", "x-bar"},               // cache full
+	} {
+		if got := lowerHeader(tt.in); got != tt.want {
+			t.Errorf("lowerHeader(%q) = %q; want %q", tt.in, got, tt.want)
+		}
+	}
+	if len(sharedLowerHeader.m) != 1 {
+		t.Errorf("cache has %d entries; want 1", len(sharedLowerHeader.m))
+	}
+}
+
+// BenchmarkLowerHeader lower-cases the names of a typical
+// response's headers that aren't in commonLowerHeader, as
+// each response's HEADERS frame is encoded.
+func BenchmarkLowerHeader(b *testing.B) {
+	names := []string{
+		"X-Content-Type-Options",
+		"X-Frame-Options",
+		"X-Request-Id",
+		"X-Xss-Protection",
+		"Content-Security-Policy",
+		"Referrer-Policy",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, v := range names {
+			lowerHeader(v)
+		}
+	}
+}
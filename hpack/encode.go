@@ -27,8 +27,10 @@ type Encoder struct {
 	// tableSizeUpdate indicates whether "Header Table Size
 	// Update" is required.
 	tableSizeUpdate bool
-	w               io.Writer
-	buf             []byte
+	// noHuffman disables Huffman coding of string literals.
+	noHuffman bool
+	w         io.Writer
+	buf       []byte
 }
 
 // NewEncoder returns a new Encoder which performs HPACK encoding. An
@@ -69,9 +71,9 @@ func (e *Encoder) WriteField(f HeaderField) error {
 		}
 
 		if idx == 0 {
-			e.buf = appendNewName(e.buf, f, indexing)
+			e.buf = appendNewName(e.buf, f, indexing, !e.noHuffman)
 		} else {
-			e.buf = appendIndexedName(e.buf, f, idx, indexing)
+			e.buf = appendIndexedName(e.buf, f, idx, indexing, !e.noHuffman)
 		}
 	}
 	n, err := e.w.Write(e.buf)
@@ -128,6 +130,14 @@ func (e *Encoder) SetMaxDynamicTableSize(v uint32) {
 	e.dynTab.setMaxSize(v)
 }
 
+// SetHuffman sets whether string literals are Huffman-encoded when
+// that makes them shorter, as they are by default. Turning it off
+// leaves names and values readable in the encoded output, which can
+// help when debugging.
+func (e *Encoder) SetHuffman(on bool) {
+	e.noHuffman = !on
+}
+
 // SetMaxDynamicTableSizeLimit changes the maximum value that can be
 // specified in SetMaxDynamicTableSize to v. By default, it is set to
 // 4096, which is the same size of the default dynamic header table
@@ -163,11 +173,12 @@ func appendIndexed(dst []byte, i uint64) []byte {
 //
 // If f.Sensitive is true, "Never Indexed" representation is used. If
 // f.Sensitive is false and indexing is true, "Inremental Indexing"
-// representation is used.
-func appendNewName(dst []byte, f HeaderField, indexing bool) []byte {
+// representation is used. Strings are encoded as appendHpackString
+// does.
+func appendNewName(dst []byte, f HeaderField, indexing, huffman bool) []byte {
 	dst = append(dst, encodeTypeByte(indexing, f.Sensitive))
-	dst = appendHpackString(dst, f.Name)
-	return appendHpackString(dst, f.Value)
+	dst = appendHpackString(dst, f.Name, huffman)
+	return appendHpackString(dst, f.Value, huffman)
 }
 
 // appendIndexedName appends f and index i referring indexed name
@@ -176,8 +187,9 @@ func appendNewName(dst []byte, f HeaderField, indexing bool) []byte {
 //
 // If f.Sensitive is true, "Never Indexed" representation is used. If
 // f.Sensitive is false and indexing is true, "Incremental Indexing"
-// representation is used.
-func appendIndexedName(dst []byte, f HeaderField, i uint64, indexing bool) []byte {
+// representation is used. The value is encoded as appendHpackString
+// does.
+func appendIndexedName(dst []byte, f HeaderField, i uint64, indexing, huffman bool) []byte {
 	first := len(dst)
 	var n byte
 	if indexing {
@@ -187,7 +199,7 @@ func appendIndexedName(dst []byte, f HeaderField, i uint64, indexing bool) []byt
 	}
 	dst = appendVarInt(dst, n, i)
 	dst[first] |= encodeTypeByte(indexing, f.Sensitive)
-	return appendHpackString(dst, f.Value)
+	return appendHpackString(dst, f.Value, huffman)
 }
 
 // appendTableSize appends v, as encoded in "Header Table Size Update"
@@ -220,11 +232,10 @@ func appendVarInt(dst []byte, n byte, i uint64) []byte {
 // appendHpackString appends s, as encoded in "String Literal"
 // representation, to dst and returns the the extended buffer.
 //
-// s will be encoded in Huffman codes only when it produces strictly
-// shorter byte string.
-func appendHpackString(dst []byte, s string) []byte {
-	huffmanLength := HuffmanEncodeLength(s)
-	if huffmanLength < uint64(len(s)) {
+// If huffman is true, s will be encoded in Huffman codes only when it
+// produces strictly shorter byte string.
+func appendHpackString(dst []byte, s string, huffman bool) []byte {
+	if huffmanLength := HuffmanEncodeLength(s); huffman && huffmanLength < uint64(len(s)) {
 		first := len(dst)
 		dst = appendVarInt(dst, 7, huffmanLength)
 		dst = AppendHuffmanString(dst, s)
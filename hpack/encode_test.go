@@ -153,22 +153,27 @@ func TestAppendVarInt(t *testing.T) {
 
 func TestAppendHpackString(t *testing.T) {
 	tests := []struct {
-		s, wantHex string
+		s       string
+		huffman bool
+		wantHex string
 	}{
 		// Huffman encoded
-		{"www.example.com", "8c f1e3 c2e5 f23a 6ba0 ab90 f4ff"},
+		{"www.example.com", true, "8c f1e3 c2e5 f23a 6ba0 ab90 f4ff"},
 
 		// Not Huffman encoded
-		{"a", "01 61"},
+		{"a", true, "01 61"},
+
+		// Huffman disabled
+		{"www.example.com", false, "0f 7777 772e 6578 616d 706c 652e 636f 6d"},
 
 		// zero length
-		{"", "00"},
+		{"", true, "00"},
 	}
 	for _, tt := range tests {
 		want := removeSpace(tt.wantHex)
-		buf := appendHpackString(nil, tt.s)
+		buf := appendHpackString(nil, tt.s, tt.huffman)
 		if got := hex.EncodeToString(buf); want != got {
-			t.Errorf("appendHpackString(nil, %q) = %q; want %q", tt.s, got, want)
+			t.Errorf("appendHpackString(nil, %q, %v) = %q; want %q", tt.s, tt.huffman, got, want)
 		}
 	}
 }
@@ -213,7 +218,7 @@ func TestAppendNewName(t *testing.T) {
 	}
 	for _, tt := range tests {
 		want := removeSpace(tt.wantHex)
-		buf := appendNewName(nil, tt.f, tt.indexing)
+		buf := appendNewName(nil, tt.f, tt.indexing, true)
 		if got := hex.EncodeToString(buf); want != got {
 			t.Errorf("appendNewName(nil, %+v, %v) = %q; want %q", tt.f, tt.indexing, got, want)
 		}
@@ -239,7 +244,7 @@ func TestAppendIndexedName(t *testing.T) {
 	}
 	for _, tt := range tests {
 		want := removeSpace(tt.wantHex)
-		buf := appendIndexedName(nil, tt.f, tt.i, tt.indexing)
+		buf := appendIndexedName(nil, tt.f, tt.i, tt.indexing, true)
 		if got := hex.EncodeToString(buf); want != got {
 			t.Errorf("appendIndexedName(nil, %+v, %v) = %q; want %q", tt.f, tt.indexing, got, want)
 		}
@@ -326,6 +331,32 @@ func TestEncoderSetMaxDynamicTableSizeLimit(t *testing.T) {
 	}
 }
 
+func TestEncoderSetHuffman(t *testing.T) {
+	f := HeaderField{Name: "x-id", Value: strings.Repeat("0123456789", 10)}
+	var sizes [2]int
+	for i, on := range []bool{false, true} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetHuffman(on)
+		if err := e.WriteField(f); err != nil {
+			t.Fatal(err)
+		}
+		sizes[i] = buf.Len()
+
+		var got []HeaderField
+		d := NewDecoder(initialHeaderTableSize, func(f HeaderField) { got = append(got, f) })
+		if _, err := d.Write(buf.Bytes()); err != nil {
+			t.Fatalf("SetHuffman(%v): decoding: %v", on, err)
+		}
+		if len(got) != 1 || got[0] != f {
+			t.Errorf("SetHuffman(%v): decoded %v; want %v", on, got, f)
+		}
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("encoded size with Huffman = %d; want less than the %d without", sizes[1], sizes[0])
+	}
+}
+
 func removeSpace(s string) string {
 	return strings.Replace(s, " ", "", -1)
 }
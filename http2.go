@@ -45,6 +45,11 @@ const (
 
 	initialWindowSize = 65535 // 6.9.2 Initial Flow Control Window Size
 
+	// 5.3.5 Default Priorities: "All streams are initially
+	// assigned ... a default weight of 16." Zero-indexed, as in
+	// PriorityParam.
+	defaultStreamWeight = 15
+
 	defaultMaxReadFrameSize = 1 << 20
 )
 
@@ -75,7 +80,10 @@ var stateName = [...]string{
 }
 
 func (st streamState) String() string {
-	return stateName[st]
+	if st >= 0 && int(st) < len(stateName) {
+		return stateName[st]
+	}
+	return fmt.Sprintf("UNKNOWN_STREAM_STATE_%d", int(st))
 }
 
 // Setting is a setting parameter: which setting it is, and its value.
@@ -50,6 +50,25 @@ func TestSettingString(t *testing.T) {
 	}
 }
 
+func TestStreamStateString(t *testing.T) {
+	tests := []struct {
+		st   streamState
+		want string
+	}{
+		{stateIdle, "Idle"},
+		{stateHalfClosedRemote, "HalfClosedRemote"},
+		{stateClosed, "Closed"},
+		{stateClosed + 1, "UNKNOWN_STREAM_STATE_7"},
+		{-1, "UNKNOWN_STREAM_STATE_-1"},
+	}
+	for i, tt := range tests {
+		got := fmt.Sprint(tt.st)
+		if got != tt.want {
+			t.Errorf("%d. for %d, string = %q; want %q", i, int(tt.st), got, tt.want)
+		}
+	}
+}
+
 type twriter struct {
 	t  testing.TB
 	st *serverTester // optional
@@ -58,11 +77,14 @@ type twriter struct {
 func (w twriter) Write(p []byte) (n int, err error) {
 	if w.st != nil {
 		ps := string(p)
+		w.st.logMu.Lock()
 		for _, phrase := range w.st.logFilter {
 			if strings.Contains(ps, phrase) {
+				w.st.logMu.Unlock()
 				return len(p), nil // no logging
 			}
 		}
+		w.st.logMu.Unlock()
 	}
 	w.t.Logf("%s", p)
 	return len(p), nil
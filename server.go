@@ -42,17 +42,24 @@ package http2
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bradfitz/http2/hpack"
@@ -63,14 +70,35 @@ const (
 	firstSettingsTimeout  = 2 * time.Second // should be in-flight with preface anyway
 	handlerChunkWriteSize = 4 << 10
 	defaultMaxStreams     = 250 // TODO: make this 100 as the GFE seems to?
+
+	// maxHeaderContinuations caps the CONTINUATION frames in one
+	// header block. Real clients fill their frames, so even a
+	// header list at the default MaxHeaderBytes needs far fewer.
+	maxHeaderContinuations = 512
 )
 
 var (
 	errClientDisconnected = errors.New("client disconnected")
 	errClosedBody         = errors.New("body closed by handler")
 	errStreamBroken       = errors.New("http2: stream broken")
+	errHandlerPanicked    = errors.New("http2: handler panicked")
+)
+
+// Errors returned by the http.Pusher that handlers' ResponseWriters
+// implement. Push returns http.ErrNotSupported if the client has
+// disabled push.
+var (
+	ErrRecursivePush    = errors.New("http2: recursive push not allowed")
+	ErrPushLimitReached = errors.New("http2: push would exceed peer's SETTINGS_MAX_CONCURRENT_STREAMS")
 )
 
+// SensitiveHeaders is a response header a handler may set to a
+// comma-separated list of header names, such as "Set-Cookie", whose
+// values HPACK must never index, so that neither the connection's
+// dynamic table nor any intermediary stores them (RFC 7541 7.1.3).
+// The header itself isn't sent.
+const SensitiveHeaders = "Http2-Sensitive-Headers"
+
 var responseWriterStatePool = sync.Pool{
 	New: func() interface{} {
 		rws := &responseWriterState{}
@@ -79,6 +107,10 @@ var responseWriterStatePool = sync.Pool{
 	},
 }
 
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} { return gzip.NewWriter(nil) },
+}
+
 // Test hooks.
 var (
 	testHookOnConn        func()
@@ -99,8 +131,11 @@ type Server struct {
 	// concurrent streams that each client may have open at a
 	// time. This is unrelated to the number of http.Handler goroutines
 	// which may be active globally, which is MaxHandlers.
-	// If zero, MaxConcurrentStreams defaults to at least 100, per
-	// the HTTP/2 spec's recommendations.
+	// It's advertised in the server's SETTINGS, and a stream
+	// opened beyond it is reset with REFUSED_STREAM, or with
+	// PROTOCOL_ERROR once the client has acknowledged the limit.
+	// If zero, MaxConcurrentStreams defaults to 250, above the
+	// HTTP/2 spec's recommended minimum of 100.
 	MaxConcurrentStreams uint32
 
 	// MaxReadFrameSize optionally specifies the largest frame
@@ -109,9 +144,214 @@ type Server struct {
 	// default value is used.
 	MaxReadFrameSize uint32
 
+	// MaxDecoderHeaderTableSize optionally specifies the HPACK
+	// dynamic table size the server advertises for decoding
+	// request headers. Once the client acknowledges it, a dynamic
+	// table size update above it is a COMPRESSION_ERROR. If zero,
+	// the HTTP/2 default of 4096 bytes is used.
+	MaxDecoderHeaderTableSize uint32
+
+	// DisableHuffman, if true, makes the server send response
+	// header names and values as plain strings rather than
+	// Huffman-encoded ones, which are usually shorter but harder
+	// to read in a packet capture.
+	DisableHuffman bool
+
 	// PermitProhibitedCipherSuites, if true, permits the use of
 	// cipher suites prohibited by the HTTP/2 spec.
 	PermitProhibitedCipherSuites bool
+
+	// NextProtos optionally lists TLS protocol identifiers, in
+	// addition to "h2", that ConfigureServer registers for
+	// HTTP/2. It lets the server interoperate with clients still
+	// negotiating a draft token. If nil, "h2-14" is registered.
+	NextProtos []string
+
+	// GracefulShutdownTimeout optionally specifies how long a
+	// connection keeps serving its in-flight streams after it has
+	// sent a graceful GOAWAY, before it's closed regardless.
+	// If zero, the connection waits for them to finish; to bound
+	// that, close the http.Server once its Shutdown context is
+	// done.
+	GracefulShutdownTimeout time.Duration
+
+	// WriteTimeout optionally specifies how long the server may
+	// spend on each write to a connection, including flushing it,
+	// before the connection is closed. A write may carry a batch
+	// of up to 16 frames queued together, and the timeout covers
+	// the whole batch. It guards against clients that stop
+	// reading. If zero, writes may block indefinitely.
+	WriteTimeout time.Duration
+
+	// SettingsAckTimeout optionally specifies how long the client
+	// has to acknowledge the server's SETTINGS before the
+	// connection is closed with SETTINGS_TIMEOUT.
+	// If zero, a default of 10 seconds is used.
+	SettingsAckTimeout time.Duration
+
+	// IdleTimeout optionally specifies how long a connection with
+	// no open streams may go without receiving a frame before
+	// it's sent a GOAWAY and closed. If zero, the http.Server's
+	// IdleTimeout is used, and if that's zero too, idle
+	// connections are kept open.
+	IdleTimeout time.Duration
+
+	// ReadIdleTimeout optionally specifies how long a connection
+	// may go without receiving a frame before the server sends
+	// it a PING, to check the client is still there. If zero,
+	// no such health checks are done.
+	ReadIdleTimeout time.Duration
+
+	// PingTimeout optionally specifies how long the server waits
+	// for the ACK of a health check PING before closing the
+	// connection. If zero, a default of 15 seconds is used.
+	PingTimeout time.Duration
+
+	// MaxUploadBufferPerStream optionally specifies how many
+	// bytes of a request body may be buffered before the handler
+	// reads them. It's advertised as the initial stream flow
+	// control window, which is only replenished as the handler
+	// reads, so a faster uploader is held back. If zero or
+	// negative, the HTTP/2 default of 65535 bytes is used.
+	MaxUploadBufferPerStream int32
+
+	// CompressResponses, if true, gzips response bodies for
+	// clients whose Accept-Encoding allows gzip, unless the
+	// handler sets its own Content-Encoding.
+	CompressResponses bool
+
+	// DecompressRequests, if true, transparently gunzips request
+	// bodies sent with "Content-Encoding: gzip". The handler then
+	// sees neither that header nor Content-Length, and the
+	// request's ContentLength is -1.
+	DecompressRequests bool
+
+	// NewWriteScheduler optionally returns the WriteScheduler
+	// deciding which stream's frames each new connection writes
+	// next. It's typically one of this package's
+	// New*WriteScheduler functions, such as
+	// NewPriorityWriteScheduler. If nil, NewFIFOWriteScheduler is
+	// used.
+	NewWriteScheduler func() WriteScheduler
+
+	// OnFrameRead and OnFrameWrite, if non-nil, are called with
+	// every frame the server reads or writes, for debugging.
+	// A frame passed to OnFrameRead is only valid during the
+	// call. Each is called from one goroutine per connection at
+	// a time, but the two may run concurrently.
+	OnFrameRead  func(Frame)
+	OnFrameWrite func(Frame)
+
+	// OnConnOpen and OnConnClose, if non-nil, are called when the
+	// server starts serving a connection and once it's done with
+	// it. The error passed to OnConnClose is why the connection
+	// ended, or nil if the server closed it gracefully.
+	OnConnOpen  func(ConnInfo)
+	OnConnClose func(ConnInfo, error)
+
+	// OnStreamEnd, if non-nil, is called when a request's stream
+	// closes, whether it finished normally, was reset, or its
+	// connection went away. It's called from the connection's
+	// serve goroutine, so it must not block.
+	OnStreamEnd func(streamID uint32, stats StreamStats)
+
+	// Logger optionally receives the server's diagnostics, so
+	// they can go to the application's own logging. If nil,
+	// errors go to the http.Server's ErrorLog, or the log
+	// package's standard logger, and debug messages are only
+	// logged there if VerboseLogs is set.
+	Logger Logger
+
+	stats serverCounters
+
+	mu           sync.Mutex
+	conns        map[*serverConn]bool // active connections; guarded by mu
+	shuttingDown bool                 // startGracefulShutdown was called; guarded by mu
+}
+
+// ServerStats is a snapshot of a Server's counters, as returned by
+// Server.Stats.
+type ServerStats struct {
+	ConnsAccepted uint64
+	StreamsOpened uint64
+	StreamsReset  uint64 // streams ended by RST_STREAM, sent or received
+	GoAwaysSent   uint64
+
+	// FramesRead and FramesWritten count frames by type. Types
+	// that weren't seen are omitted.
+	FramesRead    map[FrameType]uint64
+	FramesWritten map[FrameType]uint64
+}
+
+// serverCounters are the live counters behind ServerStats.
+type serverCounters struct {
+	connsAccepted atomic.Uint64 // also hands out ConnInfo.ID
+	streamsOpened atomic.Uint64
+	streamsReset  atomic.Uint64
+	goAwaysSent   atomic.Uint64
+	framesRead    [256]atomic.Uint64 // by FrameType
+	framesWritten [256]atomic.Uint64 // by FrameType
+}
+
+// Stats returns a snapshot of the server's counters, covering every
+// connection it has served.
+func (s *Server) Stats() ServerStats {
+	c := &s.stats
+	st := ServerStats{
+		ConnsAccepted: c.connsAccepted.Load(),
+		StreamsOpened: c.streamsOpened.Load(),
+		StreamsReset:  c.streamsReset.Load(),
+		GoAwaysSent:   c.goAwaysSent.Load(),
+		FramesRead:    make(map[FrameType]uint64),
+		FramesWritten: make(map[FrameType]uint64),
+	}
+	for t := range c.framesRead {
+		if n := c.framesRead[t].Load(); n > 0 {
+			st.FramesRead[FrameType(t)] = n
+		}
+		if n := c.framesWritten[t].Load(); n > 0 {
+			st.FramesWritten[FrameType(t)] = n
+		}
+	}
+	return st
+}
+
+func (s *Server) countFrameWrite(t FrameType) { s.stats.framesWritten[t].Add(1) }
+
+// countFrameRead counts f and passes it to OnFrameRead.
+func (s *Server) countFrameRead(f Frame) {
+	s.stats.framesRead[f.Header().Type].Add(1)
+	if h := s.OnFrameRead; h != nil {
+		h(f)
+	}
+}
+
+// A Logger receives a Server's diagnostic messages. Its methods may
+// be called concurrently.
+type Logger interface {
+	// Debugf logs a verbose message, such as each frame read
+	// or written. It's called regardless of VerboseLogs.
+	Debugf(format string, args ...interface{})
+
+	// Errorf logs a problem with a connection or request, such
+	// as a protocol error by the client.
+	Errorf(format string, args ...interface{})
+}
+
+// ConnInfo identifies a connection to Server's OnConnOpen and
+// OnConnClose callbacks.
+type ConnInfo struct {
+	// ID is unique among the connections served by a Server.
+	ID         uint64
+	RemoteAddr net.Addr
+}
+
+// StreamStats summarizes a stream for Server's OnStreamEnd callback.
+type StreamStats struct {
+	RequestBodyBytes int64         // DATA payload received from the client
+	ResponseBytes    int64         // DATA payload sent to the client
+	StatusCode       int           // zero if no response headers were sent
+	Duration         time.Duration // from the request's HEADERS to the stream's close
 }
 
 func (s *Server) maxReadFrameSize() uint32 {
@@ -121,6 +361,84 @@ func (s *Server) maxReadFrameSize() uint32 {
 	return defaultMaxReadFrameSize
 }
 
+func (s *Server) maxDecoderHeaderTableSize() uint32 {
+	if v := s.MaxDecoderHeaderTableSize; v > 0 {
+		return v
+	}
+	return initialHeaderTableSize
+}
+
+func (s *Server) pingTimeout() time.Duration {
+	if v := s.PingTimeout; v > 0 {
+		return v
+	}
+	return 15 * time.Second
+}
+
+func (s *Server) settingsAckTimeout() time.Duration {
+	if v := s.SettingsAckTimeout; v > 0 {
+		return v
+	}
+	return 10 * time.Second
+}
+
+func (s *Server) nextProtos() []string {
+	if s.NextProtos != nil {
+		return s.NextProtos
+	}
+	// h2-14 is temporary (as of 2015-03-05) while we wait for all browsers
+	// to switch to "h2".
+	return []string{"h2-14"}
+}
+
+func (s *Server) registerConn(sc *serverConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[*serverConn]bool)
+	}
+	s.conns[sc] = true
+	if s.shuttingDown {
+		// The connection raced with the shutdown; it
+		// gets its GOAWAY right away.
+		sc.startGracefulShutdown()
+	}
+}
+
+func (s *Server) unregisterConn(sc *serverConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, sc)
+}
+
+// startGracefulShutdown asks each active connection to send a GOAWAY
+// and to close once its in-flight streams have finished.
+func (s *Server) startGracefulShutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shuttingDown = true
+	for sc := range s.conns {
+		sc.startGracefulShutdown()
+	}
+}
+
+func (s *Server) initialStreamRecvWindowSize() int32 {
+	if v := s.MaxUploadBufferPerStream; v > 0 {
+		return v
+	}
+	return initialWindowSize
+}
+
+func (s *Server) newWriteScheduler() WriteScheduler {
+	newWS := s.NewWriteScheduler
+	if newWS == nil {
+		newWS = NewFIFOWriteScheduler
+	}
+	ws := newWS()
+	ws.setMaxFrameSize(initialMaxFrameSize)
+	return ws
+}
+
 func (s *Server) maxConcurrentStreams() uint32 {
 	if v := s.MaxConcurrentStreams; v > 0 {
 		return v
@@ -165,20 +483,6 @@ func ConfigureServer(s *http.Server, conf *Server) {
 		}
 	}
 
-	haveNPN := false
-	for _, p := range s.TLSConfig.NextProtos {
-		if p == NextProtoTLS {
-			haveNPN = true
-			break
-		}
-	}
-	if !haveNPN {
-		s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, NextProtoTLS)
-	}
-	// h2-14 is temporary (as of 2015-03-05) while we wait for all browsers
-	// to switch to "h2".
-	s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, "h2-14")
-
 	if s.TLSNextProto == nil {
 		s.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
 	}
@@ -186,43 +490,87 @@ func ConfigureServer(s *http.Server, conf *Server) {
 		if testHookOnConn != nil {
 			testHookOnConn()
 		}
-		conf.handleConn(hs, c, h)
+		conf.handleConn(hs, c, h, nil)
 	}
-	s.TLSNextProto[NextProtoTLS] = protoHandler
-	s.TLSNextProto["h2-14"] = protoHandler // temporary; see above.
+	for _, proto := range append([]string{NextProtoTLS}, conf.nextProtos()...) {
+		haveProto := false
+		for _, p := range s.TLSConfig.NextProtos {
+			if p == proto {
+				haveProto = true
+				break
+			}
+		}
+		if !haveProto {
+			s.TLSConfig.NextProtos = append(s.TLSConfig.NextProtos, proto)
+		}
+		s.TLSNextProto[proto] = protoHandler
+	}
+
+	s.RegisterOnShutdown(conf.startGracefulShutdown)
+}
+
+// ServeConn serves HTTP/2 on c, a connection whose client starts
+// right away with the HTTP/2 connection preface, such as cleartext
+// HTTP/2 (h2c) with prior knowledge. It returns when the connection
+// is done.
+//
+// hs supplies the http.Server settings that also apply to HTTP/2,
+// such as ErrorLog and MaxHeaderBytes, and may be nil. If h is nil,
+// hs.Handler is used, and if that's nil too, http.DefaultServeMux.
+func (srv *Server) ServeConn(hs *http.Server, c net.Conn, h http.Handler) {
+	if hs == nil {
+		hs = new(http.Server)
+	}
+	if h == nil {
+		h = hs.Handler
+	}
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	srv.handleConn(hs, c, h, nil)
 }
 
-func (srv *Server) handleConn(hs *http.Server, c net.Conn, h http.Handler) {
+// handleConn serves c. If up is non-nil, c was upgraded to h2c from
+// HTTP/1.1, and up's request is served as stream 1.
+func (srv *Server) handleConn(hs *http.Server, c net.Conn, h http.Handler, up *h2cUpgrade) {
 	sc := &serverConn{
-		srv:              srv,
-		hs:               hs,
-		conn:             c,
-		remoteAddrStr:    c.RemoteAddr().String(),
-		bw:               newBufferedWriter(c),
-		handler:          h,
-		streams:          make(map[uint32]*stream),
-		readFrameCh:      make(chan frameAndGate),
-		readFrameErrCh:   make(chan error, 1), // must be buffered for 1
-		wantWriteFrameCh: make(chan frameWriteMsg, 8),
-		wroteFrameCh:     make(chan struct{}, 1), // buffered; one send in reading goroutine
-		bodyReadCh:       make(chan bodyReadMsg), // buffering doesn't matter either way
-		doneServing:      make(chan struct{}),
-		advMaxStreams:    srv.maxConcurrentStreams(),
-		writeSched: writeScheduler{
-			maxFrameSize: initialMaxFrameSize,
-		},
+		id:                srv.stats.connsAccepted.Add(1),
+		srv:               srv,
+		hs:                hs,
+		conn:              c,
+		upgrade:           up,
+		remoteAddrStr:     c.RemoteAddr().String(),
+		bw:                newBufferedWriter(c),
+		br:                bufio.NewReader(c),
+		handler:           h,
+		streams:           make(map[uint32]*stream),
+		readFrameCh:       make(chan frameAndGate),
+		readFrameErrCh:    make(chan error, 1), // must be buffered for 1
+		wantWriteFrameCh:  make(chan frameWriteMsg, 8),
+		writeBatchCh:      make(chan []frameWriteMsg, 1), // buffered; serve never waits on the writer
+		wroteFrameCh:      make(chan error, 1),           // buffered; one send in reading goroutine
+		bodyReadCh:        make(chan bodyReadMsg),        // buffering doesn't matter either way
+		doneServing:       make(chan struct{}),
+		shutdownCh:        make(chan struct{}),
+		advMaxStreams:     srv.maxConcurrentStreams(),
+		writeSched:        srv.newWriteScheduler(),
 		initialWindowSize: initialWindowSize,
 		headerTableSize:   initialHeaderTableSize,
 		serveG:            newGoroutineLock(),
 		pushEnabled:       true,
+		clientMaxStreams:  math.MaxUint32, // 6.5.2: "Initially, there is no limit to this value"
 	}
 	sc.flow.add(initialWindowSize)
 	sc.inflow.add(initialWindowSize)
 	sc.hpackEncoder = hpack.NewEncoder(&sc.headerWriteBuf)
+	sc.hpackEncoder.SetHuffman(!srv.DisableHuffman)
 	sc.hpackDecoder = hpack.NewDecoder(initialHeaderTableSize, sc.onNewHeaderField)
 
-	fr := NewFramer(sc.bw, c)
+	fr := NewFramer(sc.bw, sc.br)
 	fr.SetMaxReadFrameSize(srv.maxReadFrameSize())
+	fr.SetMaxWriteFrameSize(initialMaxFrameSize)
+	fr.debugWriteHook = srv.OnFrameWrite
+	fr.countWrite = srv.countFrameWrite
 	sc.framer = fr
 
 	if tc, ok := c.(*tls.Conn); ok {
@@ -274,6 +622,8 @@ func (srv *Server) handleConn(hs *http.Server, c net.Conn, h http.Handler) {
 	if hook := testHookGetServerConn; hook != nil {
 		hook(sc)
 	}
+	srv.registerConn(sc)
+	defer srv.unregisterConn(sc)
 	sc.serve()
 }
 
@@ -302,8 +652,12 @@ func isBadCipher(cipher uint16) bool {
 }
 
 func (sc *serverConn) rejectConn(err ErrCode, debug string) {
-	log.Printf("REJECTING conn: %v, %s", err, debug)
+	sc.logf("REJECTING conn: %v, %s", err, debug)
 	// ignoring errors. hanging up anyway.
+	sc.srv.stats.goAwaysSent.Add(1)
+	if d := sc.srv.WriteTimeout; d > 0 {
+		sc.conn.SetWriteDeadline(time.Now().Add(d))
+	}
 	sc.framer.WriteGoAway(0, err, []byte(debug))
 	sc.bw.Flush()
 	sc.conn.Close()
@@ -313,32 +667,44 @@ func (sc *serverConn) rejectConn(err ErrCode, debug string) {
 // goroutines. Because the Framer interface only permits the most
 // recently-read Frame from being accessed, the readFrames goroutine
 // blocks until it has a frame, passes it to serve, and then waits for
-// serve to be done with it before reading the next one.
+// serve to be done with it before reading the next one. Until it
+// opens the gate, serve may read the frames that have already
+// arrived itself; see processBufferedFrames.
+//
+// A frame the Framer rejected with a StreamError is passed as err
+// instead, with a nil f and g, since the connection survives it.
 type frameAndGate struct {
-	f Frame
-	g gate
+	f   Frame
+	g   gate
+	err error // if f is nil: a StreamError or dataTooLargeError
 }
 
 type serverConn struct {
 	// Immutable:
+	id               uint64 // ConnInfo.ID
 	srv              *Server
 	hs               *http.Server
 	conn             net.Conn
 	bw               *bufferedWriter // writing to conn
+	br               *bufio.Reader   // reading from conn
 	handler          http.Handler
 	framer           *Framer
 	hpackDecoder     *hpack.Decoder
 	doneServing      chan struct{}     // closed when serverConn.serve ends
+	shutdownCh       chan struct{}     // closed to request a graceful shutdown
+	shutdownOnce     sync.Once         // guards closing shutdownCh
 	readFrameCh      chan frameAndGate // written by serverConn.readFrames
 	readFrameErrCh   chan error
 	wantWriteFrameCh chan frameWriteMsg   // from handlers -> serve
-	wroteFrameCh     chan struct{}        // from writeFrameAsync -> serve, tickles more frame writes
+	writeBatchCh     chan []frameWriteMsg // from serve -> writeFrames
+	wroteFrameCh     chan error           // from writeFrameAsync -> serve, tickles more frame writes
 	bodyReadCh       chan bodyReadMsg     // from handlers -> serve
 	testHookCh       chan func()          // code to run on the serve loop
 	flow             flow                 // conn-wide (not stream-specific) outbound flow control
 	inflow           flow                 // conn-wide inbound flow control
 	tlsState         *tls.ConnectionState // shared by all handlers, like net/http
 	remoteAddrStr    string
+	upgrade          *h2cUpgrade // non-nil if upgraded from HTTP/1.1; see serveUpgrade
 
 	// Everything following is owned by the serve loop; use serveG.check():
 	serveG                goroutineLock // used to verify funcs are on serve()
@@ -349,21 +715,38 @@ type serverConn struct {
 	clientMaxStreams      uint32 // SETTINGS_MAX_CONCURRENT_STREAMS from client (our PUSH_PROMISE limit)
 	advMaxStreams         uint32 // our SETTINGS_MAX_CONCURRENT_STREAMS advertised the client
 	curOpenStreams        uint32 // client's number of open streams
+	curPushedStreams      uint32 // our number of open pushed streams
 	maxStreamID           uint32 // max ever seen
+	lastProcessedStreamID uint32 // max handed to a handler; GOAWAY's last-stream-id
+	maxPushPromiseID      uint32 // ID of the last push promise, or 0
 	streams               map[uint32]*stream
 	initialWindowSize     int32
 	headerTableSize       uint32
+	headerTableSizeDirty  bool              // headerTableSize not yet applied to hpackEncoder
+	peerMaxFrameSize      uint32            // client's SETTINGS_MAX_FRAME_SIZE, or 0 if already applied to framer
 	maxHeaderListSize     uint32            // zero means unknown (default)
-	canonHeader           map[string]string // http2-lower-case -> Go-Canonical-Case
+	canonHeader           map[string]string // http2-lower-case -> Go-Canonical-Case, for names sharedCanonHeader didn't take
 	req                   requestParam      // non-zero while reading request headers
 	writingFrame          bool              // started write goroutine but haven't heard back on wroteFrameCh
+	writeBatch            []frameWriteMsg   // reused by startFrameWrite; writeFrameAsync's while writingFrame
 	needsFrameFlush       bool              // last frame write wasn't a flush
-	writeSched            writeScheduler
+	writeSched            WriteScheduler
 	inGoAway              bool // we've started to or sent GOAWAY
 	needToSendGoAway      bool // we need to schedule a GOAWAY frame write
 	goAwayCode            ErrCode
+	goAwayDebugData       string           // why we sent GOAWAY, for the client's benefit
 	shutdownTimerCh       <-chan time.Time // nil until used
 	shutdownTimer         *time.Timer      // nil until used
+	closeErr              error            // why serve is returning; see Server.OnConnClose
+	idleTimerCh           <-chan time.Time // nil if no IdleTimeout
+	idleTimer             *time.Timer      // nil if no IdleTimeout
+	settingsAckTimerCh    <-chan time.Time // nil when no SETTINGS await an ACK
+	settingsAckTimer      *time.Timer      // nil until started
+	readIdleTimerCh       <-chan time.Time // nil if no ReadIdleTimeout
+	readIdleTimer         *time.Timer      // nil if no ReadIdleTimeout
+	pingTimerCh           <-chan time.Time // nil unless a health check PING awaits its ACK
+	pingTimer             *time.Timer      // nil until a health check PING is sent
+	pingData              [8]byte          // of the last health check PING
 
 	// Owned by the writeFrameAsync goroutine:
 	headerWriteBuf bytes.Buffer
@@ -380,8 +763,17 @@ type requestParam struct {
 	header            http.Header
 	method, path      string
 	scheme, authority string
-	sawRegularHeader  bool // saw a non-pseudo header already
-	invalidHeader     bool // an invalid header was seen
+	sawRegularHeader  bool   // saw a non-pseudo header already
+	invalidHeader     bool   // an invalid header was seen
+	headerListSize    uint32 // decoded size so far, as SETTINGS_MAX_HEADER_LIST_SIZE counts it
+	isTrailer         bool   // trailers for stream's request, not a new request
+	blockSize         uint32 // encoded header block bytes so far
+	continuations     int    // CONTINUATION frames so far
+
+	// cookies are the "cookie" fields' values, in order. They're
+	// joined into one Cookie header once the block ends
+	// (8.1.2.5), rather than concatenated one by one.
+	cookies []string
 }
 
 // stream represents a stream. This is the minimal metadata needed by
@@ -403,11 +795,22 @@ type stream struct {
 	flow          flow    // limits writing from Handler to client
 	inflow        flow    // what the client is allowed to POST/etc to us
 	parent        *stream // or nil
-	weight        uint8
+	weight        uint8   // zero-indexed, as in PriorityParam
 	state         streamState
 	sentReset     bool // only true once detached from streams map
 	gotReset      bool // only true once detacted from streams map
 	isPush bool
+
+	// trailer is the request's Trailer map, filled in by the
+	// serve loop, or nil if the request declared no trailers.
+	trailer http.Header
+
+	cancelCtx context.CancelFunc // cancels the request's context
+
+	// For Server.OnStreamEnd:
+	startTime time.Time
+	resStatus int
+	resBytes  int64
 }
 
 func (sc *serverConn) Framer() *Framer  { return sc.framer }
@@ -429,6 +832,13 @@ func (sc *serverConn) state(streamID uint32) (streamState, *stream) {
 	// a client sends a HEADERS frame on stream 7 without ever sending a
 	// frame on stream 5, then stream 5 transitions to the "closed"
 	// state when the first frame for stream 7 is sent or received."
+	if streamID%2 == 0 {
+		// Even IDs are the streams we push.
+		if streamID <= sc.maxPushPromiseID {
+			return stateClosed, nil
+		}
+		return stateIdle, nil
+	}
 	if streamID <= sc.maxStreamID {
 		return stateClosed, nil
 	}
@@ -436,13 +846,17 @@ func (sc *serverConn) state(streamID uint32) (streamState, *stream) {
 }
 
 func (sc *serverConn) vlogf(format string, args ...interface{}) {
-	if VerboseLogs {
+	if l := sc.srv.Logger; l != nil {
+		l.Debugf(format, args...)
+	} else if VerboseLogs {
 		sc.logf(format, args...)
 	}
 }
 
 func (sc *serverConn) logf(format string, args ...interface{}) {
-	if lg := sc.hs.ErrorLog; lg != nil {
+	if l := sc.srv.Logger; l != nil {
+		l.Errorf(format, args...)
+	} else if lg := sc.hs.ErrorLog; lg != nil {
 		lg.Printf(format, args...)
 	} else {
 		log.Printf(format, args...)
@@ -462,9 +876,31 @@ func (sc *serverConn) condlogf(err error, format string, args ...interface{}) {
 	}
 }
 
+// connHeaders are the HTTP/1.x connection-specific header fields,
+// which HTTP/2 messages must not contain. A handler written for
+// HTTP/1.1 may well set them on a response, where they're dropped.
+// TE is handled separately in requests, since "trailers" is allowed.
+var connHeaders = map[string]bool{
+	"connection":        true,
+	"keep-alive":        true,
+	"proxy-connection":  true,
+	"transfer-encoding": true,
+	"upgrade":           true,
+}
+
 func (sc *serverConn) onNewHeaderField(f hpack.HeaderField) {
 	sc.serveG.check()
 	sc.vlogf("got header field %+v", f)
+	if sc.req.headerListSize > sc.advMaxHeaderListSize() {
+		// Already over; don't buffer any more of it.
+		return
+	}
+	sc.req.headerListSize += uint32(len(f.Name) + len(f.Value) + 32)
+	if sc.req.headerListSize > sc.advMaxHeaderListSize() {
+		sc.logf("header list from %v exceeds %d bytes", sc.conn.RemoteAddr(), sc.advMaxHeaderListSize())
+		sc.req.header = nil
+		return
+	}
 	switch {
 	case !validHeader(f.Name):
 		sc.req.invalidHeader = true
@@ -499,14 +935,25 @@ func (sc *serverConn) onNewHeaderField(f hpack.HeaderField) {
 			sc.req.invalidHeader = true
 			return
 		}
+		if f.Value == "" && f.Name != ":authority" {
+			// 8.1.2.3: ":path [...] MUST NOT be empty".
+			// Neither may :method or :scheme. This also
+			// keeps an empty value from hiding a duplicate.
+			sc.logf("empty pseudo-header %q sent", f.Name)
+			sc.req.invalidHeader = true
+			return
+		}
 		*dst = f.Value
+	case connHeaders[f.Name], f.Name == "te" && f.Value != "trailers":
+		// 8.1.2.2 Connection-Specific Header Fields
+		// "An endpoint MUST NOT generate an HTTP/2 message
+		// containing connection-specific header fields; any
+		// message containing connection-specific header
+		// fields MUST be treated as malformed."
+		sc.req.invalidHeader = true
 	case f.Name == "cookie":
 		sc.req.sawRegularHeader = true
-		if s, ok := sc.req.header["Cookie"]; ok && len(s) == 1 {
-			s[0] = s[0] + "; " + f.Value
-		} else {
-			sc.req.header.Add("Cookie", f.Value)
-		}
+		sc.req.cookies = append(sc.req.cookies, f.Value)
 	default:
 		sc.req.sawRegularHeader = true
 		sc.req.header.Add(sc.canonicalHeader(f.Name), f.Value)
@@ -523,11 +970,19 @@ func (sc *serverConn) canonicalHeader(v string) string {
 	if ok {
 		return cv
 	}
-	if sc.canonHeader == nil {
-		sc.canonHeader = make(map[string]string)
+	cv, ok = sharedCanonHeader.get(v)
+	if ok {
+		return cv
 	}
 	cv = http.CanonicalHeaderKey(v)
-	sc.canonHeader[v] = cv
+	// Names the shared cache doesn't take yet are kept here, so
+	// this conn offers each one only once.
+	if !sharedCanonHeader.add(v, cv, sc.id) && len(sc.canonHeader) < maxConnCanonHeaders {
+		if sc.canonHeader == nil {
+			sc.canonHeader = make(map[string]string)
+		}
+		sc.canonHeader[v] = cv
+	}
 	return cv
 }
 
@@ -537,27 +992,102 @@ func (sc *serverConn) readFrames() {
 	g := make(gate, 1)
 	for {
 		f, err := sc.framer.ReadFrame()
+		switch err.(type) {
+		case StreamError, dataTooLargeError:
+			sc.readFrameCh <- frameAndGate{err: err}
+			continue
+		}
 		if err != nil {
 			sc.readFrameErrCh <- err
 			close(sc.readFrameCh)
 			return
 		}
-		sc.readFrameCh <- frameAndGate{f, g}
+		sc.srv.countFrameRead(f)
+		sc.readFrameCh <- frameAndGate{f: f, g: g}
 		// We can't read another frame until this one is
 		// processed, as the ReadFrame interface doesn't copy
 		// memory.  The Frame accessor methods access the last
 		// frame's (shared) buffer. So we wait for the
-		// serve goroutine to tell us it's done:
-		g.Wait()
+		// serve goroutine to tell us it's done. If it hit an
+		// error reading frames itself, it never will.
+		select {
+		case <-g:
+		case <-sc.doneServing:
+			return
+		}
+	}
+}
+
+// frameBuffered reports whether the whole of the next frame has
+// already been read from the conn, so reading it won't block.
+func (sc *serverConn) frameBuffered() bool {
+	if sc.br.Buffered() < frameHeaderLen {
+		return false
+	}
+	hdr, _ := sc.br.Peek(frameHeaderLen)
+	length := int(hdr[0])<<16 | int(hdr[1])<<8 | int(hdr[2])
+	return sc.br.Buffered() >= frameHeaderLen+length
+}
+
+// processBufferedFrames reads and processes the frames that have
+// already arrived, while readFrames waits on its gate, saving a
+// round trip with it for each. A non-nil readErr is an error
+// reading a frame, after which readFrames must not go on; err is an
+// error to handle like processFrame's.
+func (sc *serverConn) processBufferedFrames() (readErr, err error) {
+	sc.serveG.check()
+	for sc.frameBuffered() {
+		f, err := sc.framer.ReadFrame()
+		switch err.(type) {
+		case StreamError, dataTooLargeError:
+			return nil, sc.processRejectedFrame(err)
+		}
+		if err != nil {
+			return err, nil
+		}
+		sc.srv.countFrameRead(f)
+		sc.vlogf("got %v: %#v", f.Header(), f)
+		if err := sc.processFrame(f); err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// writeFrames runs in its own goroutine for the life of the conn,
+// writing the batches of frames startFrameWrite sends it. Unlike a
+// goroutine per write, it keeps the stack a TLS write grows.
+func (sc *serverConn) writeFrames() {
+	for {
+		select {
+		case wms := <-sc.writeBatchCh:
+			sc.writeFrameAsync(wms)
+		case <-sc.doneServing:
+			return
+		}
 	}
 }
 
-// writeFrameAsync runs in its own goroutine and writes a single frame
-// and then reports when it's done.
-// At most one goroutine can be running writeFrameAsync at a time per
-// serverConn.
-func (sc *serverConn) writeFrameAsync(wm frameWriteMsg) {
-	err := wm.write.writeFrame(sc)
+// writeFrameAsync writes a batch of frames, in order, and then
+// reports when it's done. Each frame's writer is told as soon as its
+// own frame is written. It only runs on the writeFrames goroutine.
+func (sc *serverConn) writeFrameAsync(wms []frameWriteMsg) {
+	if d := sc.srv.WriteTimeout; d > 0 {
+		sc.conn.SetWriteDeadline(time.Now().Add(d))
+	}
+	var err error
+	for i, wm := range wms {
+		if err == nil {
+			err = wm.write.writeFrame(sc)
+		}
+		wm.replyToWriter(err)
+		wms[i] = frameWriteMsg{} // don't pin its buffers until reuse
+	}
+	sc.wroteFrameCh <- err // tickle frame selection scheduler
+}
+
+// replyToWriter sends err to wm's waiting writer, if any.
+func (wm frameWriteMsg) replyToWriter(err error) {
 	if ch := wm.done; ch != nil {
 		select {
 		case ch <- err:
@@ -565,7 +1095,6 @@ func (sc *serverConn) writeFrameAsync(wm frameWriteMsg) {
 			panic(fmt.Sprintf("unbuffered done channel passed in for type %T", wm.write))
 		}
 	}
-	sc.wroteFrameCh <- struct{}{} // tickle frame selection scheduler
 }
 
 func (sc *serverConn) closeAllStreamsOnConnClose() {
@@ -582,6 +1111,71 @@ func (sc *serverConn) stopShutdownTimer() {
 	}
 }
 
+func (sc *serverConn) stopSettingsAckTimer() {
+	sc.serveG.check()
+	if t := sc.settingsAckTimer; t != nil {
+		t.Stop()
+	}
+}
+
+func (sc *serverConn) stopIdleTimer() {
+	sc.serveG.check()
+	if t := sc.idleTimer; t != nil {
+		t.Stop()
+	}
+}
+
+func (sc *serverConn) stopPingTimers() {
+	sc.serveG.check()
+	if t := sc.readIdleTimer; t != nil {
+		t.Stop()
+	}
+	if t := sc.pingTimer; t != nil {
+		t.Stop()
+	}
+}
+
+// noteFrameRead restarts the health check timer: a client that
+// sends frames needn't be pinged.
+func (sc *serverConn) noteFrameRead() {
+	sc.serveG.check()
+	if sc.readIdleTimer != nil {
+		sc.readIdleTimer.Reset(sc.srv.ReadIdleTimeout)
+	}
+}
+
+// sendHealthCheckPing pings a client that's gone quiet, unless a
+// health check PING is already waiting for its ACK.
+func (sc *serverConn) sendHealthCheckPing() {
+	sc.serveG.check()
+	if sc.pingTimerCh != nil {
+		return
+	}
+	binary.BigEndian.PutUint64(sc.pingData[:], uint64(time.Now().UnixNano()))
+	sc.writeFrame(frameWriteMsg{write: writePing{sc.pingData}})
+	d := sc.srv.pingTimeout()
+	if sc.pingTimer == nil {
+		sc.pingTimer = time.NewTimer(d)
+	} else {
+		sc.pingTimer.Reset(d)
+	}
+	sc.pingTimerCh = sc.pingTimer.C
+}
+
+// noteIdleActivity restarts the idle timer if the connection has no
+// open streams, and stops it otherwise.
+func (sc *serverConn) noteIdleActivity() {
+	sc.serveG.check()
+	if sc.idleTimer == nil {
+		return
+	}
+	if sc.curOpenStreams == 0 {
+		sc.idleTimer.Reset(sc.idleTimeout())
+	} else {
+		sc.idleTimer.Stop()
+	}
+}
+
 func (sc *serverConn) notePanic() {
 	if testHookOnPanicMu != nil {
 		testHookOnPanicMu.Lock()
@@ -596,44 +1190,115 @@ func (sc *serverConn) notePanic() {
 	}
 }
 
+// noteCloseErr records err as the reason the connection is ending,
+// unless one was already recorded.
+func (sc *serverConn) noteCloseErr(err error) {
+	sc.serveG.check()
+	if sc.closeErr == nil {
+		sc.closeErr = err
+	}
+}
+
+func (sc *serverConn) connInfo() ConnInfo {
+	return ConnInfo{ID: sc.id, RemoteAddr: sc.conn.RemoteAddr()}
+}
+
 func (sc *serverConn) serve() {
 	sc.serveG.check()
 	defer sc.notePanic()
+	if h := sc.srv.OnConnClose; h != nil {
+		defer func() { h(sc.connInfo(), sc.closeErr) }()
+	}
 	defer sc.conn.Close()
 	defer sc.closeAllStreamsOnConnClose()
 	defer sc.stopShutdownTimer()
+	defer sc.stopIdleTimer()
+	defer sc.stopSettingsAckTimer()
+	defer sc.stopPingTimers()
 	defer close(sc.doneServing) // unblocks handlers trying to send
+	go sc.writeFrames()         // exits once doneServing is closed
 
 	sc.vlogf("HTTP/2 connection from %v on %p", sc.conn.RemoteAddr(), sc.hs)
+	if h := sc.srv.OnConnOpen; h != nil {
+		h(sc.connInfo())
+	}
 
-	sc.writeFrame(frameWriteMsg{
-		write: writeSettings{
-			{SettingMaxFrameSize, sc.srv.maxReadFrameSize()},
-			{SettingMaxConcurrentStreams, sc.advMaxStreams},
-
-			// TODO: more actual settings, notably
-			// SettingInitialWindowSize, but then we also
-			// want to bump up the conn window size the
-			// same amount here right after the settings
-		},
-	})
+	settings := writeSettings{
+		{SettingMaxFrameSize, sc.srv.maxReadFrameSize()},
+		{SettingMaxConcurrentStreams, sc.advMaxStreams},
+		{SettingMaxHeaderListSize, sc.advMaxHeaderListSize()},
+		{SettingInitialWindowSize, uint32(sc.srv.initialStreamRecvWindowSize())},
+	}
+	if v := sc.srv.maxDecoderHeaderTableSize(); v != initialHeaderTableSize {
+		settings = append(settings, Setting{SettingHeaderTableSize, v})
+	}
+	sc.writeFrame(frameWriteMsg{write: settings})
 	sc.unackedSettings++
+	if diff := sc.srv.initialStreamRecvWindowSize() - initialWindowSize; diff > 0 {
+		// Let the connection window hold a whole stream's
+		// buffer, too.
+		sc.sendWindowUpdate(nil, int(diff))
+	}
 
 	if err := sc.readPreface(); err != nil {
 		sc.condlogf(err, "error reading preface from client %v: %v", sc.conn.RemoteAddr(), err)
+		sc.noteCloseErr(err)
+		if _, ok := err.(badPrefaceError); ok {
+			// The spec allows just hanging up, but a client
+			// that got the preface slightly wrong is easier
+			// to debug with a GOAWAY.
+			sc.flushGoAway(ErrCodeProtocol, "bad connection preface")
+		}
 		return
 	}
 
+	if sc.upgrade != nil {
+		if err := sc.serveUpgrade(); err != nil {
+			sc.logf("error serving h2c upgrade request from %v: %v", sc.conn.RemoteAddr(), err)
+			sc.noteCloseErr(err)
+			return
+		}
+	}
+
 	go sc.readFrames() // closed by defer sc.conn.Close above
 
+	sc.settingsAckTimer = time.NewTimer(sc.srv.settingsAckTimeout())
+	sc.settingsAckTimerCh = sc.settingsAckTimer.C
+
+	if d := sc.idleTimeout(); d > 0 {
+		sc.idleTimer = time.NewTimer(d)
+		sc.idleTimerCh = sc.idleTimer.C
+	}
+	if d := sc.srv.ReadIdleTimeout; d > 0 {
+		sc.readIdleTimer = time.NewTimer(d)
+		sc.readIdleTimerCh = sc.readIdleTimer.C
+	}
+
 	settingsTimer := time.NewTimer(firstSettingsTimeout)
+	shutdownCh := sc.shutdownCh
 	for {
 		select {
 		case wm := <-sc.wantWriteFrameCh:
-			sc.writeFrame(wm)
-		case <-sc.wroteFrameCh:
+			sc.writeFramesFromHandlers(wm)
+		case err := <-sc.wroteFrameCh:
 			sc.writingFrame = false
+			if err != nil {
+				// The conn is broken, or the client
+				// stopped reading past WriteTimeout.
+				sc.condlogf(err, "error writing frame to %v: %v", sc.conn.RemoteAddr(), err)
+				sc.noteCloseErr(err)
+				return
+			}
+			if d := sc.srv.GracefulShutdownTimeout; d > 0 && sc.inGoAway && !sc.needToSendGoAway && sc.shutdownTimer == nil {
+				// The graceful GOAWAY is out. Bound how long
+				// the remaining streams have to finish.
+				sc.shutDownIn(d)
+			}
 			sc.scheduleFrameWrite()
+			if sc.goAwayDrained() {
+				sc.vlogf("graceful shutdown done; closing conn from %v", sc.conn.RemoteAddr())
+				return
+			}
 		case fg, ok := <-sc.readFrameCh:
 			if !ok {
 				sc.readFrameCh = nil
@@ -641,6 +1306,12 @@ func (sc *serverConn) serve() {
 			if !sc.processFrameFromReader(fg, ok) {
 				return
 			}
+			sc.noteFrameRead()
+			sc.noteIdleActivity()
+			if sc.goAwayDrained() {
+				sc.vlogf("graceful shutdown done; closing conn from %v", sc.conn.RemoteAddr())
+				return
+			}
 			if settingsTimer.C != nil {
 				settingsTimer.Stop()
 				settingsTimer.C = nil
@@ -649,42 +1320,103 @@ func (sc *serverConn) serve() {
 			sc.noteBodyRead(m.st, m.n)
 		case <-settingsTimer.C:
 			sc.logf("timeout waiting for SETTINGS frames from %v", sc.conn.RemoteAddr())
+			sc.noteCloseErr(errors.New("timeout waiting for SETTINGS frames"))
 			return
+		case <-sc.settingsAckTimerCh:
+			sc.settingsAckTimerCh = nil
+			sc.logf("timeout waiting for SETTINGS ACK from %v", sc.conn.RemoteAddr())
+			sc.goAwayDebug(ErrCodeSettingsTimeout, "timeout waiting for SETTINGS ACK")
 		case <-sc.shutdownTimerCh:
 			sc.vlogf("GOAWAY close timer fired; closing conn from %v", sc.conn.RemoteAddr())
 			return
+		case <-sc.readIdleTimerCh:
+			sc.vlogf("no frames read in %v; sending PING to %v", sc.srv.ReadIdleTimeout, sc.conn.RemoteAddr())
+			sc.sendHealthCheckPing()
+		case <-sc.pingTimerCh:
+			sc.logf("timeout waiting for PING ACK from %v; closing conn", sc.conn.RemoteAddr())
+			sc.noteCloseErr(errors.New("timeout waiting for PING ACK"))
+			return
+		case <-sc.idleTimerCh:
+			if sc.curOpenStreams == 0 {
+				sc.vlogf("idle timeout; sending GOAWAY to %v", sc.conn.RemoteAddr())
+				sc.goAwayDebug(ErrCodeNo, "idle timeout")
+			}
+		case <-shutdownCh:
+			shutdownCh = nil
+			sc.goAway(ErrCodeNo)
 		case fn := <-sc.testHookCh:
 			fn()
 		}
 	}
 }
 
+// badPrefaceError is returned by readPreface when the client's
+// greeting isn't the HTTP/2 connection preface.
+type badPrefaceError []byte
+
+func (e badPrefaceError) Error() string { return fmt.Sprintf("bogus greeting %q", []byte(e)) }
+
 // readPreface reads the ClientPreface greeting from the peer
 // or returns an error on timeout or an invalid greeting.
 func (sc *serverConn) readPreface() error {
-	errc := make(chan error, 1)
-	go func() {
-		// Read the client preface
-		buf := make([]byte, len(ClientPreface))
-		if _, err := io.ReadFull(sc.conn, buf); err != nil {
-			errc <- err
-		} else if !bytes.Equal(buf, clientPreface) {
-			errc <- fmt.Errorf("bogus greeting %q", buf)
-		} else {
-			errc <- nil
-		}
-	}()
-	timer := time.NewTimer(prefaceTimeout) // TODO: configurable on *Server?
-	defer timer.Stop()
-	select {
-	case <-timer.C:
-		return errors.New("timeout waiting for client preface")
-	case err := <-errc:
-		if err == nil {
-			sc.vlogf("client %v said hello", sc.conn.RemoteAddr())
+	sc.conn.SetReadDeadline(time.Now().Add(sc.prefaceTimeout()))
+	defer sc.conn.SetReadDeadline(time.Time{})
+
+	buf := make([]byte, len(ClientPreface))
+	if _, err := io.ReadFull(sc.br, buf); err != nil {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			return errors.New("timeout waiting for client preface")
 		}
 		return err
 	}
+	if !bytes.Equal(buf, clientPreface) {
+		return badPrefaceError(buf)
+	}
+	sc.vlogf("client %v said hello", sc.conn.RemoteAddr())
+	return nil
+}
+
+// idleTimeout returns how long a connection without open streams may
+// stay quiet, or zero for no limit.
+func (sc *serverConn) idleTimeout() time.Duration {
+	if d := sc.srv.IdleTimeout; d > 0 {
+		return d
+	}
+	return sc.hs.IdleTimeout
+}
+
+// prefaceTimeout returns how long to wait for the client preface:
+// the http.Server's ReadTimeout if set, else a default.
+func (sc *serverConn) prefaceTimeout() time.Duration {
+	if d := sc.hs.ReadTimeout; d > 0 {
+		return d
+	}
+	return prefaceTimeout
+}
+
+// advMaxHeaderListSize returns the SETTINGS_MAX_HEADER_LIST_SIZE we
+// advertise and enforce, derived from the http.Server's
+// MaxHeaderBytes.
+func (sc *serverConn) advMaxHeaderListSize() uint32 {
+	n := sc.hs.MaxHeaderBytes
+	if n <= 0 {
+		n = http.DefaultMaxHeaderBytes
+	}
+	// HTTP/2 counts 32 bytes of overhead per field, which
+	// MaxHeaderBytes doesn't. Allow for a typical number of
+	// fields so the two limits roughly agree.
+	const perFieldOverhead = 32
+	const typicalHeaders = 10
+	return uint32(n + typicalHeaders*perFieldOverhead)
+}
+
+// maxHeaderBlockSize returns how many encoded bytes one header block
+// may span across its HEADERS and CONTINUATION frames. It's well
+// above advMaxHeaderListSize, which hpack-encoded lists rarely exceed
+// in encoded form, so a request just over the list limit still gets
+// a stream error rather than a connection error.
+func (sc *serverConn) maxHeaderBlockSize() uint32 {
+	return 2 * sc.advMaxHeaderListSize()
 }
 
 // writeDataFromHandler writes the data described in req to stream.id.
@@ -705,13 +1437,15 @@ func (sc *serverConn) writeDataFromHandler(stream *stream, writeData *writeData,
 		stream: stream,
 		done:   ch,
 	})
+	// Not stream.cw: the stream is closed as soon as a frame
+	// ending it starts to be written, while writeData and its
+	// buffer are still in use. Every frame serve accepts gets a
+	// reply, even if it's dropped for a closed stream.
 	select {
 	case err := <-ch:
 		return err
 	case <-sc.doneServing:
 		return errClientDisconnected
-	case <-stream.cw:
-		return errStreamBroken
 	}
 }
 
@@ -741,36 +1475,140 @@ func (sc *serverConn) writeFrameFromHandler(wm frameWriteMsg) {
 // If you're not on the serve goroutine, use writeFrameFromHandler instead.
 func (sc *serverConn) writeFrame(wm frameWriteMsg) {
 	sc.serveG.check()
-	sc.writeSched.add(wm)
+	sc.queueFrameWrite(wm)
 	sc.scheduleFrameWrite()
 }
 
-// startFrameWrite starts a goroutine to write wm (in a separate
-// goroutine since that might block on the network), and updates the
-// serve goroutine's state about the world, updated from info in wm.
-func (sc *serverConn) startFrameWrite(wm frameWriteMsg) {
-	sc.serveG.check()
-	if sc.writingFrame {
-		panic("internal error: can only be writing one frame at a time")
+// queueFrameWrite adds wm to the writeSched without scheduling it.
+func (sc *serverConn) queueFrameWrite(wm frameWriteMsg) {
+	if st := wm.stream; st != nil && st.state == stateClosed {
+		// The stream was reset (and its queue forgotten)
+		// before this write arrived. Don't queue it: the
+		// writer may already have given up on it and be
+		// reusing its buffers.
+		wm.replyToWriter(errStreamBroken)
+		return
 	}
+	sc.writeSched.add(wm)
+}
 
-	st := wm.stream
-	if st != nil {
-		switch st.state {
-		case stateHalfClosedLocal:
-			panic("internal error: attempt to send frame on half-closed-local stream")
-		case stateClosed:
-			if st.sentReset || st.gotReset {
-				// Skip this frame. But fake the frame write to reschedule:
-				sc.wroteFrameCh <- struct{}{}
-				return
-			}
-			panic(fmt.Sprintf("internal error: attempt to send a write %v on a closed stream", wm))
+// maxWriteBatch is the most frames one writeFrameAsync call
+// writes. Everything else waits behind the batch, so it's kept small.
+// Server.WriteTimeout's doc cites it.
+const maxWriteBatch = 16
+
+// writeFramesFromHandlers queues wm, and the writes other handlers
+// have already sent on wantWriteFrameCh, before scheduling any of
+// them, so that they can go out together.
+func (sc *serverConn) writeFramesFromHandlers(wm frameWriteMsg) {
+	sc.serveG.check()
+	for {
+		sc.queueFrameWrite(wm)
+		select {
+		case wm = <-sc.wantWriteFrameCh:
+		default:
+			sc.scheduleFrameWrite()
+			return
 		}
 	}
+}
 
+// startFrameWrite hands wm to the writeFrames goroutine (since
+// writing might block on the network), and updates the serve
+// goroutine's state about the world, updated from info in wm.
+//
+// If more is set, the frames the writeSched has ready after wm go in
+// the same batch, up to maxWriteBatch in all, saving a round trip
+// through the serve loop per frame.
+func (sc *serverConn) startFrameWrite(wm frameWriteMsg, more bool) {
+	sc.serveG.check()
+	if sc.writingFrame {
+		panic("internal error: can only be writing one frame at a time")
+	}
+	// Set first, so writes queued by the state changes below
+	// (e.g. a RST_STREAM) wait for this batch.
 	sc.writingFrame = true
-	sc.needsFrameFlush = true
+
+	if sc.headerTableSizeDirty {
+		// No write is in flight, so the encoder is ours.
+		sc.headerTableSizeDirty = false
+		sc.hpackEncoder.SetMaxDynamicTableSize(sc.headerTableSize)
+	}
+	if sc.peerMaxFrameSize != 0 {
+		// Likewise the framer's writing side.
+		sc.framer.SetMaxWriteFrameSize(sc.peerMaxFrameSize)
+		sc.peerMaxFrameSize = 0
+	}
+	batch := sc.writeBatch[:0]
+	for {
+		if sc.prepareFrameWrite(wm) {
+			batch = append(batch, wm)
+		}
+		if !more || len(batch) == maxWriteBatch || sc.needToSendGoAway {
+			break
+		}
+		var ok bool
+		if wm, ok = sc.writeSched.take(); !ok {
+			break
+		}
+	}
+	sc.writeBatch = batch
+	if len(batch) == 0 {
+		// Nothing to write. But fake the frame write to
+		// reschedule. The buffered send can't block: nothing
+		// else sends on wroteFrameCh until serve receives it
+		// and clears writingFrame.
+		sc.wroteFrameCh <- nil
+		return
+	}
+	sc.needsFrameFlush = true
+	sc.writeBatchCh <- batch
+}
+
+// prepareFrameWrite updates the serve goroutine's state for wm, about
+// to be written. It reports false if wm is to be skipped instead, in
+// which case its writer has already been told why.
+func (sc *serverConn) prepareFrameWrite(wm frameWriteMsg) bool {
+	st := wm.stream
+	if st != nil {
+		switch st.state {
+		case stateHalfClosedLocal:
+			panic("internal error: attempt to send frame on half-closed-local stream")
+		case stateClosed:
+			if st.sentReset || st.gotReset {
+				// Skip this frame, and let any handler
+				// waiting on it know it won't happen:
+				wm.replyToWriter(errStreamBroken)
+				return false
+			}
+			panic(fmt.Sprintf("internal error: attempt to send a write %v on a closed stream", wm))
+		}
+	}
+
+	if wpp, ok := wm.write.(*writePushPromise); ok {
+		id, err := sc.startPush(wpp, st)
+		if err != nil {
+			// Nothing to write, as for a reset stream above.
+			wm.replyToWriter(err)
+			return false
+		}
+		wpp.promisedID = id
+	}
+
+	if st != nil {
+		switch w := wm.write.(type) {
+		case *writeData:
+			st.resBytes += int64(len(w.p))
+		case *writeResHeaders:
+			if w.trailers == nil {
+				st.resStatus = w.httpResCode
+			}
+		}
+	}
+	if _, ok := wm.write.(handlerPanicRST); ok {
+		st.sentReset = true
+		sc.closeStream(st, errHandlerPanicked)
+	}
 	if endsStream(wm.write) {
 		if st == nil {
 			panic("internal error: expecting non-nil stream")
@@ -792,7 +1630,7 @@ func (sc *serverConn) startFrameWrite(wm frameWriteMsg) {
 			sc.closeStream(st, nil)
 		}
 	}
-	go sc.writeFrameAsync(wm)
+	return true
 }
 
 // scheduleFrameWrite tickles the frame writing scheduler.
@@ -806,7 +1644,9 @@ func (sc *serverConn) startFrameWrite(wm frameWriteMsg) {
 // highest priority stream.
 //
 // If a frame isn't being written and there's nothing else to send, we
-// flush the write buffer.
+// flush the write buffer. Until the client's first SETTINGS frame
+// arrives, our own SETTINGS stay buffered so they go out in the same
+// write as the ACK of theirs.
 func (sc *serverConn) scheduleFrameWrite() {
 	sc.serveG.check()
 	if sc.writingFrame {
@@ -814,49 +1654,104 @@ func (sc *serverConn) scheduleFrameWrite() {
 	}
 	if sc.needToSendGoAway {
 		sc.needToSendGoAway = false
+		sc.srv.stats.goAwaysSent.Add(1)
 		sc.startFrameWrite(frameWriteMsg{
 			write: &writeGoAway{
-				maxStreamID: sc.maxStreamID,
+				maxStreamID: sc.lastProcessedStreamID,
 				code:        sc.goAwayCode,
+				debug:       sc.goAwayDebugData,
 			},
-		})
+		}, false)
 		return
 	}
 	if sc.needToSendSettingsAck {
 		sc.needToSendSettingsAck = false
-		sc.startFrameWrite(frameWriteMsg{write: writeSettingsAck{}})
+		sc.startFrameWrite(frameWriteMsg{write: writeSettingsAck{}}, false)
 		return
 	}
-	if !sc.inGoAway {
+	if !sc.inGoAway || sc.goAwayCode == ErrCodeNo {
+		// After a graceful GOAWAY, in-flight streams may
+		// still finish writing their responses.
 		if wm, ok := sc.writeSched.take(); ok {
-			sc.startFrameWrite(wm)
+			sc.startFrameWrite(wm, true)
 			return
 		}
 	}
-	if sc.needsFrameFlush {
-		sc.startFrameWrite(frameWriteMsg{write: flushFrameWriter{}})
+	if sc.needsFrameFlush && (sc.sawFirstSettings || sc.inGoAway) {
+		sc.startFrameWrite(frameWriteMsg{write: flushFrameWriter{}}, false)
 		sc.needsFrameFlush = false // after startFrameWrite, since it sets this true
 		return
 	}
 }
 
-func (sc *serverConn) goAway(code ErrCode) {
+// goAwayDrained reports whether a graceful GOAWAY has been written
+// and flushed and no streams remain, so the connection can be closed.
+func (sc *serverConn) goAwayDrained() bool {
+	sc.serveG.check()
+	return sc.inGoAway && sc.goAwayCode == ErrCodeNo && !sc.needToSendGoAway &&
+		!sc.writingFrame && sc.curOpenStreams == 0 && sc.curPushedStreams == 0
+}
+
+// startGracefulShutdown gracefully shuts down a connection. This
+// sends GOAWAY with ErrCodeNo to tell the client we're gracefully
+// shutting down. The connection isn't closed until all current
+// streams are done.
+//
+// It may be called from any goroutine.
+func (sc *serverConn) startGracefulShutdown() {
+	sc.shutdownOnce.Do(func() { close(sc.shutdownCh) })
+}
+
+func (sc *serverConn) goAway(code ErrCode) { sc.goAwayDebug(code, "") }
+
+// maxGoAwayDebugLen caps the debug data sent in a GOAWAY.
+const maxGoAwayDebugLen = 256
+
+// goAwayDebug is like goAway, but also sends debug, a short
+// human-readable reason, as the GOAWAY's debug data.
+func (sc *serverConn) goAwayDebug(code ErrCode, debug string) {
 	sc.serveG.check()
 	if sc.inGoAway {
 		return
 	}
+	if len(debug) > maxGoAwayDebugLen {
+		debug = debug[:maxGoAwayDebugLen]
+	}
+	sc.goAwayDebugData = debug
 	if code != ErrCodeNo {
+		sc.noteCloseErr(ConnectionError(code))
 		sc.shutDownIn(250 * time.Millisecond)
-	} else {
-		// TODO: configurable
-		sc.shutDownIn(1 * time.Second)
 	}
+	// Otherwise the serve loop hangs up once the GOAWAY is
+	// written and the remaining streams have finished, or any
+	// GracefulShutdownTimeout fires.
 	sc.inGoAway = true
 	sc.needToSendGoAway = true
 	sc.goAwayCode = code
 	sc.scheduleFrameWrite()
 }
 
+// flushGoAway sends a GOAWAY and waits for it, and anything being
+// written before it, to be flushed. It's for closing a connection
+// before the serve loop has started; it gives up with the shutdown
+// timer started by goAway.
+func (sc *serverConn) flushGoAway(code ErrCode, debug string) {
+	sc.serveG.check()
+	sc.goAwayDebug(code, debug)
+	for sc.writingFrame || sc.needToSendGoAway || sc.needsFrameFlush {
+		select {
+		case err := <-sc.wroteFrameCh:
+			sc.writingFrame = false
+			if err != nil {
+				return
+			}
+			sc.scheduleFrameWrite()
+		case <-sc.shutdownTimerCh:
+			return
+		}
+	}
+}
+
 func (sc *serverConn) shutDownIn(d time.Duration) {
 	sc.serveG.check()
 	sc.shutdownTimer = time.NewTimer(d)
@@ -894,7 +1789,7 @@ func (sc *serverConn) processFrameFromReader(fg frameAndGate, fgValid bool) bool
 	if !fgValid {
 		err = <-sc.readFrameErrCh
 		if err == ErrFrameTooLarge {
-			sc.goAway(ErrCodeFrameSize)
+			sc.goAwayDebug(ErrCodeFrameSize, "frame too large")
 			return true // goAway will close the loop
 		}
 		clientGone = err == io.EOF || strings.Contains(err.Error(), "use of closed network connection")
@@ -907,15 +1802,28 @@ func (sc *serverConn) processFrameFromReader(fg frameAndGate, fgValid bool) bool
 			// TODO: add CloseWrite to crypto/tls.Conn first
 			// so we have a way to test this? I suppose
 			// just for testing we could have a non-TLS mode.
+			sc.noteCloseErr(err)
 			return false
 		}
 	}
 
-	if fgValid {
+	if fgValid && fg.f == nil {
+		err = sc.processRejectedFrame(fg.err)
+	} else if fgValid {
 		f := fg.f
 		sc.vlogf("got %v: %#v", f.Header(), f)
 		err = sc.processFrame(f)
-		fg.g.Done() // unblock the readFrames goroutine
+		var readErr error
+		if err == nil {
+			readErr, err = sc.processBufferedFrames()
+		}
+		if readErr != nil {
+			// Leave readFrames waiting, and handle the error
+			// below as if it had hit it.
+			err, fgValid = readErr, false
+		} else {
+			fg.g.Done() // unblock the readFrames goroutine
+		}
 		if err == nil {
 			return true
 		}
@@ -926,7 +1834,7 @@ func (sc *serverConn) processFrameFromReader(fg frameAndGate, fgValid bool) bool
 		sc.resetStream(ev)
 		return true
 	case goAwayFlowError:
-		sc.goAway(ErrCodeFlowControl)
+		sc.goAwayDebug(ErrCodeFlowControl, ev.Error())
 		return true
 	case ConnectionError:
 		sc.logf("%v: %v", sc.conn.RemoteAddr(), ev)
@@ -938,10 +1846,28 @@ func (sc *serverConn) processFrameFromReader(fg frameAndGate, fgValid bool) bool
 		} else {
 			sc.logf("disconnection due to other error: %v", err)
 		}
+		sc.noteCloseErr(err)
 	}
 	return false
 }
 
+// processRejectedFrame handles a frame the Framer rejected with
+// err, a StreamError or dataTooLargeError, and returns the error to
+// handle for it.
+func (sc *serverConn) processRejectedFrame(err error) error {
+	sc.serveG.check()
+	if e, ok := err.(dataTooLargeError); ok {
+		err = sc.processDataTooLarge(e.FrameHeader)
+	}
+	if !sc.sawFirstSettings || sc.curHeaderStreamID() != 0 {
+		// The client's first frame must be SETTINGS, and only
+		// CONTINUATION may follow an unfinished header block;
+		// see processFrame.
+		err = ConnectionError(ErrCodeProtocol)
+	}
+	return err
+}
+
 func (sc *serverConn) processFrame(f Frame) error {
 	sc.serveG.check()
 
@@ -978,21 +1904,52 @@ func (sc *serverConn) processFrame(f Frame) error {
 		return sc.processResetStream(f)
 	case *PriorityFrame:
 		return sc.processPriority(f)
+	case *GoAwayFrame:
+		return sc.processGoAway(f)
 	case *PushPromiseFrame:
 		// A client cannot push. Thus, servers MUST treat the receipt of a PUSH_PROMISE
 		// frame as a connection error (Section 5.4.1) of type PROTOCOL_ERROR.
 		return ConnectionError(ErrCodeProtocol)
 	default:
-		log.Printf("Ignoring frame: %v", f.Header())
+		// 4.1: "Implementations MUST ignore and discard any
+		// frame that has a type that is unknown." ReadFrame
+		// already consumed its payload.
+		sc.vlogf("Ignoring frame: %v", f.Header())
 		return nil
 	}
 }
 
+func (sc *serverConn) processGoAway(f *GoAwayFrame) error {
+	sc.serveG.check()
+	if f.ErrCode == ErrCodeNo {
+		sc.vlogf("http2: received GOAWAY from %v: last stream %d", sc.conn.RemoteAddr(), f.LastStreamID)
+	} else {
+		sc.logf("http2: received GOAWAY from %v: last stream %d, %v, debug %q", sc.conn.RemoteAddr(), f.LastStreamID, f.ErrCode, f.DebugData())
+	}
+	// The last stream ID counts the streams we initiated, that
+	// is, pushed ones. Those above it were never processed by
+	// the peer, so there's no point in finishing them.
+	for id, st := range sc.streams {
+		if st.isPush && id > f.LastStreamID {
+			sc.closeStream(st, errClientDisconnected)
+		}
+	}
+	// Finish the streams the client already opened, and don't
+	// start any new pushes.
+	sc.goAway(ErrCodeNo)
+	return nil
+}
+
 func (sc *serverConn) processPing(f *PingFrame) error {
 	sc.serveG.check()
-	if f.Flags.Has(FlagSettingsAck) {
+	if f.Flags.Has(FlagPingAck) {
 		// 6.7 PING: " An endpoint MUST NOT respond to PING frames
 		// containing this flag."
+		if sc.pingTimerCh != nil && f.Data == sc.pingData {
+			// The client passed its health check.
+			sc.pingTimer.Stop()
+			sc.pingTimerCh = nil
+		}
 		return nil
 	}
 	if f.StreamID != 0 {
@@ -1011,7 +1968,14 @@ func (sc *serverConn) processWindowUpdate(f *WindowUpdateFrame) error {
 	sc.serveG.check()
 	switch {
 	case f.StreamID != 0: // stream-level flow control
-		st := sc.streams[f.StreamID]
+		state, st := sc.state(f.StreamID)
+		if state == stateIdle {
+			// 5.1 "idle": "Receiving any frame other than
+			// HEADERS or PRIORITY on a stream in this state
+			// MUST be treated as a connection error (Section
+			// 5.4.1) of type PROTOCOL_ERROR."
+			return ConnectionError(ErrCodeProtocol)
+		}
 		if st == nil {
 			// "WINDOW_UPDATE can be sent by a peer that has sent a
 			// frame bearing the END_STREAM flag. This means that a
@@ -1057,10 +2021,36 @@ func (sc *serverConn) closeStream(st *stream, err error) {
 		panic(fmt.Sprintf("invariant; can't close stream in state %v", st.state))
 	}
 	st.state = stateClosed
-	sc.curOpenStreams--
+	if st.sentReset || st.gotReset {
+		sc.srv.stats.streamsReset.Add(1)
+	}
+	if st.cancelCtx != nil {
+		st.cancelCtx()
+	}
+	if h := sc.srv.OnStreamEnd; h != nil {
+		h(st.id, StreamStats{
+			RequestBodyBytes: st.bodyBytes,
+			ResponseBytes:    st.resBytes,
+			StatusCode:       st.resStatus,
+			Duration:         time.Since(st.startTime),
+		})
+	}
+	if st.isPush {
+		sc.curPushedStreams--
+	} else {
+		sc.curOpenStreams--
+		if sc.curOpenStreams == 0 {
+			sc.noteIdleActivity()
+		}
+	}
 	delete(sc.streams, st.id)
 	if p := st.body; p != nil {
 		p.Close(err)
+		// The handler won't get to read what's left of the
+		// body now, so give it back to the connection's flow
+		// control window, or enough such requests would stall
+		// the connection.
+		sc.sendWindowUpdate(nil, releasePipeBuf(p, true))
 	}
 	st.cw.Close() // signals Handler's CloseNotifier, unblocks writes, etc
 	sc.writeSched.forgetStream(st.id)
@@ -1076,6 +2066,15 @@ func (sc *serverConn) processSettings(f *SettingsFrame) error {
 			// hang up on them anyway.
 			return ConnectionError(ErrCodeProtocol)
 		}
+		if sc.unackedSettings == 0 {
+			sc.stopSettingsAckTimer()
+			sc.settingsAckTimerCh = nil
+			// Until now the client's encoder could still
+			// assume the default table size. From here on it
+			// must keep to the one we advertised, which the
+			// decoder rejects updates beyond (RFC 7541 4.2).
+			sc.hpackDecoder.SetAllowedMaxDynamicTableSize(sc.srv.maxDecoderHeaderTableSize())
+		}
 		return nil
 	}
 	if err := f.ForeachSetting(sc.processSetting); err != nil {
@@ -1094,8 +2093,11 @@ func (sc *serverConn) processSetting(s Setting) error {
 	sc.vlogf("processing setting %v", s)
 	switch s.ID {
 	case SettingHeaderTableSize:
+		// The encoder belongs to the writeFrameAsync
+		// goroutine; startFrameWrite applies this before the
+		// next write.
 		sc.headerTableSize = s.Val
-		sc.hpackEncoder.SetMaxDynamicTableSize(s.Val)
+		sc.headerTableSizeDirty = true
 	case SettingEnablePush:
 		sc.pushEnabled = s.Val != 0
 	case SettingMaxConcurrentStreams:
@@ -1103,7 +2105,8 @@ func (sc *serverConn) processSetting(s Setting) error {
 	case SettingInitialWindowSize:
 		return sc.processSettingInitialWindowSize(s.Val)
 	case SettingMaxFrameSize:
-		sc.writeSched.maxFrameSize = s.Val
+		sc.writeSched.setMaxFrameSize(s.Val)
+		sc.peerMaxFrameSize = s.Val // for startFrameWrite
 	case SettingMaxHeaderListSize:
 		sc.maxHeaderListSize = s.Val
 	default:
@@ -1148,6 +2151,18 @@ func (sc *serverConn) processData(f *DataFrame) error {
 	// or "half closed (local)" state, the recipient MUST respond
 	// with a stream error (Section 5.4.2) of type STREAM_CLOSED."
 	id := f.Header().StreamID
+	data := f.Data()
+	// "The entire DATA frame payload is included in flow
+	// control, including the Pad Length and Padding fields if
+	// present."
+	n := int(f.Header().Length)
+
+	// The connection-level window covers every DATA frame,
+	// whatever the state of its stream.
+	if int(sc.inflow.available()) < n {
+		return ConnectionError(ErrCodeFlowControl)
+	}
+
 	st, ok := sc.streams[id]
 	if !ok || st.state != stateOpen {
 		// This includes sending a RST_STREAM if the stream is
@@ -1155,54 +2170,152 @@ func (sc *serverConn) processData(f *DataFrame) error {
 		// the http.Handler returned, so it's done reading &
 		// done writing). Try to stop the client from sending
 		// more DATA.
+		sc.refundConnFlow(n)
 		return StreamError{id, ErrCodeStreamClosed}
 	}
 	if st.body == nil {
 		panic("internal error: should have a body in this state")
 	}
-	data := f.Data()
 
 	// Sender sending more than they'd declared?
 	if st.declBodyBytes != -1 && st.bodyBytes+int64(len(data)) > st.declBodyBytes {
 		st.body.Close(fmt.Errorf("sender tried to send more than declared Content-Length of %d bytes", st.declBodyBytes))
+		sc.refundConnFlow(n)
 		return StreamError{id, ErrCodeStreamClosed}
 	}
-	if len(data) > 0 {
-		// Check whether the client has flow control quota.
-		if int(st.inflow.available()) < len(data) {
+	if n > 0 {
+		// Check whether the client has stream-level flow control quota.
+		if int(st.inflow.n) < n {
+			sc.refundConnFlow(n)
 			return StreamError{id, ErrCodeFlowControl}
 		}
-		st.inflow.take(int32(len(data)))
-		wrote, err := st.body.Write(data)
-		if err != nil {
-			return StreamError{id, ErrCodeStreamClosed}
+		st.inflow.take(int32(n))
+		if len(data) > 0 {
+			wrote, err := sc.writeRequestBody(st, data)
+			if err != nil {
+				// Already taken from the connection window
+				// above; just give it back.
+				sc.sendWindowUpdate(nil, n)
+				return StreamError{id, ErrCodeStreamClosed}
+			}
+			if wrote != len(data) {
+				panic("internal error: bad Writer")
+			}
+			st.bodyBytes += int64(len(data))
 		}
-		if wrote != len(data) {
-			panic("internal error: bad Writer")
+		// The handler never reads the padding, so its share
+		// of the windows is returned now rather than as the
+		// body is read.
+		if pad := n - len(data); pad > 0 {
+			sc.sendWindowUpdate(nil, pad)
+			sc.sendWindowUpdate(st, pad)
 		}
-		st.bodyBytes += int64(len(data))
 	}
 	if f.StreamEnded() {
-		if st.declBodyBytes != -1 && st.declBodyBytes != st.bodyBytes {
-			st.body.Close(fmt.Errorf("request declared a Content-Length of %d but only wrote %d bytes",
-				st.declBodyBytes, st.bodyBytes))
-		} else {
-			st.body.Close(io.EOF)
-		}
-		st.state = stateHalfClosedRemote
+		sc.endRequestBody(st)
 	}
 	return nil
 }
 
+// requestBodyBufPools holds pools of request body buffers, by size,
+// as servers may differ in MaxUploadBufferPerStream.
+var requestBodyBufPools sync.Map // int -> *sync.Pool
+
+func getRequestBodyBuf(size int) []byte {
+	p, ok := requestBodyBufPools.Load(size)
+	if !ok {
+		p, _ = requestBodyBufPools.LoadOrStore(size, new(sync.Pool))
+	}
+	if buf, ok := p.(*sync.Pool).Get().([]byte); ok {
+		return buf
+	}
+	return make([]byte, size)
+}
+
+func putRequestBodyBuf(buf []byte) {
+	if p, ok := requestBodyBufPools.Load(len(buf)); ok {
+		p.(*sync.Pool).Put(buf)
+	}
+}
+
+// writeRequestBody writes data to st's request body, which gets its
+// buffer with its first DATA, so bodyless requests never need one.
+func (sc *serverConn) writeRequestBody(st *stream, data []byte) (int, error) {
+	sc.serveG.check()
+	p := st.body
+	p.m.Lock()
+	if p.b.buf == nil && !p.b.closed {
+		p.b.buf = getRequestBodyBuf(int(sc.srv.initialStreamRecvWindowSize()))
+	}
+	p.m.Unlock()
+	return p.Write(data)
+}
+
+// endRequestBody is called when the peer half-closes st, with either
+// DATA or trailing HEADERS, so the handler sees the end of the body.
+func (sc *serverConn) endRequestBody(st *stream) {
+	sc.serveG.check()
+	if st.declBodyBytes != -1 && st.declBodyBytes != st.bodyBytes {
+		st.body.Close(fmt.Errorf("request declared a Content-Length of %d but only wrote %d bytes",
+			st.declBodyBytes, st.bodyBytes))
+	} else {
+		st.body.Close(io.EOF)
+	}
+	st.state = stateHalfClosedRemote
+}
+
+// processDataTooLarge handles a DATA frame larger than our
+// SETTINGS_MAX_FRAME_SIZE, whose payload the Framer skipped.
+// Only its stream is reset, but like any DATA it must fit in, and
+// is then returned to, the connection's flow control window.
+func (sc *serverConn) processDataTooLarge(fh FrameHeader) error {
+	sc.serveG.check()
+	n := int(fh.Length)
+	if int(sc.inflow.available()) < n {
+		return ConnectionError(ErrCodeFlowControl)
+	}
+	sc.refundConnFlow(n)
+	return StreamError{fh.StreamID, ErrCodeFrameSize}
+}
+
+// refundConnFlow accounts for n bytes of DATA that the peer charged
+// against the connection-level window but that will never reach a
+// request body, and gives them back to the peer right away.
+func (sc *serverConn) refundConnFlow(n int) {
+	sc.serveG.check()
+	if n == 0 {
+		return
+	}
+	sc.inflow.take(int32(n))
+	sc.sendWindowUpdate(nil, n)
+}
+
 func (sc *serverConn) processHeaders(f *HeadersFrame) error {
 	sc.serveG.check()
 	id := f.Header().StreamID
-	if sc.inGoAway {
-		// Ignore.
-		return nil
+	state, st := sc.state(id)
+	if st != nil && sc.req.stream == nil {
+		// A second HEADERS block on an existing stream
+		// carries the request's trailers. processTrailers
+		// rejects it with STREAM_CLOSED unless the stream is
+		// still open, but only after it's been decoded, since
+		// the block updates the HPACK dynamic table either way.
+		sc.req = requestParam{
+			stream:    st,
+			header:    make(http.Header),
+			isTrailer: true,
+		}
+		if !f.StreamEnded() {
+			// 8.1: "[...] optionally, one HEADERS frame,
+			// followed by zero or more CONTINUATION frames
+			// containing the trailer-part" and that frame
+			// ends the stream.
+			sc.req.invalidHeader = true
+		}
+		return sc.processHeaderBlockFragment(st, f.HeaderBlockFragment(), f.HeadersEnded())
 	}
 	// http://http2.github.io/http2-spec/#rfc.section.5.1.1
-	if id%2 != 1 || id <= sc.maxStreamID || sc.req.stream != nil {
+	if id%2 != 1 || state != stateIdle || sc.req.stream != nil {
 		// Streams initiated by a client MUST use odd-numbered
 		// stream identifiers. [...] The identifier of a newly
 		// established stream MUST be numerically greater than all
@@ -1210,14 +2323,17 @@ func (sc *serverConn) processHeaders(f *HeadersFrame) error {
 		// reserved. [...]  An endpoint that receives an unexpected
 		// stream identifier MUST respond with a connection error
 		// (Section 5.4.1) of type PROTOCOL_ERROR.
+		//
+		// A closed stream's ID is no longer idle, so HEADERS
+		// trying to reopen one lands here too.
 		return ConnectionError(ErrCodeProtocol)
 	}
-	if id > sc.maxStreamID {
-		sc.maxStreamID = id
-	}
-	st := &stream{
-		id:    id,
-		state: stateOpen,
+	sc.maxStreamID = id
+	st = &stream{
+		id:        id,
+		state:     stateOpen,
+		weight:    defaultStreamWeight,
+		startTime: time.Now(),
 	}
 	if f.StreamEnded() {
 		st.state = stateHalfClosedRemote
@@ -1226,14 +2342,15 @@ func (sc *serverConn) processHeaders(f *HeadersFrame) error {
 
 	st.flow.conn = &sc.flow // link to conn-level counter
 	st.flow.add(sc.initialWindowSize)
-	st.inflow.conn = &sc.inflow      // link to conn-level counter
-	st.inflow.add(initialWindowSize) // TODO: update this when we send a higher initial window size in the initial settings
+	st.inflow.conn = &sc.inflow // link to conn-level counter
+	st.inflow.add(sc.srv.initialStreamRecvWindowSize())
 
 	sc.streams[id] = st
 	if f.HasPriority() {
 		adjustStreamPriority(sc.streams, st.id, f.Priority)
 	}
 	sc.curOpenStreams++
+	sc.srv.stats.streamsOpened.Add(1)
 	sc.req = requestParam{
 		stream: st,
 		header: make(http.Header),
@@ -1243,27 +2360,72 @@ func (sc *serverConn) processHeaders(f *HeadersFrame) error {
 
 func (sc *serverConn) processContinuation(f *ContinuationFrame) error {
 	sc.serveG.check()
+	if sc.curHeaderStreamID() == 0 {
+		// A CONTINUATION must follow a HEADERS or CONTINUATION
+		// frame without END_HEADERS; there's no header block
+		// for this one to continue.
+		return ConnectionError(ErrCodeProtocol)
+	}
 	st := sc.streams[f.Header().StreamID]
 	if st == nil || sc.curHeaderStreamID() != st.id {
 		return ConnectionError(ErrCodeProtocol)
 	}
+	sc.req.continuations++
+	if sc.req.continuations > maxHeaderContinuations {
+		sc.logf("too many CONTINUATION frames from %v", sc.conn.RemoteAddr())
+		return ConnectionError(ErrCodeEnhanceYourCalm)
+	}
 	return sc.processHeaderBlockFragment(st, f.HeaderBlockFragment(), f.HeadersEnded())
 }
 
+// hpackDecodeError returns the error to handle for a header block
+// the decoder failed on. The decoder's state, shared by all streams,
+// may now differ from the peer's, so it's a connection error (RFC
+// 7540 section 4.3).
+func (sc *serverConn) hpackDecodeError(err error) error {
+	sc.logf("error decoding header block from %v: %v", sc.conn.RemoteAddr(), err)
+	return ConnectionError(ErrCodeCompression)
+}
+
 func (sc *serverConn) processHeaderBlockFragment(st *stream, frag []byte, end bool) error {
 	sc.serveG.check()
+	sc.req.blockSize += uint32(len(frag))
+	if sc.req.blockSize > sc.maxHeaderBlockSize() {
+		// Too big to be an oversized header list we could
+		// refuse politely; stop decoding and hang up.
+		sc.logf("header block from %v exceeds %d bytes", sc.conn.RemoteAddr(), sc.maxHeaderBlockSize())
+		return ConnectionError(ErrCodeEnhanceYourCalm)
+	}
 	if _, err := sc.hpackDecoder.Write(frag); err != nil {
-		// TODO: convert to stream error I assume?
-		return err
+		return sc.hpackDecodeError(err)
 	}
 	if !end {
 		return nil
 	}
 	if err := sc.hpackDecoder.Close(); err != nil {
-		// TODO: convert to stream error I assume?
-		return err
+		return sc.hpackDecodeError(err)
 	}
 	defer sc.resetPendingRequest()
+	if sc.req.headerListSize > sc.advMaxHeaderListSize() {
+		// We advertised the limit in our SETTINGS. Refuse
+		// the request rather than handing a truncated header
+		// to the handler.
+		return StreamError{st.id, ErrCodeProtocol}
+	}
+	if len(sc.req.cookies) > 0 {
+		sc.req.header.Set("Cookie", strings.Join(sc.req.cookies, "; "))
+	}
+	if sc.req.isTrailer {
+		return sc.processTrailers(st)
+	}
+	if sc.inGoAway {
+		// 6.8: the client may have opened this stream before
+		// it saw our GOAWAY, whose last stream ID is below
+		// it. Its block had to be decoded to keep the HPACK
+		// state in sync, but it isn't processed; the client
+		// may retry it elsewhere.
+		return StreamError{st.id, ErrCodeRefusedStream}
+	}
 	if sc.curOpenStreams > sc.advMaxStreams {
 		// "Endpoints MUST NOT exceed the limit set by their
 		// peer. An endpoint that receives a HEADERS frame
@@ -1283,17 +2445,53 @@ func (sc *serverConn) processHeaderBlockFragment(st *stream, frag []byte, end bo
 		return StreamError{st.id, ErrCodeRefusedStream}
 	}
 
-	rw, req, err := sc.newWriterAndRequest()
+	rw, req, cancel, err := sc.newWriterAndRequest(&sc.req)
 	if err != nil {
 		return err
 	}
+	st.cancelCtx = cancel
 	st.body = req.Body.(*requestBody).pipe // may be nil
-	st.declBodyBytes = req.ContentLength
-	go sc.runHandler(rw, req)
+	st.trailer = req.Trailer
+	// 6.8: a stream refused or rejected above wasn't processed,
+	// so a GOAWAY tells the client it's safe to retry.
+	sc.lastProcessedStreamID = st.id
+	go sc.runHandler(rw, req, cancel)
+	return nil
+}
+
+// processTrailers finishes a trailing HEADERS block for st, which
+// ends the request body.
+func (sc *serverConn) processTrailers(st *stream) error {
+	sc.serveG.check()
+	rp := &sc.req
+	if st.state != stateOpen {
+		return StreamError{st.id, ErrCodeStreamClosed}
+	}
+	if rp.invalidHeader || rp.method != "" || rp.path != "" || rp.scheme != "" || rp.authority != "" {
+		// Trailers carry no pseudo-header fields.
+		return StreamError{st.id, ErrCodeProtocol}
+	}
+	if st.trailer != nil {
+		// Only the declared trailers are kept, as in
+		// net/http. Writing them before the body's EOF
+		// makes them visible to a handler that's read it.
+		for k, vv := range rp.header {
+			if _, ok := st.trailer[k]; ok {
+				st.trailer[k] = vv
+			}
+		}
+	}
+	sc.endRequestBody(st)
 	return nil
 }
 
 func (sc *serverConn) processPriority(f *PriorityFrame) error {
+	if f.StreamDep == f.StreamID {
+		// "A stream cannot depend on itself. An endpoint MUST
+		// treat this as a stream error (Section 5.4.2) of type
+		// PROTOCOL_ERROR."
+		return StreamError{f.StreamID, ErrCodeProtocol}
+	}
 	adjustStreamPriority(sc.streams, f.StreamID, f.PriorityParam)
 	return nil
 }
@@ -1342,25 +2540,60 @@ func (sc *serverConn) resetPendingRequest() {
 	sc.req = requestParam{}
 }
 
-func (sc *serverConn) newWriterAndRequest() (*responseWriter, *http.Request, error) {
+// pseudoHeaderProblem describes the first missing or invalid
+// pseudo-header field in rp, or returns "" if they're all fine.
+func (rp *requestParam) pseudoHeaderProblem() string {
+	if rp.method == "CONNECT" {
+		// 8.3 The CONNECT Method
+		// "The :scheme and :path pseudo-header fields MUST be
+		// omitted." and ":authority [...] contains the host
+		// and port to connect to".
+		switch {
+		case rp.path != "":
+			return "CONNECT request has a :path"
+		case rp.scheme != "":
+			return "CONNECT request has a :scheme"
+		case rp.authority == "":
+			return "CONNECT request missing :authority"
+		}
+		return ""
+	}
+	// 8.1.2.3 Request Pseudo-Header Fields
+	// "All HTTP/2 requests MUST include exactly one valid
+	// value for the :method, :scheme, and :path
+	// pseudo-header fields"
+	switch {
+	case rp.method == "":
+		return "missing :method"
+	case rp.path == "":
+		return "missing :path"
+	case rp.scheme == "":
+		return "missing :scheme"
+	case rp.scheme != "https" && rp.scheme != "http":
+		return fmt.Sprintf("invalid :scheme %q", rp.scheme)
+	}
+	return ""
+}
+
+// newWriterAndRequest builds the request described by rp. It also
+// returns the function that cancels the request's context.
+func (sc *serverConn) newWriterAndRequest(rp *requestParam) (*responseWriter, *http.Request, context.CancelFunc, error) {
 	sc.serveG.check()
-	rp := &sc.req
-	if rp.invalidHeader || rp.method == "" || rp.path == "" ||
-		(rp.scheme != "https" && rp.scheme != "http") {
+	isConnect := rp.method == "CONNECT"
+	if rp.invalidHeader {
 		// See 8.1.2.6 Malformed Requests and Responses:
 		//
 		// Malformed requests or responses that are detected
 		// MUST be treated as a stream error (Section 5.4.2)
 		// of type PROTOCOL_ERROR."
-		//
-		// 8.1.2.3 Request Pseudo-Header Fields
-		// "All HTTP/2 requests MUST include exactly one valid
-		// value for the :method, :scheme, and :path
-		// pseudo-header fields"
-		return nil, nil, StreamError{rp.stream.id, ErrCodeProtocol}
+		return nil, nil, nil, StreamError{rp.stream.id, ErrCodeProtocol}
+	}
+	if problem := rp.pseudoHeaderProblem(); problem != "" {
+		sc.logf("malformed request on stream %d from %v: %s", rp.stream.id, sc.conn.RemoteAddr(), problem)
+		return nil, nil, nil, StreamError{rp.stream.id, ErrCodeProtocol}
 	}
 	var tlsState *tls.ConnectionState // nil if not scheme https
-	if rp.scheme == "https" {
+	if rp.scheme == "https" || isConnect {
 		tlsState = sc.tlsState
 	}
 	authority := rp.authority
@@ -1371,24 +2604,73 @@ func (sc *serverConn) newWriterAndRequest() (*responseWriter, *http.Request, err
 	if needsContinue {
 		rp.header.Del("Expect")
 	}
-	bodyOpen := rp.stream.state == stateOpen
-	body := &requestBody{
-		conn:          sc,
-		stream:        rp.stream,
-		needsContinue: needsContinue,
+	contentLength := int64(-1)
+	if vv, ok := rp.header["Content-Length"]; ok {
+		// 8.1.2.6: "A request or response is also malformed if
+		// the value of a content-length header field does not
+		// equal the sum of the DATA frame payload lengths", so
+		// it had better be a single number in the first place.
+		for _, v := range vv[1:] {
+			if v != vv[0] {
+				return nil, nil, nil, StreamError{rp.stream.id, ErrCodeProtocol}
+			}
+		}
+		cl, err := strconv.ParseUint(vv[0], 10, 63)
+		if err != nil {
+			return nil, nil, nil, StreamError{rp.stream.id, ErrCodeProtocol}
+		}
+		contentLength = int64(cl)
 	}
-	// TODO: handle asterisk '*' requests + test
-	url, err := url.ParseRequestURI(rp.path)
-	if err != nil {
-		// TODO: find the right error code?
-		return nil, nil, StreamError{rp.stream.id, ErrCodeProtocol}
+	bodyOpen := rp.stream.state == stateOpen
+	// The responseWriter and requestBody are allocated together.
+	// Neither comes from a pool: a handler may keep either after
+	// it returns, and must then get a panic or an error, not
+	// another request's body or response.
+	hs := new(handlerState)
+	body := &hs.body
+	body.conn = sc
+	body.stream = rp.stream
+	// A client that already ended the stream isn't waiting to
+	// send a body.
+	body.needsContinue = needsContinue && bodyOpen
+	var reqURL *url.URL
+	requestURI := rp.path
+	if isConnect {
+		// Same as net/http for an authority-form request.
+		reqURL = &url.URL{Host: rp.authority}
+		requestURI = rp.authority
+	} else if rp.path == "*" {
+		// 8.1.2.3: "OPTIONS requests that do not include a
+		// path component [...] MUST include a ":path"
+		// pseudo-header field with a value of '*'". Only
+		// OPTIONS may use this asterisk-form.
+		if rp.method != "OPTIONS" {
+			return nil, nil, nil, StreamError{rp.stream.id, ErrCodeProtocol}
+		}
+		reqURL = new(url.URL)
+	} else if !strings.HasPrefix(rp.path, "/") {
+		// 8.1.2.3: "This pseudo-header field MUST NOT be
+		// empty for http or https URIs [...]" and otherwise
+		// holds the origin-form, not an absolute URI.
+		return nil, nil, nil, StreamError{rp.stream.id, ErrCodeProtocol}
+	} else {
+		var err error
+		reqURL, err = url.ParseRequestURI(rp.path)
+		if err != nil {
+			// TODO: find the right error code?
+			return nil, nil, nil, StreamError{rp.stream.id, ErrCodeProtocol}
+		}
+		// Unlike an HTTP/1 request line, every HTTP/2
+		// request says which scheme and host it's for.
+		reqURL.Scheme = rp.scheme
+		reqURL.Host = authority
 	}
 	req := &http.Request{
 		Method:     rp.method,
-		URL:        url,
+		URL:        reqURL,
 		RemoteAddr: sc.remoteAddrStr,
 		Header:     rp.header,
-		RequestURI: rp.path,
+		RequestURI: requestURI,
 		Proto:      "HTTP/2.0",
 		ProtoMajor: 2,
 		ProtoMinor: 0,
@@ -1396,17 +2678,40 @@ func (sc *serverConn) newWriterAndRequest() (*responseWriter, *http.Request, err
 		Host:       authority,
 		Body:       body,
 	}
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), streamIDKey{}, rp.stream.id))
+	req = req.WithContext(ctx)
 	if bodyOpen {
-		body.pipe = &pipe{
-			b: buffer{buf: make([]byte, initialWindowSize)}, // TODO: share/remove XXX
-		}
+		// The buffer comes from requestBodyBufPools with the
+		// first DATA; see writeRequestBody.
+		body.pipe = &pipe{}
 		body.pipe.c.L = &body.pipe.m
 
-		if vv, ok := rp.header["Content-Length"]; ok {
-			req.ContentLength, _ = strconv.ParseInt(vv[0], 10, 64)
-		} else {
+		req.ContentLength = contentLength
+		// Checked against the DATA received, which stays
+		// compressed even if the handler's body isn't.
+		rp.stream.declBodyBytes = contentLength
+		if sc.srv.DecompressRequests && strings.EqualFold(rp.header.Get("Content-Encoding"), "gzip") {
+			body.gunzip = true
+			// The decoded length is unknown, and the headers
+			// describe the body as sent, not as read.
 			req.ContentLength = -1
+			rp.header.Del("Content-Encoding")
+			rp.header.Del("Content-Length")
+		}
+
+		// Declared trailers start out nil, to be filled in
+		// if the client sends them. Same as net/http.
+		for _, v := range rp.header["Trailer"] {
+			for _, k := range strings.Split(v, ",") {
+				if k = http.CanonicalHeaderKey(strings.TrimSpace(k)); k != "" {
+					if req.Trailer == nil {
+						req.Trailer = make(http.Header)
+					}
+					req.Trailer[k] = nil
+				}
+			}
 		}
+		delete(rp.header, "Trailer")
 	}
 
 	rws := responseWriterStatePool.Get().(*responseWriterState)
@@ -1418,22 +2723,106 @@ func (sc *serverConn) newWriterAndRequest() (*responseWriter, *http.Request, err
 	rws.stream = rp.stream
 	rws.req = req
 	rws.body = body
+	rws.acceptsGzip = sc.srv.CompressResponses && acceptsGzip(req.Header)
 	rws.frameWriteCh = make(chan error, 1)
 
-	rw := &responseWriter{rws: rws}
-	return rw, req, nil
+	rw := &hs.rw
+	rw.rws = rws
+	return rw, req, cancel, nil
+}
+
+// streamIDKey is the context key for the ID of the stream a request
+// arrived on.
+type streamIDKey struct{}
+
+// StreamIDFromContext returns the ID of the HTTP/2 stream carrying
+// the request whose context is ctx. The boolean is false if the
+// request didn't arrive over HTTP/2.
+func StreamIDFromContext(ctx context.Context) (id uint32, ok bool) {
+	id, ok = ctx.Value(streamIDKey{}).(uint32)
+	return
 }
 
 // Run on its own goroutine.
-func (sc *serverConn) runHandler(rw *responseWriter, req *http.Request) {
-	defer rw.handlerDone()
-	// TODO: catch panics like net/http.Server
+func (sc *serverConn) runHandler(rw *responseWriter, req *http.Request, cancel context.CancelFunc) {
+	didPanic := true
+	defer cancel()
+	defer func() {
+		if didPanic {
+			e := recover()
+			if e != http.ErrAbortHandler {
+				// Same as net/http:
+				const size = 64 << 10
+				buf := make([]byte, size)
+				buf = buf[:runtime.Stack(buf, false)]
+				sc.logf("http2: panic serving %v: %v\n%s", sc.conn.RemoteAddr(), e, buf)
+			}
+			rw.rws.handlerPanicked = true
+		}
+		rw.handlerDone()
+	}()
 	sc.handler.ServeHTTP(rw, req)
+	didPanic = false
+}
+
+// startPush reserves a stream for the push promise wpp, sent on
+// parent, and starts the handler serving the pushed request. It
+// returns the promised stream's ID.
+func (sc *serverConn) startPush(wpp *writePushPromise, parent *stream) (uint32, error) {
+	sc.serveG.check()
+	if !sc.pushEnabled || sc.inGoAway {
+		return 0, http.ErrNotSupported
+	}
+	if sc.curPushedStreams+1 > sc.clientMaxStreams {
+		return 0, ErrPushLimitReached
+	}
+	if sc.maxPushPromiseID+2 > 1<<31-1 {
+		// Out of even stream IDs.
+		return 0, ErrPushLimitReached
+	}
+	id := sc.maxPushPromiseID + 2
+
+	// 8.2.1: the promised request can't have a body, so
+	// the client's half of the stream is closed already.
+	st := &stream{
+		id:        id,
+		state:     stateHalfClosedRemote,
+		startTime: time.Now(),
+		isPush:    true,
+		parent:    parent,
+		weight:    defaultStreamWeight,
+	}
+	st.cw.Init()
+	st.flow.conn = &sc.flow
+	st.flow.add(sc.initialWindowSize)
+	st.inflow.conn = &sc.inflow
+	st.inflow.add(sc.srv.initialStreamRecvWindowSize())
+
+	rp := &requestParam{
+		stream:    st,
+		header:    cloneHeader(wpp.h), // wpp.h is still to be written
+		method:    wpp.method,
+		path:      wpp.url.RequestURI(),
+		scheme:    wpp.url.Scheme,
+		authority: wpp.url.Host,
+	}
+	rw, req, cancel, err := sc.newWriterAndRequest(rp)
+	if err != nil {
+		// Push validated the request; this shouldn't happen.
+		return 0, err
+	}
+	sc.maxPushPromiseID = id
+	sc.streams[id] = st
+	sc.curPushedStreams++
+	sc.srv.stats.streamsOpened.Add(1)
+	st.cancelCtx = cancel
+	go sc.runHandler(rw, req, cancel)
+	return id, nil
 }
 
 // called from handler goroutines.
 // h may be nil.
-func (sc *serverConn) writeHeaders(st *stream, headerData *writeResHeaders, tempCh chan error) {
+func (sc *serverConn) writeHeaders(st *stream, headerData *writeResHeaders, tempCh chan error) error {
 	sc.serveG.checkNotOn() // NOT on
 	var errc chan error
 	if headerData.h != nil {
@@ -1449,14 +2838,15 @@ func (sc *serverConn) writeHeaders(st *stream, headerData *writeResHeaders, temp
 		done:   errc,
 	})
 	if errc != nil {
+		// See writeDataFromHandler for why not st.cw.
 		select {
-		case <-errc:
-			// Ignore. Just for synchronization.
-			// Any error will be handled in the writing goroutine.
+		case err := <-errc:
+			return err
 		case <-sc.doneServing:
-			// Client has closed the connection.
+			return errClientDisconnected
 		}
 	}
+	return nil
 }
 
 // called from handler goroutines.
@@ -1479,7 +2869,11 @@ type bodyReadMsg struct {
 // and schedules flow control tokens to be sent.
 func (sc *serverConn) noteBodyReadFromHandler(st *stream, n int) {
 	sc.serveG.checkNotOn() // NOT on
-	sc.bodyReadCh <- bodyReadMsg{st, n}
+	select {
+	case sc.bodyReadCh <- bodyReadMsg{st, n}:
+	case <-sc.doneServing:
+		// The conn's gone; nothing to return the bytes to.
+	}
 }
 
 func (sc *serverConn) noteBodyRead(st *stream, n int) {
@@ -1521,10 +2915,11 @@ func (sc *serverConn) sendWindowUpdate32(st *stream, n int32) {
 	if st != nil {
 		streamID = st.id
 	}
-	sc.writeFrame(frameWriteMsg{
+	sc.writeSched.addWindowUpdate(frameWriteMsg{
 		write:  writeWindowUpdate{streamID: streamID, n: uint32(n)},
 		stream: st,
 	})
+	sc.scheduleFrameWrite()
 	var ok bool
 	if st == nil {
 		ok = sc.inflow.add(n)
@@ -1536,27 +2931,82 @@ func (sc *serverConn) sendWindowUpdate32(st *stream, n int32) {
 	}
 }
 
+// handlerState is what newWriterAndRequest allocates for each handler.
+type handlerState struct {
+	rw   responseWriter
+	body requestBody
+}
+
 type requestBody struct {
-	stream        *stream
-	conn          *serverConn
-	closed        bool
-	pipe          *pipe // non-nil if we have a HTTP entity message body
-	needsContinue bool  // need to send a 100-continue
+	stream *stream
+	conn   *serverConn
+	closed bool
+	pipe   *pipe // non-nil if we have a HTTP entity message body
+
+	continueMu    sync.Mutex // guards needsContinue
+	needsContinue bool       // need to send a 100-continue
+
+	gunzip bool         // decompress the body; see Server.DecompressRequests
+	zr     *gzip.Reader // nil until the first Read, if gunzip
+	zerr   error        // sticky error from creating zr
+}
+
+// sendContinue sends the 100-continue the client is waiting for,
+// unless it's been sent or cancelled already.
+func (b *requestBody) sendContinue() {
+	b.continueMu.Lock()
+	defer b.continueMu.Unlock()
+	if b.needsContinue {
+		b.needsContinue = false
+		b.conn.write100ContinueHeaders(b.stream)
+	}
+}
+
+// cancelContinue is called before the final response headers are
+// sent, after which a 100-continue may no longer be sent.
+// The handler may be reading the body from another goroutine, and
+// holding continueMu keeps a 100 already on its way ordered before
+// the final headers.
+func (b *requestBody) cancelContinue() {
+	b.continueMu.Lock()
+	b.needsContinue = false
+	b.continueMu.Unlock()
 }
 
 func (b *requestBody) Close() error {
 	if b.pipe != nil {
 		b.pipe.Close(errClosedBody)
+		if n := b.releaseBuf(true); n > 0 {
+			// Returned as if read; see serverConn.closeStream.
+			b.conn.noteBodyReadFromHandler(b.stream, n)
+		}
 	}
 	b.closed = true
 	return nil
 }
 
 func (b *requestBody) Read(p []byte) (n int, err error) {
-	if b.needsContinue {
-		b.needsContinue = false
-		b.conn.write100ContinueHeaders(b.stream)
+	if !b.gunzip {
+		return b.readRaw(p)
+	}
+	if b.zr == nil && b.zerr == nil {
+		// Made lazily, as reading the gzip header blocks
+		// until the client sends the body.
+		b.zr, b.zerr = gzip.NewReader(rawRequestBody{b})
 	}
+	if b.zerr != nil {
+		return 0, b.zerr
+	}
+	return b.zr.Read(p)
+}
+
+// rawRequestBody reads a requestBody as the client sent it.
+type rawRequestBody struct{ b *requestBody }
+
+func (r rawRequestBody) Read(p []byte) (n int, err error) { return r.b.readRaw(p) }
+
+func (b *requestBody) readRaw(p []byte) (n int, err error) {
+	b.sendContinue()
 	if b.pipe == nil {
 		return 0, io.EOF
 	}
@@ -1564,9 +3014,37 @@ func (b *requestBody) Read(p []byte) (n int, err error) {
 	if n > 0 {
 		b.conn.noteBodyReadFromHandler(b.stream, n)
 	}
+	if err != nil {
+		// Read to the end; the buffer's done with.
+		b.releaseBuf(false)
+	}
 	return
 }
 
+// releaseBuf returns the body's buffer to requestBodyBufPools once
+// the body is closed, so that nothing more will be written to it, and
+// empty, or its unread data is to be discarded. It returns how many
+// unread bytes were discarded.
+func (b *requestBody) releaseBuf(discard bool) int {
+	return releasePipeBuf(b.pipe, discard)
+}
+
+// releasePipeBuf is requestBody.releaseBuf for the body's pipe p.
+func releasePipeBuf(p *pipe, discard bool) (discarded int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if discard {
+		discarded = p.b.Len()
+		p.b.r = p.b.w
+	}
+	if p.b.buf != nil && p.b.closed && p.b.Len() == 0 {
+		putRequestBodyBuf(p.b.buf)
+		p.b.buf = nil
+		p.b.r, p.b.w = 0, 0
+	}
+	return discarded
+}
+
 // responseWriter is the http.ResponseWriter implementation.  It's
 // intentionally small (1 pointer wide) to minimize garbage.  The
 // responseWriterState pointer inside is zeroed at the end of a
@@ -1594,15 +3072,26 @@ type responseWriterState struct {
 	// TODO: adjust buffer writing sizes based on server config, frame size updates from peer, etc
 	bw *bufio.Writer // writing to a chunkWriter{this *responseWriterState}
 
+	acceptsGzip bool // Server.CompressResponses is set and the client accepts gzip
+
 	// mutated by http.Handler goroutine:
-	handlerHeader http.Header // nil until called
-	snapHeader    http.Header // snapshot of handlerHeader at WriteHeader time
-	status        int         // status code passed to WriteHeader
-	wroteHeader   bool        // WriteHeader called (explicitly or implicitly). Not necessarily sent to user yet.
-	sentHeader    bool        // have we sent the header frame?
-	handlerDone   bool        // handler has finished
-	curWrite      writeData
-	frameWriteCh  chan error // re-used whenever we need to block on a frame being written
+	handlerHeader   http.Header // nil until called
+	snapHeader      http.Header // snapshot of handlerHeader at WriteHeader time
+	status          int         // status code passed to WriteHeader
+	wroteHeader     bool        // WriteHeader called with a final status (explicitly or implicitly). Not necessarily sent to user yet.
+	sentHeader      bool        // have we sent the header frame?
+	handlerDone     bool        // handler has finished
+	handlerPanicked bool        // handler panicked; reset the stream rather than finishing it
+	trailers        []string    // canonical trailer keys to send after the body; set in writeChunk
+	curWrite        writeData
+	frameWriteCh    chan error // re-used whenever we need to block on a frame being written
+
+	// sensitive holds the canonical keys named in the
+	// SensitiveHeaders header at WriteHeader time, or is nil.
+	sensitive map[string]bool
+
+	// gz, if non-nil, gzips the handler's writes into bw.
+	gz *gzip.Writer
 
 	closeNotifierMu sync.Mutex // guards closeNotifierCh
 	closeNotifierCh chan bool  // nil until first used
@@ -1619,49 +3108,136 @@ func (cw chunkWriter) Write(p []byte) (n int, err error) { return cw.rws.writeCh
 // writeChunk is also responsible (on the first chunk) for sending the
 // HEADER response.
 func (rws *responseWriterState) writeChunk(p []byte) (n int, err error) {
+	select {
+	case <-rws.conn.doneServing:
+		// An earlier write may have been abandoned mid-flight,
+		// still using curWrite and frameWriteCh; leave them be.
+		return 0, errClientDisconnected
+	default:
+	}
 	if !rws.wroteHeader {
 		rws.writeHeader(200)
 	}
+	if rws.handlerDone {
+		rws.promoteUndeclaredTrailers()
+	}
 	if !rws.sentHeader {
 		rws.sentHeader = true
+		rws.body.cancelContinue()
 		var ctype, clen string // implicit ones, if we can calculate it
-		if rws.handlerDone && rws.snapHeader.Get("Content-Length") == "" {
+		// If the handler finished without flushing, all of the
+		// body is in p and its length is known. An empty HEAD
+		// response says nothing about the GET body's length,
+		// though, and a status that can't have a body has none.
+		if rws.handlerDone && rws.snapHeader.Get("Content-Length") == "" &&
+			bodyAllowedForStatus(rws.status) &&
+			(len(p) > 0 || rws.req.Method != "HEAD") {
 			clen = strconv.Itoa(len(p))
 		}
-		if rws.snapHeader.Get("Content-Type") == "" {
+		// Like net/http, a Content-Type key set to nil means the
+		// handler wants none sent, and a status that can't have a
+		// body doesn't get one.
+		// A gzipped body can't be sniffed; write sniffs the
+		// uncompressed data instead.
+		_, haveType := rws.snapHeader["Content-Type"]
+		if !haveType && bodyAllowedForStatus(rws.status) && rws.gz == nil {
 			ctype = http.DetectContentType(p)
 		}
-		endStream := rws.handlerDone && len(p) == 0
-		rws.conn.writeHeaders(rws.stream, &writeResHeaders{
+		endStream := rws.handlerDone && len(p) == 0 && !rws.hasTrailers()
+		err = rws.conn.writeHeaders(rws.stream, &writeResHeaders{
 			streamID:      rws.stream.id,
 			httpResCode:   rws.status,
 			h:             rws.snapHeader,
+			sensitive:     rws.sensitive,
 			endStream:     endStream,
 			contentType:   ctype,
 			contentLength: clen,
 		}, rws.frameWriteCh)
+		if err != nil {
+			return 0, err
+		}
 		if endStream {
 			return 0, nil
 		}
 	}
-	if len(p) == 0 && !rws.handlerDone {
-		return 0, nil
+	// With trailers to follow, the last DATA frame doesn't end
+	// the stream; the trailing HEADERS frame does.
+	endStream := rws.handlerDone && !rws.hasTrailers()
+	if len(p) > 0 || endStream {
+		curWrite := &rws.curWrite
+		curWrite.streamID = rws.stream.id
+		curWrite.p = p
+		curWrite.endStream = endStream
+		if err := rws.conn.writeDataFromHandler(rws.stream, curWrite, rws.frameWriteCh); err != nil {
+			return 0, err
+		}
 	}
-	curWrite := &rws.curWrite
-	curWrite.streamID = rws.stream.id
-	curWrite.p = p
-	curWrite.endStream = rws.handlerDone
-	if err := rws.conn.writeDataFromHandler(rws.stream, curWrite, rws.frameWriteCh); err != nil {
-		return 0, err
+	if rws.handlerDone && rws.hasTrailers() {
+		err = rws.conn.writeHeaders(rws.stream, &writeResHeaders{
+			streamID:  rws.stream.id,
+			h:         rws.handlerHeader,
+			trailers:  rws.trailers,
+			sensitive: rws.sensitive,
+			endStream: true,
+		}, rws.frameWriteCh)
+		if err != nil {
+			return 0, err
+		}
 	}
 	return len(p), nil
 }
 
+// hasTrailers reports whether any declared trailer has a value.
+func (rws *responseWriterState) hasTrailers() bool {
+	for _, k := range rws.trailers {
+		if len(rws.handlerHeader[k]) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// declareTrailer records k as a trailer to send once the handler
+// is done, as announced in the "Trailer" response header.
+func (rws *responseWriterState) declareTrailer(k string) {
+	if k == "" || isPseudoHeader(k) {
+		return
+	}
+	k = http.CanonicalHeaderKey(k)
+	for _, v := range rws.trailers {
+		if v == k {
+			return
+		}
+	}
+	rws.trailers = append(rws.trailers, k)
+}
+
+// promoteUndeclaredTrailers moves any headers set with the
+// http.TrailerPrefix convention, which needn't be announced in the
+// "Trailer" header, to the trailers.
+func (rws *responseWriterState) promoteUndeclaredTrailers() {
+	for k, vv := range rws.handlerHeader {
+		if !strings.HasPrefix(k, http.TrailerPrefix) {
+			continue
+		}
+		trailerKey := strings.TrimPrefix(k, http.TrailerPrefix)
+		rws.declareTrailer(trailerKey)
+		rws.handlerHeader[http.CanonicalHeaderKey(trailerKey)] = vv
+	}
+	sort.Strings(rws.trailers) // map order above is random
+}
+
 func (w *responseWriter) Flush() {
 	rws := w.rws
 	if rws == nil {
 		panic("Header called after Handler finished")
 	}
+	if rws.gz != nil {
+		// Push what the compressor holds into rws.bw. The
+		// error, if any, is the frame writer's and it already
+		// knows.
+		rws.gz.Flush()
+	}
 	if rws.bw.Buffered() > 0 {
 		if err := rws.bw.Flush(); err != nil {
 			// Ignore the error. The frame writer already knows.
@@ -1695,6 +3271,99 @@ func (w *responseWriter) CloseNotify() <-chan bool {
 	return ch
 }
 
+// pushForbiddenHeaders are the request headers a push can't carry:
+// those describing a body, which a pushed request can't have, and
+// those the pseudo-headers replace.
+var pushForbiddenHeaders = map[string]bool{
+	"Content-Length":   true,
+	"Content-Encoding": true,
+	"Trailer":          true,
+	"Te":               true,
+	"Expect":           true,
+	"Host":             true,
+}
+
+// Push implements http.Pusher. It sends the client a PUSH_PROMISE
+// for target and serves the promised request with the server's
+// handler, on a new stream. It returns once the PUSH_PROMISE is
+// written, or fails.
+func (w *responseWriter) Push(target string, opts *http.PushOptions) error {
+	rws := w.rws
+	if rws == nil {
+		panic("Push called after Handler finished")
+	}
+	sc := rws.conn
+	sc.serveG.checkNotOn() // NOT on
+	if rws.stream.isPush {
+		return ErrRecursivePush
+	}
+	if opts == nil {
+		opts = new(http.PushOptions)
+	}
+	method := opts.Method
+	if method == "" {
+		method = "GET"
+	}
+	// 8.2: "Promised requests MUST be cacheable [...], MUST be
+	// safe [...] and MUST NOT include a request body."
+	if method != "GET" && method != "HEAD" {
+		return fmt.Errorf("http2: method %q must be GET or HEAD", method)
+	}
+
+	wantScheme := "http"
+	if rws.req.TLS != nil {
+		wantScheme = "https"
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" {
+		if !strings.HasPrefix(target, "/") {
+			return fmt.Errorf("http2: target %q must be an absolute URL or an absolute path", target)
+		}
+		u.Scheme = wantScheme
+		u.Host = rws.req.Host
+	} else {
+		if u.Scheme != wantScheme {
+			return fmt.Errorf("http2: target %q must have scheme %q", target, wantScheme)
+		}
+		if u.Host == "" {
+			return fmt.Errorf("http2: target %q must have a host", target)
+		}
+	}
+
+	h := make(http.Header, len(opts.Header))
+	for k, vv := range opts.Header {
+		if strings.HasPrefix(k, ":") {
+			return fmt.Errorf("http2: pseudo-header %q can't be pushed", k)
+		}
+		ck := http.CanonicalHeaderKey(k)
+		if pushForbiddenHeaders[ck] || connHeaders[strings.ToLower(k)] {
+			return fmt.Errorf("http2: header %q can't be pushed", k)
+		}
+		h[ck] = append([]string(nil), vv...)
+	}
+
+	errc := make(chan error, 1)
+	sc.writeFrameFromHandler(frameWriteMsg{
+		write: &writePushPromise{
+			streamID: rws.stream.id,
+			method:   method,
+			url:      u,
+			h:        h,
+		},
+		stream: rws.stream,
+		done:   errc,
+	})
+	select {
+	case err := <-errc:
+		return err
+	case <-sc.doneServing:
+		return errClientDisconnected
+	}
+}
+
 func (w *responseWriter) Header() http.Header {
 	rws := w.rws
 	if rws == nil {
@@ -1715,13 +3384,138 @@ func (w *responseWriter) WriteHeader(code int) {
 }
 
 func (rws *responseWriterState) writeHeader(code int) {
+	if isInformationalStatus(code) {
+		rws.writeInformational(code)
+		return
+	}
 	if !rws.wroteHeader {
 		rws.wroteHeader = true
 		rws.status = code
 		if len(rws.handlerHeader) > 0 {
 			rws.snapHeader = cloneHeader(rws.handlerHeader)
 		}
+		for k := range rws.snapHeader {
+			if isPseudoHeader(k) {
+				rws.conn.logf("http2: ignoring response header %q set by handler; pseudo-headers are the server's", k)
+				delete(rws.snapHeader, k)
+			}
+		}
+		for _, v := range rws.snapHeader["Trailer"] {
+			for _, k := range strings.Split(v, ",") {
+				rws.declareTrailer(strings.TrimSpace(k))
+			}
+		}
+		rws.sensitive = sensitiveHeaders(rws.snapHeader)
+		if rws.acceptsGzip && bodyAllowedForStatus(code) && rws.req.Method != "HEAD" &&
+			rws.snapHeader.Get("Content-Encoding") == "" {
+			rws.startGzip()
+		}
+	}
+}
+
+// startGzip makes the response body gzip-compressed.
+func (rws *responseWriterState) startGzip() {
+	if rws.snapHeader == nil {
+		rws.snapHeader = make(http.Header)
+	}
+	rws.snapHeader.Set("Content-Encoding", "gzip")
+	rws.snapHeader.Add("Vary", "Accept-Encoding")
+	// Any length the handler set is the uncompressed one.
+	rws.snapHeader.Del("Content-Length")
+	rws.gz = gzipWriterPool.Get().(*gzip.Writer)
+	rws.gz.Reset(rws.bw)
+}
+
+// acceptsGzip reports whether the Accept-Encoding in h allows a
+// gzip-encoded response.
+func acceptsGzip(h http.Header) bool {
+	for _, v := range h["Accept-Encoding"] {
+		for _, coding := range strings.Split(v, ",") {
+			coding = strings.TrimSpace(coding)
+			var params string
+			if i := strings.Index(coding, ";"); i != -1 {
+				coding, params = strings.TrimSpace(coding[:i]), coding[i+1:]
+			}
+			if !strings.EqualFold(coding, "gzip") {
+				continue
+			}
+			// "gzip;q=0" rules it out.
+			params = strings.Replace(params, " ", "", -1)
+			if q := strings.TrimPrefix(params, "q="); q != params {
+				if f, err := strconv.ParseFloat(q, 64); err == nil && f == 0 {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// isInformationalStatus reports whether code is a 1xx interim
+// status. 101 (Switching Protocols) isn't one: HTTP/2 has no
+// upgrade mechanism, so it's left to be sent (and rejected by
+// clients) as a final status.
+func isInformationalStatus(code int) bool {
+	return code >= 100 && code <= 199 && code != http.StatusSwitchingProtocols
+}
+
+// writeInformational sends an interim 1xx response carrying the
+// handler's current headers, such as a 103 (Early Hints) with Link
+// headers. It's dropped once the final status has been written.
+func (rws *responseWriterState) writeInformational(code int) {
+	if rws.wroteHeader {
+		return
 	}
+	if code == http.StatusContinue {
+		// The handler sent its own; don't send another when it
+		// first reads the body.
+		rws.body.cancelContinue()
+	}
+	var h http.Header
+	if len(rws.handlerHeader) > 0 {
+		h = rws.handlerHeader
+	}
+	// writeHeaders blocks until the frame's written when h is
+	// non-nil, so the handler may change its headers afterwards.
+	rws.conn.writeHeaders(rws.stream, &writeResHeaders{
+		streamID:    rws.stream.id,
+		httpResCode: code,
+		h:           h,
+		sensitive:   sensitiveHeaders(h),
+	}, rws.frameWriteCh)
+}
+
+// sensitiveHeaders returns the canonical keys listed in h's
+// SensitiveHeaders, or nil if there are none.
+func sensitiveHeaders(h http.Header) map[string]bool {
+	var m map[string]bool
+	for _, v := range h[SensitiveHeaders] {
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k == "" {
+				continue
+			}
+			if m == nil {
+				m = make(map[string]bool)
+			}
+			m[http.CanonicalHeaderKey(k)] = true
+		}
+	}
+	return m
+}
+
+// bodyAllowedForStatus reports whether a given response status code
+// permits a body. See RFC 2616, section 4.4.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == 204:
+		return false
+	case status == 304:
+		return false
+	}
+	return true
 }
 
 func cloneHeader(h http.Header) http.Header {
@@ -1759,6 +3553,23 @@ func (w *responseWriter) write(lenData int, dataB []byte, dataS string) (n int,
 	if !rws.wroteHeader {
 		w.WriteHeader(200)
 	}
+	if rws.gz != nil {
+		if _, haveType := rws.snapHeader["Content-Type"]; !haveType && !rws.sentHeader && lenData > 0 {
+			sniff := dataB
+			if sniff == nil {
+				s := dataS
+				if len(s) > 512 {
+					s = s[:512] // all DetectContentType looks at
+				}
+				sniff = []byte(s)
+			}
+			rws.snapHeader.Set("Content-Type", http.DetectContentType(sniff))
+		}
+		if dataB != nil {
+			return rws.gz.Write(dataB)
+		}
+		return io.WriteString(rws.gz, dataS)
+	}
 	if dataB != nil {
 		return rws.bw.Write(dataB)
 	} else {
@@ -1772,7 +3583,29 @@ func (w *responseWriter) handlerDone() {
 		panic("handlerDone called twice")
 	}
 	rws.handlerDone = true
-	w.Flush()
+	if rws.gz != nil && !rws.handlerPanicked {
+		rws.gz.Close() // into rws.bw; flushed below
+	}
+	if rws.handlerPanicked {
+		// Don't finish a response the handler may have left
+		// half-written; abort the stream instead.
+		rws.conn.writeFrameFromHandler(frameWriteMsg{
+			write:  handlerPanicRST{rws.stream.id},
+			stream: rws.stream,
+		})
+	} else {
+		w.Flush()
+	}
+	if rws.gz != nil {
+		gzipWriterPool.Put(rws.gz)
+		rws.gz = nil
+	}
 	w.rws = nil
-	responseWriterStatePool.Put(rws)
+	select {
+	case <-rws.conn.doneServing:
+		// A write may have been abandoned mid-flight, still
+		// using rws's buffers. Leave it to the GC.
+	default:
+		responseWriterStatePool.Put(rws)
+	}
 }
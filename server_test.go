@@ -8,7 +8,10 @@
 package http2
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/tls"
 	"errors"
 	"flag"
@@ -40,6 +43,7 @@ type serverTester struct {
 	ts        *httptest.Server
 	fr        *Framer
 	logBuf    *bytes.Buffer
+	logMu     sync.Mutex // guards logFilter
 	logFilter []string   // substrings to filter out
 	scMu      sync.Mutex // guards sc
 	sc        *serverConn
@@ -82,12 +86,15 @@ func newServerTester(t testing.TB, handler http.HandlerFunc, opts ...interface{}
 	}
 
 	onlyServer := false
+	h2server := new(Server)
 	for _, opt := range opts {
 		switch v := opt.(type) {
 		case func(*tls.Config):
 			v(tlsConfig)
 		case func(*httptest.Server):
 			v(ts)
+		case func(*Server):
+			v(h2server)
 		case serverTesterOpt:
 			onlyServer = (v == optOnlyServer)
 		default:
@@ -95,7 +102,7 @@ func newServerTester(t testing.TB, handler http.HandlerFunc, opts ...interface{}
 		}
 	}
 
-	ConfigureServer(ts.Config, &Server{})
+	ConfigureServer(ts.Config, h2server)
 
 	st := &serverTester{
 		t:      t,
@@ -144,6 +151,8 @@ func (st *serverTester) closeConn() {
 }
 
 func (st *serverTester) addLogFilter(phrase string) {
+	st.logMu.Lock()
+	defer st.logMu.Unlock()
 	st.logFilter = append(st.logFilter, phrase)
 }
 
@@ -217,6 +226,20 @@ func (st *serverTester) encodeHeaderField(k, v string) {
 	}
 }
 
+// encodeTrailer encodes a trailing header block, which unlike
+// encodeHeader has no implicit pseudo-header fields.
+func (st *serverTester) encodeTrailer(headers ...string) []byte {
+	if len(headers)%2 == 1 {
+		panic("odd number of kv args")
+	}
+	st.headerBuf.Reset()
+	for len(headers) > 0 {
+		st.encodeHeaderField(headers[0], headers[1])
+		headers = headers[2:]
+	}
+	return st.headerBuf.Bytes()
+}
+
 // encodeHeader encodes headers and returns their HPACK bytes. headers
 // must contain an even number of key/value pairs.  There may be
 // multiple pairs for keys (e.g. "cookie").  The :method, :path, and
@@ -295,6 +318,12 @@ func (st *serverTester) writeData(streamID uint32, endStream bool, data []byte)
 	}
 }
 
+func (st *serverTester) writePriority(id uint32, p PriorityParam) {
+	if err := st.fr.WritePriority(id, p); err != nil {
+		st.t.Fatalf("Error writing PRIORITY: %v", err)
+	}
+}
+
 func (st *serverTester) readFrame() (Frame, error) {
 	go func() {
 		fr, err := st.fr.ReadFrame()
@@ -381,6 +410,18 @@ func (st *serverTester) wantPing() *PingFrame {
 	return pf
 }
 
+// checkAlive sends a PING and waits for its ACK, to check that the
+// frames written before it didn't end the connection.
+func (st *serverTester) checkAlive() {
+	data := [8]byte{'a', 'l', 'i', 'v', 'e', '?', '?', '?'}
+	if err := st.fr.WritePing(false, data); err != nil {
+		st.t.Fatal(err)
+	}
+	if pf := st.wantPing(); !pf.Flags.Has(FlagPingAck) || pf.Data != data {
+		st.t.Fatalf("got PING %v; want ACK of %v", pf, data)
+	}
+}
+
 func (st *serverTester) wantGoAway() *GoAwayFrame {
 	f, err := st.readFrame()
 	if err != nil {
@@ -476,6 +517,26 @@ func TestServer(t *testing.T) {
 	}
 }
 
+func TestServer_PrefaceTimeout(t *testing.T) {
+	const timeout = 200 * time.Millisecond
+	st := newServerTester(t, nil, func(ts *httptest.Server) {
+		ts.Config.ReadTimeout = timeout
+	})
+	defer st.Close()
+	st.addLogFilter("timeout waiting for client preface")
+
+	// Never send the preface; the server should hang up on us.
+	start := time.Now()
+	st.cc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err := io.Copy(ioutil.Discard, st.cc)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("server didn't close the connection")
+	}
+	if d := time.Since(start); d < timeout {
+		t.Errorf("connection closed after %v; want at least %v", d, timeout)
+	}
+}
+
 func TestServer_Request_Get(t *testing.T) {
 	testServerRequest(t, func(st *serverTester) {
 		st.writeHeaders(HeadersFrameParam{
@@ -645,6 +706,325 @@ func TestServer_Request_Post_Body_ContentLength_TooSmall(t *testing.T) {
 		})
 }
 
+func TestServer_Request_Post_Body_ContentLength_Repeated(t *testing.T) {
+	const content = "Some content"
+	testBodyContents(t, int64(len(content)), content, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID: 1, // clients send odd numbers
+			BlockFragment: st.encodeHeader(
+				":method", "POST",
+				"content-length", strconv.Itoa(len(content)),
+				"content-length", strconv.Itoa(len(content)),
+			),
+			EndStream:  false, // to say DATA frames are coming
+			EndHeaders: true,
+		})
+		st.writeData(1, true, []byte(content))
+	})
+}
+
+func TestServer_PriorityWriteScheduler(t *testing.T) {
+	var made int
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}, func(s *Server) {
+		s.NewWriteScheduler = func() WriteScheduler {
+			made++
+			return NewPriorityWriteScheduler()
+		}
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":path", "/a"),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(":path", "/b"),
+		EndStream:     true,
+		EndHeaders:    true,
+		Priority:      PriorityParam{StreamDep: 1, Weight: 200},
+	})
+	for ended := 0; ended < 2; {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if df, ok := f.(*DataFrame); ok && df.StreamEnded() {
+			ended++
+		}
+	}
+	if made != 1 {
+		t.Errorf("NewWriteScheduler called %d times; want 1", made)
+	}
+}
+
+// Handlers on many streams write at once, so their frames reach the
+// wire in shared batches; each stream's must still arrive in order.
+func TestServer_ConcurrentStreams_FrameOrder(t *testing.T) {
+	const streams, chunks = 20, 5
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		w.WriteHeader(200)
+		for i := 0; i < chunks; i++ {
+			fmt.Fprintf(w, "%s:%d,", r.URL.Path, i)
+			w.(http.Flusher).Flush()
+		}
+	})
+	defer st.Close()
+	st.greet()
+	for i := 0; i < streams; i++ {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1 + uint32(i)*2,
+			BlockFragment: st.encodeHeader(":path", fmt.Sprintf("/%d", i)),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	}
+
+	bodies := make(map[uint32]*bytes.Buffer)
+	for ended := 0; ended < streams; {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := f.Header().StreamID
+		switch f := f.(type) {
+		case *HeadersFrame:
+			if bodies[id] != nil {
+				t.Fatalf("stream %d: second HEADERS", id)
+			}
+			bodies[id] = new(bytes.Buffer)
+		case *DataFrame:
+			if bodies[id] == nil {
+				t.Fatalf("stream %d: DATA before HEADERS", id)
+			}
+			bodies[id].Write(f.Data())
+			if f.StreamEnded() {
+				ended++
+			}
+		default:
+			t.Fatalf("unexpected frame %v", f.Header())
+		}
+	}
+	for i := 0; i < streams; i++ {
+		var want string
+		for j := 0; j < chunks; j++ {
+			want += fmt.Sprintf("/%d:%d,", i, j)
+		}
+		if got := bodies[1+uint32(i)*2].String(); got != want {
+			t.Errorf("stream %d body = %q; want %q", 1+i*2, got, want)
+		}
+	}
+}
+
+// Test that a handler that keeps its ResponseWriter and request past
+// its return can't reach a later request's.
+func TestServer_Handler_RetainedAfterReturn(t *testing.T) {
+	type retained struct {
+		w http.ResponseWriter
+		r *http.Request
+	}
+	reqs := make(chan retained, 2)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		reqs <- retained{w, r}
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+	st.wantHeaders()
+	old := <-reqs
+
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	st.writeData(3, true, []byte("second"))
+	st.wantHeaders()
+	<-reqs
+
+	if n, err := old.r.Body.Read(make([]byte, 10)); n != 0 || err == nil {
+		t.Errorf("Read of the old body = %d, %v; want an error", n, err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Write on the old ResponseWriter didn't panic")
+			}
+		}()
+		old.w.Write([]byte("x"))
+	}()
+}
+
+// Test that a request body's buffer is only taken once DATA arrives,
+// and is given back once the handler has read or closed the body.
+func TestServer_Request_Post_Body_BufferReleased(t *testing.T) {
+	hasBuf := func(r *http.Request) bool {
+		p := r.Body.(*requestBody).pipe
+		p.m.Lock()
+		defer p.m.Unlock()
+		return p.b.buf != nil
+	}
+	for _, closeEarly := range []bool{false, true} {
+		gotReq := make(chan bool, 1)
+		sentData := make(chan bool)
+		st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+			defer func() { gotReq <- true }()
+			if hasBuf(r) {
+				t.Error("buffer taken before any DATA")
+			}
+			sentData <- true
+			if closeEarly {
+				// Wait for the DATA, but don't read it.
+				for i := 0; !hasBuf(r) && i < 100; i++ {
+					time.Sleep(10 * time.Millisecond)
+				}
+				r.Body.Close()
+			} else if _, err := ioutil.ReadAll(r.Body); err != nil {
+				t.Errorf("ReadAll = %v", err)
+			}
+			if hasBuf(r) {
+				t.Errorf("closeEarly=%v: buffer kept after the body was done with", closeEarly)
+			}
+		})
+		st.greet()
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1, // clients send odd numbers
+			BlockFragment: st.encodeHeader(":method", "POST"),
+			EndStream:     false, // to say DATA frames are coming
+			EndHeaders:    true,
+		})
+		<-sentData
+		st.writeData(1, true, []byte("some data"))
+		select {
+		case <-gotReq:
+		case <-time.After(2 * time.Second):
+			t.Error("timeout waiting for request")
+		}
+		st.Close()
+	}
+}
+
+func TestServer_Request_Post_Body_Gzip(t *testing.T) {
+	const content = "Some content, which the client compressed."
+	var zbuf bytes.Buffer
+	zw := gzip.NewWriter(&zbuf)
+	io.WriteString(zw, content)
+	zw.Close()
+	zbody := zbuf.Bytes()
+
+	for _, decompress := range []bool{false, true} {
+		gotReq := make(chan bool, 1)
+		st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+			defer func() { gotReq <- true }()
+			all, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				t.Errorf("decompress=%v: ReadAll = %v", decompress, err)
+				return
+			}
+			if !decompress {
+				if r.ContentLength != int64(len(zbody)) || !bytes.Equal(all, zbody) {
+					t.Errorf("ContentLength, body = %d, %q; want %d, %q", r.ContentLength, all, len(zbody), zbody)
+				}
+				return
+			}
+			if r.ContentLength != -1 {
+				t.Errorf("ContentLength = %d; want -1", r.ContentLength)
+			}
+			if string(all) != content {
+				t.Errorf("Read = %q; want %q", all, content)
+			}
+			for _, k := range []string{"Content-Encoding", "Content-Length"} {
+				if v, ok := r.Header[k]; ok {
+					t.Errorf("Header[%q] = %q; want it removed", k, v)
+				}
+			}
+		}, func(s *Server) {
+			s.DecompressRequests = decompress
+		})
+		st.greet()
+		st.writeHeaders(HeadersFrameParam{
+			StreamID: 1, // clients send odd numbers
+			BlockFragment: st.encodeHeader(
+				":method", "POST",
+				"content-encoding", "gzip",
+				"content-length", strconv.Itoa(len(zbody)),
+			),
+			EndStream:  false, // to say DATA frames are coming
+			EndHeaders: true,
+		})
+		st.writeData(1, false, zbody[:5])
+		st.writeData(1, true, zbody[5:])
+		select {
+		case <-gotReq:
+		case <-time.After(2 * time.Second):
+			t.Error("timeout waiting for request")
+		}
+		st.Close()
+	}
+}
+
+func TestServer_Request_Post_Body_Gzip_Invalid(t *testing.T) {
+	gotReq := make(chan bool, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		defer func() { gotReq <- true }()
+		if all, err := ioutil.ReadAll(r.Body); err != gzip.ErrHeader {
+			t.Errorf("ReadAll = %q, %v; want gzip.ErrHeader", all, err)
+		}
+		if _, err := r.Body.Read(make([]byte, 1)); err != gzip.ErrHeader {
+			t.Errorf("Read after the error = %v; want gzip.ErrHeader", err)
+		}
+	}, func(s *Server) {
+		s.DecompressRequests = true
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1, // clients send odd numbers
+		BlockFragment: st.encodeHeader(":method", "POST", "content-encoding", "gzip"),
+		EndStream:     false, // to say DATA frames are coming
+		EndHeaders:    true,
+	})
+	st.writeData(1, true, []byte("not gzip, but long enough for a header"))
+	select {
+	case <-gotReq:
+	case <-time.After(2 * time.Second):
+		t.Error("timeout waiting for request")
+	}
+}
+
+func TestServer_Request_Reject_ContentLength_NotNumber(t *testing.T) {
+	testRejectContentLength(t, "abc")
+}
+
+func TestServer_Request_Reject_ContentLength_Negative(t *testing.T) {
+	testRejectContentLength(t, "-1")
+}
+
+func TestServer_Request_Reject_ContentLength_Conflicting(t *testing.T) {
+	testRejectContentLength(t, "3", "4")
+}
+
+func testRejectContentLength(t *testing.T, values ...string) {
+	testRejectRequest(t, func(st *serverTester) {
+		headers := []string{":method", "POST"}
+		for _, v := range values {
+			headers = append(headers, "content-length", v)
+		}
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1, // clients send odd numbers
+			BlockFragment: st.encodeHeader(headers...),
+			EndStream:     false,
+			EndHeaders:    true,
+		})
+	})
+}
+
 func testBodyContents(t *testing.T, wantContentLength int64, wantBody string, write func(st *serverTester)) {
 	testServerRequest(t, write, func(r *http.Request) {
 		if r.Method != "POST" {
@@ -688,6 +1068,89 @@ func testBodyContentsFail(t *testing.T, wantContentLength int64, wantReadError s
 	})
 }
 
+func TestServer_Request_Trailers(t *testing.T) {
+	const content = "Some content"
+	testServerRequest(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1, // clients send odd numbers
+			BlockFragment: st.encodeHeader(":method", "POST", "trailer", "Client-Trailer-A, client-trailer-b"),
+			EndStream:     false, // to say DATA frames are coming
+			EndHeaders:    true,
+		})
+		st.writeData(1, false, []byte(content))
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeTrailer("client-trailer-a", "a", "client-trailer-b", "b", "undeclared", "x"),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	}, func(r *http.Request) {
+		if _, ok := r.Header["Trailer"]; ok {
+			t.Errorf("Header still contains Trailer: %v", r.Header)
+		}
+		all, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(all) != content {
+			t.Errorf("Read = %q; want %q", all, content)
+		}
+		want := http.Header{
+			"Client-Trailer-A": {"a"},
+			"Client-Trailer-B": {"b"},
+		}
+		if !reflect.DeepEqual(r.Trailer, want) {
+			t.Errorf("Trailer = %v; want %v", r.Trailer, want)
+		}
+	})
+}
+
+func TestServer_Request_Trailers_NoEndStream(t *testing.T) {
+	testRejectTrailers(t, false, "client-trailer-a", "a")
+}
+
+func TestServer_Request_Trailers_PseudoHeader(t *testing.T) {
+	testRejectTrailers(t, true, ":path", "/")
+}
+
+// testRejectTrailers sends a POST with a body followed by a trailing
+// header block of the given header pairs, which the server should
+// refuse with a PROTOCOL_ERROR.
+func testRejectTrailers(t *testing.T, endStream bool, headers ...string) {
+	gotErr := make(chan error, 1)
+	proceed := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		<-proceed // read only once reset, so no WINDOW_UPDATE races the RST_STREAM
+		_, err := ioutil.ReadAll(r.Body)
+		gotErr <- err
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST", "trailer", "client-trailer-a"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	st.writeData(1, false, []byte("body"))
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeTrailer(headers...),
+		EndStream:     endStream,
+		EndHeaders:    true,
+	})
+	st.wantRSTStream(1, ErrCodeProtocol)
+	close(proceed)
+	select {
+	case err := <-gotErr:
+		if err == nil {
+			t.Error("body read succeeded; want an error")
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timeout waiting for handler")
+	}
+}
+
 // Using a Host header, instead of :authority
 func TestServer_Request_Get_Host(t *testing.T) {
 	const host = "example.com"
@@ -780,28 +1243,225 @@ func TestServer_Request_CookieConcat(t *testing.T) {
 			"cookie", "e=f",
 		)
 	}, func(r *http.Request) {
-		const want = "a=b; c=d; e=f"
-		if got := r.Header.Get("Cookie"); got != want {
+		want := []string{"a=b; c=d; e=f"}
+		if got := r.Header["Cookie"]; !reflect.DeepEqual(got, want) {
 			t.Errorf("Cookie = %q; want %q", got, want)
 		}
 	})
 }
 
-func TestServer_Request_Reject_CapitalHeader(t *testing.T) {
-	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1("UPPER", "v") })
+// Test that cookie crumbs are joined in the order they were sent,
+// even when other fields come between them, and that a lone cookie
+// field reaches the handler as it was sent.
+func TestServer_Request_CookieOrder(t *testing.T) {
+	tests := []struct {
+		headers []string
+		want    string
+	}{
+		{
+			headers: []string{"cookie", "z=1", "cookie", "a=2", "x-foo", "bar", "cookie", "m=3"},
+			want:    "z=1; a=2; m=3",
+		},
+		{
+			headers: []string{"cookie", "b=2", "cookie", "b=1"},
+			want:    "b=2; b=1",
+		},
+		{
+			headers: []string{"cookie", "only=one"},
+			want:    "only=one",
+		},
+		{
+			headers: []string{"cookie", "a=b; c=d"}, // sent uncrumbled
+			want:    "a=b; c=d",
+		},
+	}
+	for _, tt := range tests {
+		testServerRequest(t, func(st *serverTester) {
+			st.bodylessReq1(tt.headers...)
+		}, func(r *http.Request) {
+			if got := r.Header["Cookie"]; !reflect.DeepEqual(got, []string{tt.want}) {
+				t.Errorf("for %q, Cookie = %q; want [%q]", tt.headers, got, tt.want)
+			}
+		})
+	}
 }
 
-func TestServer_Request_Reject_Pseudo_Missing_method(t *testing.T) {
-	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1(":method", "") })
+func TestServer_Request_Reject_ConnectionHeader(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1("connection", "keep-alive") })
 }
 
-func TestServer_Request_Reject_Pseudo_ExactlyOne(t *testing.T) {
-	// 8.1.2.3 Request Pseudo-Header Fields
-	// "All HTTP/2 requests MUST include exactly one valid value" ...
-	testRejectRequest(t, func(st *serverTester) {
-		st.addLogFilter("duplicate pseudo-header")
-		st.bodylessReq1(":method", "GET", ":method", "POST")
-	})
+func TestServer_Request_Reject_TE(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1("te", "gzip") })
+}
+
+func TestServer_Request_TE_Trailers(t *testing.T) {
+	testServerRequest(t, func(st *serverTester) {
+		st.bodylessReq1("te", "trailers")
+	}, func(r *http.Request) {
+		if got := r.Header.Get("Te"); got != "trailers" {
+			t.Errorf("TE = %q; want %q", got, "trailers")
+		}
+	})
+}
+
+func TestServer_Request_Connect(t *testing.T) {
+	testServerRequest(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID: 1,
+			BlockFragment: encodeHeaderNoImplicit(t,
+				":method", "CONNECT",
+				":authority", "example.com:123",
+			),
+			EndStream:  false, // the tunnel stays open
+			EndHeaders: true,
+		})
+	}, func(r *http.Request) {
+		if r.Method != "CONNECT" {
+			t.Errorf("Method = %q; want CONNECT", r.Method)
+		}
+		if r.Host != "example.com:123" {
+			t.Errorf("Host = %q; want example.com:123", r.Host)
+		}
+		if r.URL.Host != "example.com:123" || r.URL.Path != "" {
+			t.Errorf("URL = %#v; want just Host example.com:123", r.URL)
+		}
+		if r.RequestURI != "example.com:123" {
+			t.Errorf("RequestURI = %q; want example.com:123", r.RequestURI)
+		}
+	})
+}
+
+func TestServer_Request_Reject_Connect_WithPath(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID: 1,
+			BlockFragment: encodeHeaderNoImplicit(t,
+				":method", "CONNECT",
+				":authority", "example.com:123",
+				":path", "/",
+			),
+			EndStream:  true,
+			EndHeaders: true,
+		})
+	})
+}
+
+func TestServer_Request_Reject_Connect_NoAuthority(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: encodeHeaderNoImplicit(t, ":method", "CONNECT"),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	})
+}
+
+func TestServer_Request_Options_Asterisk(t *testing.T) {
+	gotReq := make(chan *http.Request, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotReq <- r
+	}, func(ts *httptest.Server) {
+		// Otherwise net/http answers "OPTIONS *" itself.
+		ts.Config.DisableGeneralOptionsHandler = true
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1(":method", "OPTIONS", ":path", "*")
+	st.wantHeaders()
+
+	r := <-gotReq
+	if r.RequestURI != "*" {
+		t.Errorf("RequestURI = %q; want *", r.RequestURI)
+	}
+	if r.URL.Path != "" || r.URL.RawQuery != "" {
+		t.Errorf("URL = %#v; want empty", r.URL)
+	}
+}
+
+func TestServer_Request_Reject_Asterisk_NotOptions(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1(":path", "*") })
+}
+
+func TestServer_Request_StreamIDFromContext(t *testing.T) {
+	testServerRequest(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      3,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	}, func(r *http.Request) {
+		id, ok := StreamIDFromContext(r.Context())
+		if !ok || id != 3 {
+			t.Errorf("StreamIDFromContext = %d, %v; want 3, true", id, ok)
+		}
+	})
+	if id, ok := StreamIDFromContext(context.Background()); ok {
+		t.Errorf("StreamIDFromContext(Background) = %d, true; want false", id)
+	}
+}
+
+func TestServer_Request_Reject_EmptyPath(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1(":path", "") })
+}
+
+func TestServer_Request_Reject_EmptyPath_Duplicate(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1(":path", "", ":path", "/") })
+}
+
+func TestServer_Request_Reject_AbsolutePath(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1(":path", "https://example.com/") })
+}
+
+func TestServer_Request_URL(t *testing.T) {
+	testServerRequest(t, func(st *serverTester) {
+		st.bodylessReq1(":path", "/a/b?x=1", ":authority", "example.com")
+	}, func(r *http.Request) {
+		if r.URL.Path != "/a/b" {
+			t.Errorf("URL.Path = %q; want /a/b", r.URL.Path)
+		}
+		if got := r.URL.Query().Get("x"); got != "1" {
+			t.Errorf("URL.Query() x = %q; want 1", got)
+		}
+		if r.URL.Scheme != "https" || r.URL.Host != "example.com" {
+			t.Errorf("URL.Scheme, Host = %q, %q; want https, example.com", r.URL.Scheme, r.URL.Host)
+		}
+	})
+}
+
+func TestServer_Request_PathQuery(t *testing.T) {
+	testServerRequest(t, func(st *serverTester) {
+		st.bodylessReq1(":path", "/foo?bar=1")
+	}, func(r *http.Request) {
+		if r.RequestURI != "/foo?bar=1" {
+			t.Errorf("RequestURI = %q; want /foo?bar=1", r.RequestURI)
+		}
+		if r.URL.Path != "/foo" || r.URL.RawQuery != "bar=1" {
+			t.Errorf("URL Path, RawQuery = %q, %q; want /foo, bar=1", r.URL.Path, r.URL.RawQuery)
+		}
+	})
+}
+
+func TestServer_Request_Reject_CapitalHeader(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1("UPPER", "v") })
+}
+
+func TestServer_Request_Reject_MixedCaseHeader(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1("Content-Type", "text/plain") })
+}
+
+func TestServer_Request_Reject_Pseudo_Missing_method(t *testing.T) {
+	testRejectRequest(t, func(st *serverTester) { st.bodylessReq1(":method", "") })
+}
+
+func TestServer_Request_Reject_Pseudo_ExactlyOne(t *testing.T) {
+	// 8.1.2.3 Request Pseudo-Header Fields
+	// "All HTTP/2 requests MUST include exactly one valid value" ...
+	testRejectRequest(t, func(st *serverTester) {
+		st.addLogFilter("duplicate pseudo-header")
+		st.bodylessReq1(":method", "GET", ":method", "POST")
+	})
 }
 
 func TestServer_Request_Reject_Pseudo_AfterRegular(t *testing.T) {
@@ -858,691 +1518,3324 @@ func testRejectRequest(t *testing.T, send func(*serverTester)) {
 	st.wantRSTStream(1, ErrCodeProtocol)
 }
 
-func TestServer_Ping(t *testing.T) {
-	st := newServerTester(t, nil)
+func TestServer_FrameHooks(t *testing.T) {
+	readc := make(chan FrameType, 10)
+	writec := make(chan FrameType, 10)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}, func(s *Server) {
+		s.OnFrameRead = func(f Frame) { readc <- f.Header().Type }
+		s.OnFrameWrite = func(f Frame) { writec <- f.Header().Type }
+	})
 	defer st.Close()
 	st.greet()
-
-	// Server should ignore this one, since it has ACK set.
-	ackPingData := [8]byte{1, 2, 4, 8, 16, 32, 64, 128}
-	if err := st.fr.WritePing(true, ackPingData); err != nil {
-		t.Fatal(err)
+	getSlash(st)
+	st.wantHeaders()
+	st.wantData()
+
+	check := func(c chan FrameType, want ...FrameType) {
+		for _, wt := range want {
+			select {
+			case got := <-c:
+				if got != wt {
+					t.Fatalf("got %v; want %v (want all of %v)", got, wt, want)
+				}
+			case <-time.After(2 * time.Second):
+				t.Fatalf("timeout waiting for %v", wt)
+			}
+		}
 	}
+	check(readc, FrameSettings, FrameSettings, FrameHeaders)
+	check(writec, FrameSettings, FrameSettings, FrameHeaders, FrameData)
+}
 
-	// But the server should reply to this one, since ACK is false.
-	pingData := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
-	if err := st.fr.WritePing(false, pingData); err != nil {
-		t.Fatal(err)
-	}
+func TestServer_ConnCallbacks(t *testing.T) {
+	var opens, closes int32
+	opened := make(chan ConnInfo, 2)
+	closed := make(chan error, 2)
+	var closedInfo ConnInfo
+	st := newServerTester(t, nil, func(s *Server) {
+		s.OnConnOpen = func(ci ConnInfo) {
+			atomic.AddInt32(&opens, 1)
+			opened <- ci
+		}
+		s.OnConnClose = func(ci ConnInfo, err error) {
+			atomic.AddInt32(&closes, 1)
+			closedInfo = ci
+			closed <- err
+		}
+	})
+	defer st.Close()
+	st.greet()
 
-	pf := st.wantPing()
-	if !pf.Flags.Has(FlagPingAck) {
-		t.Error("response ping doesn't have ACK set")
+	ci := <-opened
+	if ci.RemoteAddr.String() != st.cc.LocalAddr().String() {
+		t.Errorf("RemoteAddr = %v; want %v", ci.RemoteAddr, st.cc.LocalAddr())
 	}
-	if pf.Data != pingData {
-		t.Errorf("response ping has data %q; want %q", pf.Data, pingData)
+	st.cc.Close()
+	select {
+	case err := <-closed:
+		if err == nil {
+			t.Error("OnConnClose got a nil error after the client hung up")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnConnClose")
+	}
+	if closedInfo != ci {
+		t.Errorf("OnConnClose got %+v; want %+v as given to OnConnOpen", closedInfo, ci)
+	}
+	if o, c := atomic.LoadInt32(&opens), atomic.LoadInt32(&closes); o != 1 || c != 1 {
+		t.Errorf("OnConnOpen, OnConnClose called %d, %d times; want 1, 1", o, c)
 	}
 }
 
-func TestServer_RejectsLargeFrames(t *testing.T) {
-	st := newServerTester(t, nil)
+// Test that a connection the server closes gracefully, here for
+// being idle, reports a nil error.
+func TestServer_ConnCallbacks_GracefulClose(t *testing.T) {
+	closed := make(chan error, 1)
+	st := newServerTester(t, nil, func(s *Server) {
+		s.IdleTimeout = 50 * time.Millisecond
+		s.OnConnClose = func(ci ConnInfo, err error) { closed <- err }
+	})
 	defer st.Close()
 	st.greet()
-
-	// Write too large of a frame (too large by one byte)
-	// We ignore the return value because it's expected that the server
-	// will only read the first 9 bytes (the headre) and then disconnect.
-	st.fr.WriteRawFrame(0xff, 0, 0, make([]byte, defaultMaxReadFrameSize+1))
-
-	gf := st.wantGoAway()
-	if gf.ErrCode != ErrCodeFrameSize {
-		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeFrameSize)
+	st.wantGoAway()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Errorf("OnConnClose error = %v; want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnConnClose")
 	}
 }
 
-func TestServer_Handler_Sends_WindowUpdate(t *testing.T) {
-	puppet := newHandlerPuppet()
+func TestServer_OnStreamEnd(t *testing.T) {
+	const reply = "hello world"
+	type end struct {
+		id    uint32
+		stats StreamStats
+	}
+	ended := make(chan end, 1)
 	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
-		puppet.act(w, r)
+		ioutil.ReadAll(r.Body)
+		w.WriteHeader(201)
+		io.WriteString(w, reply)
+	}, func(s *Server) {
+		s.OnStreamEnd = func(id uint32, stats StreamStats) { ended <- end{id, stats} }
 	})
 	defer st.Close()
-	defer puppet.done()
-
 	st.greet()
-
 	st.writeHeaders(HeadersFrameParam{
 		StreamID:      1, // clients send odd numbers
 		BlockFragment: st.encodeHeader(":method", "POST"),
 		EndStream:     false, // data coming
 		EndHeaders:    true,
 	})
-	st.writeData(1, false, []byte("abcdef"))
-	puppet.do(readBodyHandler(t, "abc"))
-	st.wantWindowUpdate(0, 3)
-	st.wantWindowUpdate(1, 3)
-
-	puppet.do(readBodyHandler(t, "def"))
-	st.wantWindowUpdate(0, 3)
-	st.wantWindowUpdate(1, 3)
+	st.writeData(1, true, []byte("abc"))
 
-	st.writeData(1, true, []byte("ghijkl")) // END_STREAM here
-	puppet.do(readBodyHandler(t, "ghi"))
-	puppet.do(readBodyHandler(t, "jkl"))
-	st.wantWindowUpdate(0, 3)
-	st.wantWindowUpdate(0, 3) // no more stream-level, since END_STREAM
+	select {
+	case e := <-ended:
+		if e.id != 1 {
+			t.Errorf("stream ID = %d; want 1", e.id)
+		}
+		want := StreamStats{RequestBodyBytes: 3, ResponseBytes: int64(len(reply)), StatusCode: 201}
+		got := e.stats
+		got.Duration = 0
+		if got != want {
+			t.Errorf("stats = %+v; want %+v", got, want)
+		}
+		if e.stats.Duration <= 0 {
+			t.Errorf("Duration = %v; want > 0", e.stats.Duration)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnStreamEnd")
+	}
 }
 
-func TestServer_Send_GoAway_After_Bogus_WindowUpdate(t *testing.T) {
-	st := newServerTester(t, nil)
+// Test that OnStreamEnd also fires for a stream the client resets.
+func TestServer_OnStreamEnd_RSTStream(t *testing.T) {
+	ended := make(chan StreamStats, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		<-w.(http.CloseNotifier).CloseNotify()
+	}, func(s *Server) {
+		s.OnStreamEnd = func(id uint32, stats StreamStats) { ended <- stats }
+	})
 	defer st.Close()
 	st.greet()
-	if err := st.fr.WriteWindowUpdate(0, 1<<31-1); err != nil {
+	st.bodylessReq1()
+	if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
 		t.Fatal(err)
 	}
-	gf := st.wantGoAway()
-	if gf.ErrCode != ErrCodeFlowControl {
-		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeFlowControl)
+	select {
+	case stats := <-ended:
+		if stats.StatusCode != 0 {
+			t.Errorf("StatusCode = %d; want 0 for a stream reset before its response", stats.StatusCode)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for OnStreamEnd")
 	}
-	if gf.LastStreamID != 0 {
-		t.Errorf("GOAWAY last stream ID = %v; want %v", gf.LastStreamID, 0)
+}
+
+// captureLogger is a Logger that records each message, prefixed by
+// its level.
+type captureLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *captureLogger) Debugf(format string, args ...interface{}) { l.add("debug: ", format, args) }
+func (l *captureLogger) Errorf(format string, args ...interface{}) { l.add("error: ", format, args) }
+
+func (l *captureLogger) add(level, format string, args []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, level+fmt.Sprintf(format, args...))
+}
+
+func (l *captureLogger) messages() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.msgs...)
+}
+
+func (l *captureLogger) has(prefix, substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.msgs {
+		if strings.HasPrefix(m, prefix) && strings.Contains(m, substr) {
+			return true
+		}
 	}
+	return false
 }
 
-func TestServer_Send_RstStream_After_Bogus_WindowUpdate(t *testing.T) {
-	inHandler := make(chan bool)
-	blockHandler := make(chan bool)
-	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
-		inHandler <- true
-		<-blockHandler
+func TestServer_Logger(t *testing.T) {
+	logger := new(captureLogger)
+	st := newServerTester(t, nil, func(s *Server) {
+		s.Logger = logger
 	})
 	defer st.Close()
-	defer close(blockHandler)
 	st.greet()
-	st.writeHeaders(HeadersFrameParam{
+
+	// A client may not push.
+	if err := st.fr.WritePushPromise(PushPromiseParam{
 		StreamID:      1,
-		BlockFragment: st.encodeHeader(":method", "POST"),
-		EndStream:     false, // keep it open
+		PromiseID:     2,
+		BlockFragment: st.encodeHeader(),
 		EndHeaders:    true,
-	})
-	<-inHandler
-	// Send a bogus window update:
-	if err := st.fr.WriteWindowUpdate(1, 1<<31-1); err != nil {
+	}); err != nil {
 		t.Fatal(err)
 	}
-	st.wantRSTStream(1, ErrCodeFlowControl)
+	st.wantGoAway()
+
+	// Debug messages are delivered without VerboseLogs.
+	if !logger.has("debug: ", "got [FrameHeader PUSH_PROMISE") {
+		t.Errorf("no debug message for the PUSH_PROMISE read; got %q", logger.messages())
+	}
+	if !logger.has("error: ", "connection error: PROTOCOL_ERROR") {
+		t.Errorf("protocol error not logged; got %q", logger.messages())
+	}
+	if st.logBuf.Len() != 0 {
+		t.Errorf("http.Server.ErrorLog used despite Server.Logger: %q", st.logBuf)
+	}
 }
 
-// testServerPostUnblock sends a hanging POST with unsent data to handler,
-// then runs fn once in the handler, and verifies that the error returned from
-// handler is acceptable. It fails if takes over 5 seconds for handler to exit.
-func testServerPostUnblock(t *testing.T,
-	handler func(http.ResponseWriter, *http.Request) error,
-	fn func(*serverTester),
-	checkErr func(error),
-	otherHeaders ...string) {
-	inHandler := make(chan bool)
-	errc := make(chan error, 1)
+// Test that a request rejected for its pseudo-header fields logs
+// which one was at fault, and is still reset with PROTOCOL_ERROR.
+func TestServer_Request_Reject_PseudoHeader_Logged(t *testing.T) {
+	tests := []struct {
+		headers []string
+		want    string
+	}{
+		{[]string{":path", "/", ":scheme", "https"}, "missing :method"},
+		{[]string{":method", "GET", ":scheme", "https"}, "missing :path"},
+		{[]string{":method", "GET", ":path", "/"}, "missing :scheme"},
+		{[]string{":method", "GET", ":path", "/", ":scheme", "ftp"}, `invalid :scheme "ftp"`},
+		{[]string{":method", "CONNECT", ":authority", "example.com:443", ":path", "/"}, "CONNECT request has a :path"},
+		{[]string{":method", "CONNECT", ":authority", "example.com:443", ":scheme", "https"}, "CONNECT request has a :scheme"},
+		{[]string{":method", "CONNECT"}, "CONNECT request missing :authority"},
+	}
+	for _, tt := range tests {
+		func() {
+			logger := new(captureLogger)
+			st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("%s: request made it to the handler", tt.want)
+			}, func(s *Server) {
+				s.Logger = logger
+			})
+			defer st.Close()
+			st.greet()
+			st.writeHeaders(HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: st.encodeTrailer(tt.headers...), // no default pseudo-headers
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+			st.wantRSTStream(1, ErrCodeProtocol)
+			logged := false
+			for _, m := range logger.messages() {
+				if strings.HasPrefix(m, "error: malformed request on stream 1 from ") && strings.HasSuffix(m, ": "+tt.want) {
+					logged = true
+				}
+			}
+			if !logged {
+				t.Errorf("%s: not logged; got %q", tt.want, logger.messages())
+			}
+		}()
+	}
+}
+
+func TestServer_Stats(t *testing.T) {
+	var srv *Server
+	ended := make(chan uint32, 2)
 	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
-		inHandler <- true
-		errc <- handler(w, r)
+		if r.URL.Path == "/reset" {
+			<-w.(http.CloseNotifier).CloseNotify()
+			return
+		}
+		io.WriteString(w, "ok")
+	}, func(s *Server) {
+		srv = s
+		s.OnStreamEnd = func(id uint32, stats StreamStats) { ended <- id }
 	})
+	defer st.Close()
 	st.greet()
+	st.bodylessReq1()
+	// The stream ends as its last frame is scheduled, which can
+	// be before its frames are written; wait to see them.
+	st.wantHeaders()
+	st.wantData()
 	st.writeHeaders(HeadersFrameParam{
-		StreamID:      1,
-		BlockFragment: st.encodeHeader(append([]string{":method", "POST"}, otherHeaders...)...),
-		EndStream:     false, // keep it open
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(":path", "/reset"),
+		EndStream:     true,
 		EndHeaders:    true,
 	})
-	<-inHandler
-	fn(st)
-	select {
-	case err := <-errc:
-		if checkErr != nil {
-			checkErr(err)
+	if err := st.fr.WriteRSTStream(3, ErrCodeCancel); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ended:
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for streams to end")
 		}
-	case <-time.After(5 * time.Second):
-		t.Fatal("timeout waiting for Handler to return")
 	}
-	st.Close()
-}
 
-func TestServer_RSTStream_Unblocks_Read(t *testing.T) {
-	testServerPostUnblock(t,
-		func(w http.ResponseWriter, r *http.Request) (err error) {
-			_, err = r.Body.Read(make([]byte, 1))
-			return
-		},
-		func(st *serverTester) {
-			if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
-				t.Fatal(err)
-			}
-		},
-		func(err error) {
-			if err == nil {
-				t.Error("unexpected nil error from Request.Body.Read")
-			}
-		},
-	)
+	stats := srv.Stats()
+	if stats.ConnsAccepted != 1 {
+		t.Errorf("ConnsAccepted = %d; want 1", stats.ConnsAccepted)
+	}
+	if stats.StreamsOpened != 2 {
+		t.Errorf("StreamsOpened = %d; want 2", stats.StreamsOpened)
+	}
+	if stats.StreamsReset != 1 {
+		t.Errorf("StreamsReset = %d; want 1", stats.StreamsReset)
+	}
+	if stats.GoAwaysSent != 0 {
+		t.Errorf("GoAwaysSent = %d; want 0", stats.GoAwaysSent)
+	}
+	if n := stats.FramesRead[FrameHeaders]; n != 2 {
+		t.Errorf("FramesRead[HEADERS] = %d; want 2", n)
+	}
+	if n := stats.FramesRead[FrameRSTStream]; n != 1 {
+		t.Errorf("FramesRead[RST_STREAM] = %d; want 1", n)
+	}
+	if n := stats.FramesWritten[FrameHeaders]; n < 1 {
+		t.Errorf("FramesWritten[HEADERS] = %d; want >= 1", n)
+	}
+	if n := stats.FramesWritten[FrameSettings]; n < 1 {
+		t.Errorf("FramesWritten[SETTINGS] = %d; want >= 1", n)
+	}
+	if _, ok := stats.FramesRead[FramePushPromise]; ok {
+		t.Errorf("FramesRead has an entry for PUSH_PROMISE; want unseen types omitted")
+	}
 }
 
-func TestServer_DeadConn_Unblocks_Read(t *testing.T) {
-	testServerPostUnblock(t,
-		func(w http.ResponseWriter, r *http.Request) (err error) {
-			_, err = r.Body.Read(make([]byte, 1))
-			return
-		},
-		func(st *serverTester) { st.cc.Close() },
-		func(err error) {
-			if err == nil {
-				t.Error("unexpected nil error from Request.Body.Read")
-			}
-		},
-	)
+// writeCountConn counts the Write calls on a net.Conn.
+type writeCountConn struct {
+	net.Conn
+	writes int32 // atomic
 }
 
-var blockUntilClosed = func(w http.ResponseWriter, r *http.Request) error {
-	<-w.(http.CloseNotifier).CloseNotify()
-	return nil
+func (c *writeCountConn) Write(p []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(p)
 }
 
-func TestServer_CloseNotify_After_RSTStream(t *testing.T) {
-	testServerPostUnblock(t, blockUntilClosed, func(st *serverTester) {
-		if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+// Test that the server's SETTINGS and its ACK of the client's
+// SETTINGS go out in one network write.
+func TestServer_Handshake_SingleWrite(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	wc := &writeCountConn{Conn: serverConn}
+	srv := new(Server)
+	hs := &http.Server{ErrorLog: log.New(ioutil.Discard, "", 0)}
+	go srv.handleConn(hs, wc, http.NotFoundHandler(), nil)
+
+	fr := NewFramer(clientConn, clientConn)
+	if _, err := clientConn.Write(clientPreface); err != nil {
+		t.Fatal(err)
+	}
+	// Give the server time to (wrongly) flush its SETTINGS
+	// alone, as if ours were still in flight.
+	time.Sleep(50 * time.Millisecond)
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	for _, wantAck := range []bool{false, true} {
+		f, err := fr.ReadFrame()
+		if err != nil {
 			t.Fatal(err)
 		}
-	}, nil)
+		sf, ok := f.(*SettingsFrame)
+		if !ok || sf.IsAck() != wantAck {
+			t.Fatalf("got %v; want SETTINGS with ACK=%v", f, wantAck)
+		}
+	}
+	if n := atomic.LoadInt32(&wc.writes); n != 1 {
+		t.Errorf("server made %d writes for the handshake; want 1", n)
+	}
 }
 
-func TestServer_CloseNotify_After_ConnClose(t *testing.T) {
-	testServerPostUnblock(t, blockUntilClosed, func(st *serverTester) { st.cc.Close() }, nil)
+// Test that WriteTimeout closes a connection whose client stops
+// reading, rather than leaving the write blocked forever.
+func TestServer_WriteTimeout(t *testing.T) {
+	clientConn, serverConn := net.Pipe() // unbuffered: writes block until read
+	defer clientConn.Close()
+	closed := make(chan error, 1)
+	srv := &Server{
+		WriteTimeout: 100 * time.Millisecond,
+		OnConnClose:  func(_ ConnInfo, err error) { closed <- err },
+	}
+	hs := &http.Server{ErrorLog: log.New(ioutil.Discard, "", 0)}
+	go srv.ServeConn(hs, serverConn, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush()
+		io.WriteString(w, strings.Repeat("a", 1<<10))
+	}))
+
+	fr := NewFramer(clientConn, clientConn)
+	gotHeaders := make(chan bool)
+	go func() {
+		// Read until the response HEADERS, then stop reading.
+		for {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				return
+			}
+			if _, ok := f.(*HeadersFrame); ok {
+				close(gotHeaders)
+				return
+			}
+		}
+	}()
+	if _, err := clientConn.Write(clientPreface); err != nil {
+		t.Fatal(err)
+	}
+	if err := fr.WriteSettings(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fr.WriteSettingsAck(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	if err := fr.WriteHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: buf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-gotHeaders:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for response HEADERS")
+	}
+	select {
+	case err := <-closed:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("conn closed with %v; want a timeout", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn not closed after WriteTimeout")
+	}
 }
 
-// that CloseNotify unblocks after a stream error due to the client's
-// problem that's unrelated to them explicitly canceling it (which is
-// TestServer_CloseNotify_After_RSTStream above)
-func TestServer_CloseNotify_After_StreamError(t *testing.T) {
-	testServerPostUnblock(t, blockUntilClosed, func(st *serverTester) {
-		// data longer than declared Content-Length => stream error
-		st.writeData(1, true, []byte("1234"))
-	}, nil, "content-length", "3")
+func TestServer_Ping(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.greet()
+
+	// Server should ignore this one, since it has ACK set.
+	ackPingData := [8]byte{1, 2, 4, 8, 16, 32, 64, 128}
+	if err := st.fr.WritePing(true, ackPingData); err != nil {
+		t.Fatal(err)
+	}
+
+	// But the server should reply to this one, since ACK is false.
+	pingData := [8]byte{1, 2, 3, 4, 5, 6, 7, 8}
+	if err := st.fr.WritePing(false, pingData); err != nil {
+		t.Fatal(err)
+	}
+
+	pf := st.wantPing()
+	if !pf.Flags.Has(FlagPingAck) {
+		t.Error("response ping doesn't have ACK set")
+	}
+	if pf.Data != pingData {
+		t.Errorf("response ping has data %q; want %q", pf.Data, pingData)
+	}
 }
 
-func TestServer_StateTransitions(t *testing.T) {
-	var st *serverTester
-	inHandler := make(chan bool)
-	writeData := make(chan bool)
-	leaveHandler := make(chan bool)
-	st = newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
-		inHandler <- true
-		if st.stream(1) == nil {
-			t.Errorf("nil stream 1 in handler")
-		}
-		if got, want := st.streamState(1), stateOpen; got != want {
-			t.Errorf("in handler, state is %v; want %v", got, want)
+func TestServer_Ping_BadLength(t *testing.T) {
+	for _, size := range []int{4, 9} {
+		st := newServerTester(t, nil)
+		st.greet()
+		st.fr.WriteRawFrame(FramePing, 0, 0, make([]byte, size))
+		gf := st.wantGoAway()
+		if gf.ErrCode != ErrCodeFrameSize {
+			t.Errorf("%d-byte PING: GOAWAY err = %v; want %v", size, gf.ErrCode, ErrCodeFrameSize)
 		}
-		writeData <- true
-		if n, err := r.Body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
-			t.Errorf("body read = %d, %v; want 0, EOF", n, err)
+		st.Close()
+	}
+}
+
+// Test frames that arrive together, which the serve loop reads
+// itself rather than waiting on the frame-reading goroutine for
+// each.
+func TestServer_FramesArrivingTogether(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.greet()
+
+	var buf bytes.Buffer
+	fr := NewFramer(&buf, nil)
+	fr.WritePing(false, [8]byte{1})
+	fr.WritePing(false, [8]byte{2})
+	fr.WriteRawFrame(FramePing, 0, 0, make([]byte, 4)) // bad length
+	fr.WritePing(false, [8]byte{3})                    // never read
+	if _, err := st.cc.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	// The GOAWAY may overtake the first PINGs' ACKs.
+	var gf *GoAwayFrame
+	for gf == nil {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
 		}
-		if got, want := st.streamState(1), stateHalfClosedRemote; got != want {
-			t.Errorf("in handler, state is %v; want %v", got, want)
+		switch f := f.(type) {
+		case *PingFrame:
+			if !f.Flags.Has(FlagPingAck) || f.Data == [8]byte{3} {
+				t.Errorf("got PING %v, ack=%v; want ACKs of only the first two", f.Data, f.Flags.Has(FlagPingAck))
+			}
+		case *GoAwayFrame:
+			gf = f
+		default:
+			t.Fatalf("unexpected frame %v", f.Header())
 		}
+	}
+	if gf.ErrCode != ErrCodeFrameSize {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeFrameSize)
+	}
+	if f, err := st.readFrame(); err != io.EOF {
+		t.Errorf("after GOAWAY, got %v, %v; want io.EOF", f, err)
+	}
+}
 
-		<-leaveHandler
-	})
+func TestServer_RejectsLargeFrames(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
 	st.greet()
-	if st.stream(1) != nil {
-		t.Fatal("stream 1 should be empty")
+
+	// Write too large of a frame (too large by one byte)
+	// We ignore the return value because it's expected that the server
+	// will only read the first 9 bytes (the headre) and then disconnect.
+	st.fr.WriteRawFrame(0xff, 0, 0, make([]byte, defaultMaxReadFrameSize+1))
+
+	gf := st.wantGoAway()
+	if gf.ErrCode != ErrCodeFrameSize {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeFrameSize)
 	}
-	if got := st.streamState(1); got != stateIdle {
-		t.Fatalf("stream 1 should be idle; got %v", got)
+}
+
+// A configured MaxReadFrameSize is both advertised and enforced.
+func TestServer_RejectsLargeFrames_Configured(t *testing.T) {
+	const maxSize = 1 << 15
+	st := newServerTester(t, nil, func(s *Server) {
+		s.MaxReadFrameSize = maxSize
+	})
+	defer st.Close()
+	st.writePreface()
+	st.writeInitialSettings()
+	sf := st.wantSettings()
+	if v, ok := sf.Value(SettingMaxFrameSize); !ok || v != maxSize {
+		t.Errorf("advertised SETTINGS_MAX_FRAME_SIZE = %v, %v; want %v", v, ok, maxSize)
+	}
+	st.writeSettingsAck()
+	st.wantSettingsAck()
+
+	// A frame of exactly the maximum size is fine.
+	st.fr.WriteRawFrame(0xff, 0, 0, make([]byte, maxSize))
+	st.checkAlive()
+
+	st.fr.WriteRawFrame(0xff, 0, 0, make([]byte, maxSize+1))
+	gf := st.wantGoAway()
+	if gf.ErrCode != ErrCodeFrameSize {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeFrameSize)
 	}
+}
 
+// An oversized DATA frame only affects its stream, so it's a stream
+// error, and its payload is still returned to the connection window.
+func TestServer_RejectsLargeFrames_Data(t *testing.T) {
+	const maxSize = minMaxFrameSize
+	bodyErr := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		_, err := ioutil.ReadAll(r.Body)
+		bodyErr <- err
+	}, func(s *Server) {
+		s.MaxReadFrameSize = maxSize
+	})
+	defer st.Close()
+	st.greet()
 	st.writeHeaders(HeadersFrameParam{
 		StreamID:      1,
 		BlockFragment: st.encodeHeader(":method", "POST"),
-		EndStream:     false, // keep it open
+		EndStream:     false,
 		EndHeaders:    true,
 	})
-	<-inHandler
-	<-writeData
-	st.writeData(1, true, nil)
-
-	leaveHandler <- true
-	hf := st.wantHeaders()
-	if !hf.StreamEnded() {
-		t.Fatal("expected END_STREAM flag")
-	}
+	st.writeData(1, true, make([]byte, maxSize+1))
 
-	if got, want := st.streamState(1), stateClosed; got != want {
-		t.Errorf("at end, state is %v; want %v", got, want)
+	var gotRST, gotWU bool
+	for !gotRST || !gotWU {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *RSTStreamFrame:
+			if f.StreamID != 1 || f.ErrCode != ErrCodeFrameSize {
+				t.Fatalf("got RST_STREAM stream %d, %v; want stream 1, %v", f.StreamID, f.ErrCode, ErrCodeFrameSize)
+			}
+			gotRST = true
+		case *WindowUpdateFrame:
+			if f.StreamID != 0 || f.Increment != maxSize+1 {
+				t.Fatalf("got WINDOW_UPDATE stream %d, +%d; want stream 0, +%d", f.StreamID, f.Increment, maxSize+1)
+			}
+			gotWU = true
+		default:
+			t.Fatalf("unexpected %v", f.Header())
+		}
 	}
-	if st.stream(1) != nil {
-		t.Fatal("at end, stream 1 should be gone")
+	if err := <-bodyErr; err == nil {
+		t.Error("handler read the request body without error")
 	}
+	st.checkAlive()
 }
 
-// test HEADERS w/o EndHeaders + another HEADERS (should get rejected)
-func TestServer_Rejects_HeadersNoEnd_Then_Headers(t *testing.T) {
-	testServerRejects(t, func(st *serverTester) {
-		st.writeHeaders(HeadersFrameParam{
-			StreamID:      1,
-			BlockFragment: st.encodeHeader(),
-			EndStream:     true,
-			EndHeaders:    false,
-		})
-		st.writeHeaders(HeadersFrameParam{ // Not a continuation.
-			StreamID:      3, // different stream.
-			BlockFragment: st.encodeHeader(),
-			EndStream:     true,
-			EndHeaders:    true,
-		})
+// An oversized frame that could change the connection's state, such
+// as HEADERS, is a connection error.
+func TestServer_RejectsLargeFrames_Headers(t *testing.T) {
+	const maxSize = minMaxFrameSize
+	st := newServerTester(t, nil, func(s *Server) {
+		s.MaxReadFrameSize = maxSize
 	})
+	defer st.Close()
+	st.greet()
+	st.fr.WriteRawFrame(FrameHeaders, FlagHeadersEndHeaders, 1, make([]byte, maxSize+1))
+	gf := st.wantGoAway()
+	if gf.ErrCode != ErrCodeFrameSize {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeFrameSize)
+	}
 }
 
-// test HEADERS w/o EndHeaders + PING (should get rejected)
-func TestServer_Rejects_HeadersNoEnd_Then_Ping(t *testing.T) {
-	testServerRejects(t, func(st *serverTester) {
-		st.writeHeaders(HeadersFrameParam{
-			StreamID:      1,
-			BlockFragment: st.encodeHeader(),
-			EndStream:     true,
-			EndHeaders:    false,
-		})
-		if err := st.fr.WritePing(false, [8]byte{}); err != nil {
-			t.Fatal(err)
+// Unknown frame types are discarded wherever they appear outside a
+// header block, leaving the frames around them to be processed.
+func TestServer_IgnoresUnknownFrames(t *testing.T) {
+	const msg = "foo"
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || string(body) != msg {
+			t.Errorf("body = %q, %v; want %q, nil", body, err, msg)
 		}
 	})
+	defer st.Close()
+	st.greet()
+
+	st.fr.WriteRawFrame(0xff, 0xff, 0, []byte("on the connection"))
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	st.fr.WriteRawFrame(0xfe, 0x01, 1, []byte("on the open stream"))
+	st.fr.WriteRawFrame(0xfe, 0, 99, []byte("on an idle stream"))
+	st.writeData(1, true, []byte(msg))
+	st.wantWindowUpdate(0, uint32(len(msg)))
+	st.wantHeaders()
+
+	// Stream 99 wasn't opened, so a lower stream ID is still fine.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	st.writeData(3, true, []byte(msg))
+	st.wantWindowUpdate(0, uint32(len(msg)))
+	st.wantHeaders()
+	st.checkAlive()
 }
 
-// test HEADERS w/ EndHeaders + a continuation HEADERS (should get rejected)
-func TestServer_Rejects_HeadersEnd_Then_Continuation(t *testing.T) {
-	testServerRejects(t, func(st *serverTester) {
-		st.writeHeaders(HeadersFrameParam{
-			StreamID:      1,
-			BlockFragment: st.encodeHeader(),
-			EndStream:     true,
-			EndHeaders:    true,
-		})
-		st.wantHeaders()
-		if err := st.fr.WriteContinuation(1, true, encodeHeaderNoImplicit(t, "foo", "bar")); err != nil {
-			t.Fatal(err)
+func TestServer_Handler_Sends_WindowUpdate(t *testing.T) {
+	puppet := newHandlerPuppet()
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		puppet.act(w, r)
+	})
+	defer st.Close()
+	defer puppet.done()
+
+	st.greet()
+
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1, // clients send odd numbers
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // data coming
+		EndHeaders:    true,
+	})
+	st.writeData(1, false, []byte("abcdef"))
+	puppet.do(readBodyHandler(t, "abc"))
+	st.wantWindowUpdate(0, 3)
+	st.wantWindowUpdate(1, 3)
+
+	puppet.do(readBodyHandler(t, "def"))
+	st.wantWindowUpdate(0, 3)
+	st.wantWindowUpdate(1, 3)
+
+	st.writeData(1, true, []byte("ghijkl")) // END_STREAM here
+	puppet.do(readBodyHandler(t, "ghi"))
+	puppet.do(readBodyHandler(t, "jkl"))
+	st.wantWindowUpdate(0, 3)
+	st.wantWindowUpdate(0, 3) // no more stream-level, since END_STREAM
+}
+
+// Test that a handler that isn't reading its body lets the client
+// send MaxUploadBufferPerStream bytes and no more.
+func TestServer_MaxUploadBufferPerStream(t *testing.T) {
+	const bufSize = 1000
+	puppet := newHandlerPuppet()
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		puppet.act(w, r)
+	}, func(s *Server) {
+		s.MaxUploadBufferPerStream = bufSize
+	})
+	defer st.Close()
+	defer puppet.done()
+
+	st.writePreface()
+	st.writeInitialSettings()
+	var advertised uint32
+	st.wantSettings().ForeachSetting(func(s Setting) error {
+		if s.ID == SettingInitialWindowSize {
+			advertised = s.Val
 		}
+		return nil
+	})
+	if advertised != bufSize {
+		t.Fatalf("advertised SETTINGS_INITIAL_WINDOW_SIZE = %d; want %d", advertised, bufSize)
+	}
+	st.writeSettingsAck()
+	st.wantSettingsAck()
+
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1, // clients send odd numbers
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // data coming
+		EndHeaders:    true,
 	})
+	st.writeData(1, false, make([]byte, bufSize))
+	// Nothing was read, so the window wasn't replenished and
+	// one more byte is too many.
+	st.writeData(1, false, []byte("x"))
+	st.wantWindowUpdate(0, 1) // the refused byte, given back to the conn
+	st.wantRSTStream(1, ErrCodeFlowControl)
 }
 
-// test HEADERS w/o EndHeaders + a continuation HEADERS on wrong stream ID
-func TestServer_Rejects_HeadersNoEnd_Then_ContinuationWrongStream(t *testing.T) {
-	testServerRejects(t, func(st *serverTester) {
-		st.writeHeaders(HeadersFrameParam{
-			StreamID:      1,
-			BlockFragment: st.encodeHeader(),
-			EndStream:     true,
-			EndHeaders:    false,
-		})
-		if err := st.fr.WriteContinuation(3, true, encodeHeaderNoImplicit(t, "foo", "bar")); err != nil {
+// Test that a MaxUploadBufferPerStream above the default grows the
+// connection window to match.
+func TestServer_MaxUploadBufferPerStream_Large(t *testing.T) {
+	const bufSize = 1 << 20
+	st := newServerTester(t, nil, func(s *Server) {
+		s.MaxUploadBufferPerStream = bufSize
+	})
+	defer st.Close()
+
+	st.writePreface()
+	st.writeInitialSettings()
+	st.wantSettings()
+	st.writeSettingsAck()
+	// The WINDOW_UPDATE may come before or after the ACK.
+	var gotAck, gotUpdate bool
+	for !gotAck || !gotUpdate {
+		f, err := st.readFrame()
+		if err != nil {
 			t.Fatal(err)
 		}
-	})
+		switch f := f.(type) {
+		case *SettingsFrame:
+			gotAck = f.IsAck()
+		case *WindowUpdateFrame:
+			if f.StreamID != 0 || f.Increment != bufSize-initialWindowSize {
+				t.Fatalf("WINDOW_UPDATE stream %d, increment %d; want stream 0, increment %d",
+					f.StreamID, f.Increment, bufSize-initialWindowSize)
+			}
+			gotUpdate = true
+		default:
+			t.Fatalf("unexpected frame %v", f)
+		}
+	}
 }
 
-// No HEADERS on stream 0.
-func TestServer_Rejects_Headers0(t *testing.T) {
-	testServerRejects(t, func(st *serverTester) {
-		st.fr.AllowIllegalWrites = true
+// Test that with two request bodies being read concurrently, each
+// byte is credited once to the connection and once to its own stream.
+func TestServer_Handler_Sends_WindowUpdate_TwoStreams(t *testing.T) {
+	const n1, n3 = 5000, 7000
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		n := n1
+		if r.URL.Path == "/3" {
+			n = n3
+		}
+		if _, err := io.ReadFull(r.Body, make([]byte, n)); err != nil {
+			t.Errorf("reading body: %v", err)
+		}
+	})
+	defer st.Close()
+	st.greet()
+	for _, id := range []uint32{1, 3} {
 		st.writeHeaders(HeadersFrameParam{
-			StreamID:      0,
-			BlockFragment: st.encodeHeader(),
-			EndStream:     true,
+			StreamID:      id,
+			BlockFragment: st.encodeHeader(":method", "POST", ":path", fmt.Sprintf("/%d", id)),
+			EndStream:     false, // data coming
 			EndHeaders:    true,
 		})
-	})
-}
+	}
+	st.writeData(1, false, make([]byte, n1))
+	st.writeData(3, false, make([]byte, n3))
 
-// No CONTINUATION on stream 0.
-func TestServer_Rejects_Continuation0(t *testing.T) {
-	testServerRejects(t, func(st *serverTester) {
-		st.fr.AllowIllegalWrites = true
-		if err := st.fr.WriteContinuation(0, true, st.encodeHeader()); err != nil {
+	got := map[uint32]int{}
+	for got[0] < n1+n3 || got[1] < n1 || got[3] < n3 {
+		f, err := st.readFrame()
+		if err != nil {
 			t.Fatal(err)
 		}
-	})
-}
-
-func TestServer_Rejects_PushPromise(t *testing.T) {
-	testServerRejects(t, func(st *serverTester) {
-		pp := PushPromiseParam{
-			StreamID:  1,
-			PromiseID: 3,
+		if wu, ok := f.(*WindowUpdateFrame); ok {
+			got[wu.StreamID] += int(wu.Increment)
 		}
-		if err := st.fr.WritePushPromise(pp); err != nil {
+	}
+	// Make sure nothing more was credited.
+	if err := st.fr.WritePing(false, [8]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := st.readFrame()
+		if err != nil {
 			t.Fatal(err)
 		}
-	})
+		if wu, ok := f.(*WindowUpdateFrame); ok {
+			got[wu.StreamID] += int(wu.Increment)
+		}
+		if _, ok := f.(*PingFrame); ok {
+			break
+		}
+	}
+	want := map[uint32]int{0: n1 + n3, 1: n1, 3: n3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("WINDOW_UPDATE increments by stream = %v; want %v", got, want)
+	}
 }
 
-// testServerRejects tests that the server hangs up with a GOAWAY
-// frame and a server close after the client does something
-// deserving a CONNECTION_ERROR.
-func testServerRejects(t *testing.T, writeReq func(*serverTester)) {
+func TestServer_Send_GoAway_After_Bogus_WindowUpdate(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.greet()
+	if err := st.fr.WriteWindowUpdate(0, 1<<31-1); err != nil {
+		t.Fatal(err)
+	}
+	gf := st.wantGoAway()
+	if gf.ErrCode != ErrCodeFlowControl {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeFlowControl)
+	}
+	if gf.LastStreamID != 0 {
+		t.Errorf("GOAWAY last stream ID = %v; want %v", gf.LastStreamID, 0)
+	}
+	if got, want := string(gf.DebugData()), (goAwayFlowError{}).Error(); got != want {
+		t.Errorf("GOAWAY debug data = %q; want %q", got, want)
+	}
+}
+
+func TestServer_WindowUpdate_IdleStream(t *testing.T) {
 	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {})
-	st.addLogFilter("connection error: PROTOCOL_ERROR")
 	defer st.Close()
 	st.greet()
-	writeReq(st)
+	st.bodylessReq1()
+	st.wantHeaders()
+	// Stream 3 was never opened.
+	if err := st.fr.WriteWindowUpdate(3, 1); err != nil {
+		t.Fatal(err)
+	}
+	gf := st.wantGoAway()
+	if gf.ErrCode != ErrCodeProtocol {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeProtocol)
+	}
+}
 
-	st.wantGoAway()
-	errc := make(chan error, 1)
-	go func() {
-		fr, err := st.fr.ReadFrame()
-		if err == nil {
-			err = fmt.Errorf("got frame of type %T", fr)
-		}
-		errc <- err
-	}()
-	select {
-	case err := <-errc:
-		if err != io.EOF {
-			t.Errorf("ReadFrame = %v; want io.EOF", err)
+func TestServer_WindowUpdate_ClosedStream(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	st.wantHeaders()
+	// Stream 3 has closed, and stream 1 was implicitly closed by
+	// opening stream 3; updates to either are ignored.
+	for _, id := range []uint32{1, 3} {
+		if err := st.fr.WriteWindowUpdate(id, 1); err != nil {
+			t.Fatal(err)
 		}
-	case <-time.After(2 * time.Second):
-		t.Error("timeout waiting for disconnect")
 	}
+	st.checkAlive()
 }
 
-// testServerRequest sets up an idle HTTP/2 connection and lets you
-// write a single request with writeReq, and then verify that the
-// *http.Request is built correctly in checkReq.
-func testServerRequest(t *testing.T, writeReq func(*serverTester), checkReq func(*http.Request)) {
-	gotReq := make(chan bool, 1)
+// A refused stream wasn't processed, so it's not covered by GOAWAY's
+// last stream ID, even though it's the highest the server has seen.
+func TestServer_GoAway_LastStreamID_ExcludesRefused(t *testing.T) {
+	inHandler := make(chan bool)
+	leaveHandler := make(chan bool)
 	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
-		if r.Body == nil {
-			t.Fatal("nil Body")
-		}
-		checkReq(r)
-		gotReq <- true
+		inHandler <- true
+		<-leaveHandler
+	}, func(s *Server) {
+		s.MaxConcurrentStreams = 1
 	})
 	defer st.Close()
+	defer close(leaveHandler)
+	st.writePreface()
+	st.writeInitialSettings()
+	st.wantSettings()
+	st.wantSettingsAck()
 
-	st.greet()
-	writeReq(st)
+	st.bodylessReq1()
+	<-inHandler
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	st.wantRSTStream(3, ErrCodeRefusedStream)
 
-	select {
-	case <-gotReq:
-	case <-time.After(2 * time.Second):
-		t.Error("timeout waiting for request")
+	if err := st.fr.WriteWindowUpdate(0, 1<<31-1); err != nil {
+		t.Fatal(err)
+	}
+	gf := st.wantGoAway()
+	if gf.LastStreamID != 1 {
+		t.Errorf("GOAWAY last stream ID = %v; want 1", gf.LastStreamID)
 	}
 }
 
-func getSlash(st *serverTester) { st.bodylessReq1() }
+// Test that a GOAWAY from the client lets its open streams finish,
+// and that the server then hangs up.
+func TestServer_GoAway_FromClient(t *testing.T) {
+	inHandler := make(chan bool)
+	leaveHandler := make(chan bool)
+	pushErr := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		<-leaveHandler
+		pushErr <- w.(http.Pusher).Push("/pushed", nil)
+		io.WriteString(w, "done")
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+	<-inHandler
 
-func TestServer_Response_NoData(t *testing.T) {
-	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		// Nothing.
-		return nil
-	}, func(st *serverTester) {
-		getSlash(st)
-		hf := st.wantHeaders()
-		if !hf.StreamEnded() {
-			t.Fatal("want END_STREAM flag")
+	if err := st.fr.WriteGoAway(0, ErrCodeNo, nil); err != nil {
+		t.Fatal(err)
+	}
+	gf := st.wantGoAway()
+	if gf.ErrCode != ErrCodeNo || gf.LastStreamID != 1 {
+		t.Errorf("GOAWAY = %v, last stream %d; want %v, last stream 1", gf.ErrCode, gf.LastStreamID, ErrCodeNo)
+	}
+	close(leaveHandler)
+	if err := <-pushErr; err != http.ErrNotSupported {
+		t.Errorf("Push after client GOAWAY = %v; want http.ErrNotSupported", err)
+	}
+	hf := st.wantHeaders()
+	if hf.StreamID != 1 || hf.StreamEnded() {
+		t.Fatalf("got HEADERS for stream %d, ended=%v; want stream 1 not ended", hf.StreamID, hf.StreamEnded())
+	}
+	df := st.wantData()
+	if string(df.Data()) != "done" || !df.StreamEnded() {
+		t.Errorf("got DATA %q, ended=%v; want \"done\" ended", df.Data(), df.StreamEnded())
+	}
+	if _, err := st.readFrame(); err != io.EOF {
+		t.Errorf("ReadFrame after the last stream = %v; want io.EOF", err)
+	}
+}
+
+// Test that a client GOAWAY tears down the pushed streams above its
+// last stream ID.
+func TestServer_GoAway_FromClient_ClosesPushes(t *testing.T) {
+	pushedDone := make(chan bool, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			if err := w.(http.Pusher).Push("/pushed", nil); err != nil {
+				t.Errorf("Push = %v", err)
+			}
+		case "/pushed":
+			select {
+			case <-r.Context().Done():
+				pushedDone <- true
+			case <-time.After(5 * time.Second):
+				t.Error("pushed request not canceled")
+			}
+		}
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := f.(*PushPromiseFrame); ok {
+			break
+		}
+	}
+
+	if err := st.fr.WriteGoAway(0, ErrCodeNo, nil); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-pushedDone:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timeout waiting for the pushed stream to be torn down")
+	}
+	for {
+		f, err := st.readFrame()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("ReadFrame = %v; want frames then io.EOF", err)
+		}
+		if df, ok := f.(*DataFrame); ok && df.StreamID == 2 {
+			t.Errorf("got DATA on torn down pushed stream 2")
+		}
+	}
+}
+
+func TestServer_Send_RstStream_After_Bogus_WindowUpdate(t *testing.T) {
+	inHandler := make(chan bool)
+	blockHandler := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		<-blockHandler
+	})
+	defer st.Close()
+	defer close(blockHandler)
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // keep it open
+		EndHeaders:    true,
+	})
+	<-inHandler
+	// Send a bogus window update:
+	if err := st.fr.WriteWindowUpdate(1, 1<<31-1); err != nil {
+		t.Fatal(err)
+	}
+	st.wantRSTStream(1, ErrCodeFlowControl)
+}
+
+// Test that the connection window may grow to exactly 2^31-1, and
+// that one more byte is a FLOW_CONTROL_ERROR.
+func TestServer_Send_GoAway_After_ConnWindow_Overflow(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.greet()
+	if err := st.fr.WriteWindowUpdate(0, 1<<31-1-initialWindowSize); err != nil {
+		t.Fatal(err)
+	}
+	st.checkAlive()
+	if err := st.fr.WriteWindowUpdate(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	if gf := st.wantGoAway(); gf.ErrCode != ErrCodeFlowControl {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeFlowControl)
+	}
+}
+
+// Test that a stream's window may grow to exactly 2^31-1, and that
+// one more byte resets the stream with FLOW_CONTROL_ERROR.
+func TestServer_Send_RstStream_After_StreamWindow_Overflow(t *testing.T) {
+	inHandler := make(chan bool, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		<-w.(http.CloseNotifier).CloseNotify()
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // keep it open
+		EndHeaders:    true,
+	})
+	<-inHandler
+	if err := st.fr.WriteWindowUpdate(1, 1<<31-1-initialWindowSize); err != nil {
+		t.Fatal(err)
+	}
+	st.checkAlive()
+	if err := st.fr.WriteWindowUpdate(1, 1); err != nil {
+		t.Fatal(err)
+	}
+	st.wantRSTStream(1, ErrCodeFlowControl)
+}
+
+func TestServer_Send_GoAway_After_Zero_WindowUpdate(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.greet()
+	if err := st.fr.WriteRawFrame(FrameWindowUpdate, 0, 0, []byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if gf := st.wantGoAway(); gf.ErrCode != ErrCodeProtocol {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeProtocol)
+	}
+}
+
+// Test that a zero increment on a stream only resets that stream,
+// and the connection keeps serving requests.
+func TestServer_Send_RstStream_After_Zero_WindowUpdate(t *testing.T) {
+	inHandler := make(chan bool, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			inHandler <- true
+			<-w.(http.CloseNotifier).CloseNotify()
+		}
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // keep it open
+		EndHeaders:    true,
+	})
+	<-inHandler
+	if err := st.fr.WriteRawFrame(FrameWindowUpdate, 0, 1, []byte{0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	st.wantRSTStream(1, ErrCodeProtocol)
+
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	hf := st.wantHeaders()
+	if hf.StreamID != 3 || !hf.StreamEnded() {
+		t.Errorf("got HEADERS for stream %d, ended=%v; want stream 3 ended", hf.StreamID, hf.StreamEnded())
+	}
+}
+
+func TestServer_Send_GoAway_After_Exceeding_ConnWindow(t *testing.T) {
+	inHandler := make(chan bool)
+	blockHandler := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		<-blockHandler
+	})
+	defer st.Close()
+	defer close(blockHandler)
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // keep it open
+		EndHeaders:    true,
+	})
+	<-inHandler
+	// Use up the whole window without the handler reading any of it,
+	// then send one byte more.
+	st.writeData(1, false, make([]byte, initialWindowSize))
+	st.writeData(1, false, []byte("x"))
+	gf := st.wantGoAway()
+	if gf.ErrCode != ErrCodeFlowControl {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeFlowControl)
+	}
+}
+
+func TestServer_Send_RstStream_After_Exceeding_StreamWindow(t *testing.T) {
+	inHandler := make(chan bool)
+	blockHandler := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		<-blockHandler
+	})
+	defer st.Close()
+	defer close(blockHandler)
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // keep it open
+		EndHeaders:    true,
+	})
+	<-inHandler
+	// Shrink the stream's receive window below the connection's,
+	// as if we'd advertised a smaller per-stream window.
+	const streamWindow = 10
+	done := make(chan bool)
+	st.sc.testHookCh <- func() {
+		st.sc.streams[1].inflow.n = streamWindow
+		close(done)
+	}
+	<-done
+	st.writeData(1, false, make([]byte, streamWindow+1))
+	// The connection-level window is handed back, since those
+	// bytes will never be read by the handler.
+	st.wantWindowUpdate(0, streamWindow+1)
+	st.wantRSTStream(1, ErrCodeFlowControl)
+}
+
+func TestServer_Send_RstStream_After_Data_To_Closed_Body(t *testing.T) {
+	inHandler := make(chan bool)
+	blockHandler := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		r.Body.Close()
+		inHandler <- true
+		<-blockHandler
+	})
+	defer st.Close()
+	defer close(blockHandler)
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // keep it open
+		EndHeaders:    true,
+	})
+	<-inHandler
+	st.writeData(1, false, []byte("foo"))
+	// The handler closed the body, so nothing will ever read
+	// those bytes. Their connection-level window is handed back.
+	st.wantWindowUpdate(0, 3)
+	st.wantRSTStream(1, ErrCodeStreamClosed)
+
+	// And it's only charged once.
+	connWindow := make(chan int32, 1)
+	st.sc.testHookCh <- func() { connWindow <- st.sc.inflow.n }
+	if got := <-connWindow; got != initialWindowSize {
+		t.Errorf("connection receive window = %d; want %d", got, initialWindowSize)
+	}
+}
+
+// Test that padding is stripped from the request body but charged
+// to, and then immediately returned to, both receive windows.
+func TestServer_Data_Padded(t *testing.T) {
+	const padLen = 10
+	inHandler := make(chan bool)
+	readBody := make(chan bool)
+	gotBody := make(chan string, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		<-readBody
+		slurp, _ := ioutil.ReadAll(r.Body)
+		gotBody <- string(slurp)
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	<-inHandler
+
+	payload := append([]byte{padLen}, "foo"...)
+	payload = append(payload, make([]byte, padLen)...)
+	if err := st.fr.WriteRawFrame(FrameData, FlagDataPadded|FlagDataEndStream, 1, payload); err != nil {
+		t.Fatal(err)
+	}
+	// Pad Length field plus padding:
+	const charged = 1 + padLen
+	st.wantWindowUpdate(0, charged)
+	st.wantWindowUpdate(1, charged)
+
+	windows := make(chan [2]int32, 1)
+	st.sc.testHookCh <- func() {
+		windows <- [2]int32{st.sc.inflow.n, st.sc.streams[1].inflow.n}
+	}
+	if got, want := <-windows, int32(initialWindowSize-len("foo")); got[0] != want || got[1] != want {
+		t.Errorf("conn, stream receive windows = %v; want %d for both", got, want)
+	}
+
+	close(readBody)
+	if got := <-gotBody; got != "foo" {
+		t.Errorf("body = %q; want %q", got, "foo")
+	}
+}
+
+func TestServer_Rejects_Data_PadLengthTooLarge(t *testing.T) {
+	// The handler doesn't respond, so its HEADERS can't beat the GOAWAY.
+	testServerRejectsHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		<-w.(http.CloseNotifier).CloseNotify()
+	}, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(":method", "POST"),
+			EndStream:     false,
+			EndHeaders:    true,
+		})
+		// Claims 5 bytes of padding; only 3 follow.
+		if err := st.fr.WriteRawFrame(FrameData, FlagDataPadded, 1, []byte{5, 0, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestServer_Request_Headers_PaddedWithPriority(t *testing.T) {
+	inHandler := make(chan bool)
+	blockHandler := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Foo"); got != "bar" {
+			t.Errorf("Foo header = %q; want %q", got, "bar")
+		}
+		inHandler <- true
+		<-blockHandler
+	})
+	defer st.Close()
+	defer close(blockHandler)
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader("foo", "bar"),
+		EndStream:     true,
+		EndHeaders:    true,
+		PadLength:     7,
+		Priority:      PriorityParam{StreamDep: 3, Weight: 99},
+	})
+	<-inHandler
+	if w := st.stream(1).weight; w != 99 {
+		t.Errorf("stream weight = %d; want 99", w)
+	}
+}
+
+func TestServer_Priority(t *testing.T) {
+	inHandler := make(chan bool)
+	blockHandler := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		<-blockHandler
+	})
+	defer st.Close()
+	defer close(blockHandler)
+	st.greet()
+	for _, id := range []uint32{1, 3} {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      id,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+		<-inHandler
+	}
+	st.writePriority(3, PriorityParam{StreamDep: 1, Weight: 42})
+
+	// PRIORITY has no reply; use a PING to know it was processed.
+	if err := st.fr.WritePing(false, [8]byte{}); err != nil {
+		t.Fatal(err)
+	}
+	st.wantPing()
+
+	s1, s3 := st.stream(1), st.stream(3)
+	if s3.parent != s1 {
+		t.Errorf("stream 3 parent = %v; want stream 1", s3.parent)
+	}
+	if s3.weight != 42 {
+		t.Errorf("stream 3 weight = %d; want 42", s3.weight)
+	}
+}
+
+func TestServer_Priority_SelfDependency(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.greet()
+	st.writePriority(1, PriorityParam{StreamDep: 1, Weight: 15})
+	st.wantRSTStream(1, ErrCodeProtocol)
+}
+
+// testServerPostUnblock sends a hanging POST with unsent data to handler,
+// then runs fn once in the handler, and verifies that the error returned from
+// handler is acceptable. It fails if takes over 5 seconds for handler to exit.
+func testServerPostUnblock(t *testing.T,
+	handler func(http.ResponseWriter, *http.Request) error,
+	fn func(*serverTester),
+	checkErr func(error),
+	otherHeaders ...string) {
+	inHandler := make(chan bool)
+	errc := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		errc <- handler(w, r)
+	})
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(append([]string{":method", "POST"}, otherHeaders...)...),
+		EndStream:     false, // keep it open
+		EndHeaders:    true,
+	})
+	<-inHandler
+	fn(st)
+	select {
+	case err := <-errc:
+		if checkErr != nil {
+			checkErr(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for Handler to return")
+	}
+	st.Close()
+}
+
+func TestServer_RSTStream_Unblocks_Read(t *testing.T) {
+	testServerPostUnblock(t,
+		func(w http.ResponseWriter, r *http.Request) (err error) {
+			_, err = r.Body.Read(make([]byte, 1))
+			return
+		},
+		func(st *serverTester) {
+			if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func(err error) {
+			if err == nil {
+				t.Error("unexpected nil error from Request.Body.Read")
+			}
+		},
+	)
+}
+
+// Test that once the client resets a stream, the handler's writes fail
+// rather than block, and the stream is gone from the server's map.
+func TestServer_RSTStream_Fails_Write(t *testing.T) {
+	var st *serverTester
+	testServerPostUnblock(t,
+		func(w http.ResponseWriter, r *http.Request) error {
+			<-w.(http.CloseNotifier).CloseNotify()
+			if st.stream(1) != nil {
+				t.Error("stream 1 still in the streams map after RST_STREAM")
+			}
+			// Larger than the handler's write buffer, so the
+			// write goes straight to the (reset) stream.
+			_, err := w.Write(make([]byte, 2*handlerChunkWriteSize))
+			return err
+		},
+		func(st0 *serverTester) {
+			st = st0
+			if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+				t.Fatal(err)
+			}
+		},
+		func(err error) {
+			if err == nil {
+				t.Error("unexpected nil error from ResponseWriter.Write")
+			}
+		},
+	)
+}
+
+func TestServer_DeadConn_Unblocks_Read(t *testing.T) {
+	testServerPostUnblock(t,
+		func(w http.ResponseWriter, r *http.Request) (err error) {
+			_, err = r.Body.Read(make([]byte, 1))
+			return
+		},
+		func(st *serverTester) { st.cc.Close() },
+		func(err error) {
+			if err == nil {
+				t.Error("unexpected nil error from Request.Body.Read")
+			}
+		},
+	)
+}
+
+// When the connection dies, serve's teardown unblocks every handler
+// still running on it, whatever it's waiting on, so their
+// goroutines don't leak.
+func TestServer_ConnClose_ReleasesHandlers(t *testing.T) {
+	started := make(chan bool, 3)
+	returned := make(chan string, 3)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		defer func() { returned <- r.URL.Path }()
+		started <- true
+		switch r.URL.Path {
+		case "/write": // more than the flow control window allows
+			for {
+				if _, err := w.Write(make([]byte, 16<<10)); err != nil {
+					return
+				}
+			}
+		case "/read":
+			io.Copy(ioutil.Discard, r.Body)
+		case "/wait":
+			<-r.Context().Done()
+		}
+	})
+	defer st.Close()
+	st.greet()
+	for i, path := range []string{"/write", "/read", "/wait"} {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1 + uint32(i)*2,
+			BlockFragment: st.encodeHeader(":method", "POST", ":path", path),
+			EndStream:     path != "/read",
+			EndHeaders:    true,
+		})
+	}
+	for i := 0; i < 3; i++ {
+		<-started
+	}
+	st.cc.Close()
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < 3; i++ {
+		select {
+		case <-returned:
+		case <-timeout:
+			t.Fatalf("only %d of 3 handlers returned after the conn closed", i)
+		}
+	}
+}
+
+var blockUntilClosed = func(w http.ResponseWriter, r *http.Request) error {
+	<-w.(http.CloseNotifier).CloseNotify()
+	return nil
+}
+
+func TestServer_CloseNotify_After_RSTStream(t *testing.T) {
+	testServerPostUnblock(t, blockUntilClosed, func(st *serverTester) {
+		if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+			t.Fatal(err)
+		}
+	}, nil)
+}
+
+// Test that CloseNotify also fires for a stream whose request has
+// already ended (half-closed remote), as for a GET.
+func TestServer_CloseNotify_After_RSTStream_HalfClosed(t *testing.T) {
+	inHandler := make(chan bool)
+	notified := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		<-w.(http.CloseNotifier).CloseNotify()
+		close(notified)
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+	<-inHandler
+	if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CloseNotify didn't fire after RST_STREAM")
+	}
+}
+
+func TestServer_CloseNotify_After_ConnClose(t *testing.T) {
+	testServerPostUnblock(t, blockUntilClosed, func(st *serverTester) { st.cc.Close() }, nil)
+}
+
+// that CloseNotify unblocks after a stream error due to the client's
+// problem that's unrelated to them explicitly canceling it (which is
+// TestServer_CloseNotify_After_RSTStream above)
+func TestServer_CloseNotify_After_StreamError(t *testing.T) {
+	testServerPostUnblock(t, blockUntilClosed, func(st *serverTester) {
+		// data longer than declared Content-Length => stream error
+		st.writeData(1, true, []byte("1234"))
+	}, nil, "content-length", "3")
+}
+
+var blockUntilCanceled = func(w http.ResponseWriter, r *http.Request) error {
+	<-r.Context().Done()
+	return nil
+}
+
+func TestServer_Context_Canceled_After_RSTStream(t *testing.T) {
+	testServerPostUnblock(t, blockUntilCanceled, func(st *serverTester) {
+		if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+			t.Fatal(err)
+		}
+	}, nil)
+}
+
+func TestServer_Context_Canceled_After_ConnClose(t *testing.T) {
+	testServerPostUnblock(t, blockUntilCanceled, func(st *serverTester) { st.cc.Close() }, nil)
+}
+
+func TestServer_Context_Canceled_After_HandlerReturns(t *testing.T) {
+	ctxc := make(chan context.Context, 1)
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		ctxc <- r.Context()
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		st.wantHeaders()
+		ctx := <-ctxc
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+			t.Fatal("request context not canceled after the handler returned")
+		}
+	})
+}
+
+func TestServer_StateTransitions(t *testing.T) {
+	var st *serverTester
+	inHandler := make(chan bool)
+	writeData := make(chan bool)
+	leaveHandler := make(chan bool)
+	st = newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		if st.stream(1) == nil {
+			t.Errorf("nil stream 1 in handler")
+		}
+		if got, want := st.streamState(1), stateOpen; got != want {
+			t.Errorf("in handler, state is %v; want %v", got, want)
+		}
+		writeData <- true
+		if n, err := r.Body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("body read = %d, %v; want 0, EOF", n, err)
+		}
+		if got, want := st.streamState(1), stateHalfClosedRemote; got != want {
+			t.Errorf("in handler, state is %v; want %v", got, want)
+		}
+
+		<-leaveHandler
+	})
+	st.greet()
+	if st.stream(1) != nil {
+		t.Fatal("stream 1 should be empty")
+	}
+	if got := st.streamState(1); got != stateIdle {
+		t.Fatalf("stream 1 should be idle; got %v", got)
+	}
+
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // keep it open
+		EndHeaders:    true,
+	})
+	<-inHandler
+	<-writeData
+	st.writeData(1, true, nil)
+
+	leaveHandler <- true
+	hf := st.wantHeaders()
+	if !hf.StreamEnded() {
+		t.Fatal("expected END_STREAM flag")
+	}
+
+	if got, want := st.streamState(1), stateClosed; got != want {
+		t.Errorf("at end, state is %v; want %v", got, want)
+	}
+	if st.stream(1) != nil {
+		t.Fatal("at end, stream 1 should be gone")
+	}
+}
+
+// test HEADERS w/o EndHeaders + another HEADERS (should get rejected)
+func TestServer_Rejects_HeadersNoEnd_Then_Headers(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    false,
+		})
+		st.writeHeaders(HeadersFrameParam{ // Not a continuation.
+			StreamID:      3, // different stream.
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	})
+}
+
+// test HEADERS w/o EndHeaders + another HEADERS on the same stream
+func TestServer_Rejects_HeadersNoEnd_Then_HeadersSameStream(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     false,
+			EndHeaders:    false,
+		})
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: encodeHeaderNoImplicit(t, "foo", "bar"),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	})
+}
+
+// Test that HEADERS can't reopen a stream the client has finished
+// sending on: a half-closed stream is reset with STREAM_CLOSED,
+// leaving the connection usable, and a closed one's ID is no longer
+// idle, which is a connection error.
+func TestServer_Rejects_HeadersTwice_SameStream(t *testing.T) {
+	release := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/block" {
+			<-release
+		}
+	})
+	defer st.Close()
+	st.greet()
+
+	// Half-closed (remote) while the handler runs.
+	for i := 0; i < 2; i++ {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(":path", "/block"),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	}
+	st.wantRSTStream(1, ErrCodeStreamClosed)
+	close(release)
+
+	// The rejected block was still decoded, so the HPACK
+	// state is in sync for the next request.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(":path", "/block"),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	if hf := st.wantHeaders(); hf.StreamID != 3 || !hf.StreamEnded() {
+		t.Fatalf("got %v; want stream 3's response with END_STREAM", hf)
+	}
+	st.checkAlive() // stream 3 has been closed
+
+	// Closed.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	if gf := st.wantGoAway(); gf.ErrCode != ErrCodeProtocol {
+		t.Errorf("GOAWAY code = %v; want PROTOCOL_ERROR", gf.ErrCode)
+	}
+}
+
+// test HEADERS w/o EndHeaders + DATA on the same stream
+func TestServer_Rejects_HeadersNoEnd_Then_Data(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(":method", "POST"),
+			EndStream:     false,
+			EndHeaders:    false,
+		})
+		st.writeData(1, true, []byte("abc"))
+	})
+}
+
+// test HEADERS w/o EndHeaders + a frame the Framer itself rejects
+// with a stream error (a zero WINDOW_UPDATE increment)
+func TestServer_Rejects_HeadersNoEnd_Then_ZeroWindowUpdate(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    false,
+		})
+		if err := st.fr.WriteRawFrame(FrameWindowUpdate, 0, 1, []byte{0, 0, 0, 0}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// test HEADERS w/o EndHeaders + PING (should get rejected)
+func TestServer_Rejects_HeadersNoEnd_Then_Ping(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    false,
+		})
+		if err := st.fr.WritePing(false, [8]byte{}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// test HEADERS w/ EndHeaders + a continuation HEADERS (should get rejected)
+func TestServer_Rejects_HeadersEnd_Then_Continuation(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+		st.wantHeaders()
+		if err := st.fr.WriteContinuation(1, true, encodeHeaderNoImplicit(t, "foo", "bar")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// test HEADERS w/o EndHeaders + a continuation HEADERS on wrong stream ID
+func TestServer_Rejects_HeadersNoEnd_Then_ContinuationWrongStream(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    false,
+		})
+		if err := st.fr.WriteContinuation(3, true, encodeHeaderNoImplicit(t, "foo", "bar")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// No HEADERS on stream 0.
+func TestServer_Rejects_Headers0(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.fr.AllowIllegalWrites = true
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      0,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+	})
+}
+
+// No DATA on stream 0.
+func TestServer_Rejects_Data0(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.fr.AllowIllegalWrites = true
+		st.writeData(0, true, []byte("foo"))
+	})
+}
+
+// No CONTINUATION on stream 0.
+// test a CONTINUATION with no HEADERS before it at all
+func TestServer_Rejects_Continuation_NoHeaders(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		if err := st.fr.WriteContinuation(1, true, st.encodeHeader()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// test a CONTINUATION on an open stream whose header block is done
+func TestServer_Rejects_Continuation_OpenStream(t *testing.T) {
+	testServerRejectsHandler(t, func(w http.ResponseWriter, r *http.Request) {
+		<-w.(http.CloseNotifier).CloseNotify()
+	}, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     false,
+			EndHeaders:    true,
+		})
+		if err := st.fr.WriteContinuation(1, true, encodeHeaderNoImplicit(t, "foo", "bar")); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestServer_Rejects_Continuation0(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		st.fr.AllowIllegalWrites = true
+		if err := st.fr.WriteContinuation(0, true, st.encodeHeader()); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestServer_Rejects_PushPromise(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		pp := PushPromiseParam{
+			StreamID:  1,
+			PromiseID: 3,
+		}
+		if err := st.fr.WritePushPromise(pp); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestServer_Rejects_MaxFrameSize_TooSmall(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		if err := st.fr.WriteSettings(Setting{SettingMaxFrameSize, 1<<14 - 1}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestServer_Rejects_MaxFrameSize_TooLarge(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		if err := st.fr.WriteSettings(Setting{SettingMaxFrameSize, 1 << 24}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestServer_Rejects_EnablePush_Invalid(t *testing.T) {
+	testServerRejects(t, func(st *serverTester) {
+		if err := st.fr.WriteSettings(Setting{SettingEnablePush, 2}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestServer_EnablePush_Disabled(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.greet()
+	if err := st.fr.WriteSettings(Setting{SettingEnablePush, 0}); err != nil {
+		t.Fatal(err)
+	}
+	st.wantSettingsAck()
+	enabled := make(chan bool, 1)
+	st.sc.testHookCh <- func() { enabled <- st.sc.pushEnabled }
+	if <-enabled {
+		t.Error("push still enabled after client sent ENABLE_PUSH=0")
+	}
+}
+
+// testServerRejects tests that the server hangs up with a GOAWAY
+// frame and a server close after the client does something
+// deserving a CONNECTION_ERROR.
+func testServerRejects(t *testing.T, writeReq func(*serverTester)) {
+	testServerRejectsHandler(t, func(w http.ResponseWriter, r *http.Request) {}, writeReq)
+}
+
+// testServerRejectsHandler is like testServerRejects, for when
+// writeReq starts a request that handler serves.
+func testServerRejectsHandler(t *testing.T, handler http.HandlerFunc, writeReq func(*serverTester)) {
+	st := newServerTester(t, handler)
+	st.addLogFilter("connection error: PROTOCOL_ERROR")
+	defer st.Close()
+	st.greet()
+	writeReq(st)
+
+	if gf := st.wantGoAway(); gf.ErrCode != ErrCodeProtocol {
+		t.Errorf("GOAWAY error code = %v; want %v", gf.ErrCode, ErrCodeProtocol)
+	}
+	errc := make(chan error, 1)
+	go func() {
+		fr, err := st.fr.ReadFrame()
+		if err == nil {
+			err = fmt.Errorf("got frame of type %T", fr)
+		}
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		if err != io.EOF {
+			t.Errorf("ReadFrame = %v; want io.EOF", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("timeout waiting for disconnect")
+	}
+}
+
+// testServerRequest sets up an idle HTTP/2 connection and lets you
+// write a single request with writeReq, and then verify that the
+// *http.Request is built correctly in checkReq.
+func testServerRequest(t *testing.T, writeReq func(*serverTester), checkReq func(*http.Request)) {
+	gotReq := make(chan bool, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Body == nil {
+			t.Fatal("nil Body")
+		}
+		checkReq(r)
+		gotReq <- true
+	})
+	defer st.Close()
+
+	st.greet()
+	writeReq(st)
+
+	select {
+	case <-gotReq:
+	case <-time.After(2 * time.Second):
+		t.Error("timeout waiting for request")
+	}
+}
+
+func getSlash(st *serverTester) { st.bodylessReq1() }
+
+func TestServer_Response_NoData(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		// Nothing.
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if !hf.StreamEnded() {
+			t.Fatal("want END_STREAM flag")
+		}
+		if !hf.HeadersEnded() {
+			t.Fatal("want END_HEADERS flag")
+		}
+	})
+}
+
+func TestServer_Response_NoContent_SingleFrame(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if !hf.StreamEnded() || !hf.HeadersEnded() {
+			t.Fatalf("want END_STREAM and END_HEADERS flags; got %v", hf)
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		if len(goth) == 0 || goth[0] != [2]string{":status", "204"} {
+			t.Errorf("Got headers %v; want :status 204 first", goth)
+		}
+		// Nothing else, such as an empty DATA frame, follows
+		// on the stream: the next frame is the PING reply.
+		if err := st.fr.WritePing(false, [8]byte{}); err != nil {
+			t.Fatal(err)
+		}
+		st.wantPing()
+	})
+}
+
+func TestServer_Response_Trailers(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Trailer", "Server-Trailer-A, Server-Trailer-B")
+		w.Header().Add("Trailer", "Server-Trailer-C")
+		io.WriteString(w, "Hello")
+		w.Header().Set("Server-Trailer-A", "valuea")
+		w.Header().Set("Server-Trailer-C", "valuec")
+		// Undeclared, using the http.TrailerPrefix convention:
+		w.Header().Set(http.TrailerPrefix+"Server-Trailer-D", "valued")
+		// Not a trailer; the header was already sent.
+		w.Header().Set("Foo", "Bar")
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("response HEADERS had END_STREAM")
+		}
+		df := st.wantData()
+		if string(df.Data()) != "Hello" {
+			t.Fatalf("DATA = %q; want Hello", df.Data())
+		}
+		if df.StreamEnded() {
+			t.Fatal("DATA had END_STREAM; want it on the trailers")
+		}
+		tf := st.wantHeaders()
+		if !tf.StreamEnded() || !tf.HeadersEnded() {
+			t.Fatalf("trailers HEADERS = %v; want END_STREAM and END_HEADERS", tf)
+		}
+		goth := decodeHeader(t, tf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{"server-trailer-a", "valuea"},
+			{"server-trailer-c", "valuec"},
+			{"server-trailer-d", "valued"},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got trailers %v; want %v", goth, wanth)
+		}
+	})
+}
+
+// Test that headers named in SensitiveHeaders, trailers included,
+// are encoded with HPACK's never-indexed representation, and that
+// SensitiveHeaders itself isn't sent.
+func TestServer_Response_SensitiveHeaders(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set(SensitiveHeaders, "Set-Cookie, server-trailer")
+		w.Header().Set("Trailer", "Server-Trailer")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Header().Set("X-Plain", "public")
+		io.WriteString(w, "Hello")
+		w.Header().Set("Server-Trailer", "token")
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		got := map[string]bool{} // name -> Sensitive
+		dec := hpack.NewDecoder(initialHeaderTableSize, func(f hpack.HeaderField) {
+			got[f.Name] = f.Sensitive
+		})
+		hf := st.wantHeaders()
+		if _, err := dec.Write(hf.HeaderBlockFragment()); err != nil {
+			t.Fatal(err)
+		}
+		st.wantData()
+		tf := st.wantHeaders()
+		if _, err := dec.Write(tf.HeaderBlockFragment()); err != nil {
+			t.Fatal(err)
+		}
+		want := map[string]bool{
+			":status":        false,
+			"trailer":        false,
+			"set-cookie":     true,
+			"x-plain":        false,
+			"content-type":   false,
+			"content-length": false,
+			"server-trailer": true,
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got header fields (name: sensitive) %v; want %v", got, want)
+		}
+	})
+}
+
+// Test that declared trailers left unset don't produce a trailing
+// HEADERS frame.
+// Test that connection-specific fields declared as trailers aren't
+// sent in the trailers block.
+func TestServer_Response_Trailers_ConnHeaders(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Trailer", "Connection, Server-Trailer")
+		io.WriteString(w, "Hello")
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Server-Trailer", "value")
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		st.wantHeaders()
+		st.wantData()
+		tf := st.wantHeaders()
+		if !tf.StreamEnded() {
+			t.Fatalf("trailers HEADERS = %v; want END_STREAM", tf)
+		}
+		goth := decodeHeader(t, tf.HeaderBlockFragment())
+		wanth := [][2]string{{"server-trailer", "value"}}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got trailers %v; want %v", goth, wanth)
+		}
+	})
+}
+
+func TestServer_Response_Trailers_Unset(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Trailer", "Server-Trailer-A")
+		io.WriteString(w, "Hello")
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		st.wantHeaders()
+		df := st.wantData()
+		if string(df.Data()) != "Hello" || !df.StreamEnded() {
+			t.Fatalf("DATA = %q, END_STREAM=%v; want Hello with END_STREAM", df.Data(), df.StreamEnded())
+		}
+	})
+}
+
+func TestServer_Response_NoData_Header_FooBar(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Foo-Bar", "some-value")
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if !hf.StreamEnded() {
+			t.Fatal("want END_STREAM flag")
+		}
+		if !hf.HeadersEnded() {
+			t.Fatal("want END_HEADERS flag")
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"foo-bar", "some-value"},
+			{"content-type", "text/plain; charset=utf-8"},
+			{"content-length", "0"},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+	})
+}
+
+func TestServer_Response_Data_Sniff_DoesntOverride(t *testing.T) {
+	const msg = "<html>this is HTML."
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "foo/bar")
+		io.WriteString(w, msg)
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("don't want END_STREAM, expecting data")
+		}
+		if !hf.HeadersEnded() {
+			t.Fatal("want END_HEADERS flag")
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"content-type", "foo/bar"},
+			{"content-length", strconv.Itoa(len(msg))},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+		df := st.wantData()
+		if !df.StreamEnded() {
+			t.Error("expected DATA to have END_STREAM flag")
+		}
+		if got := string(df.Data()); got != msg {
+			t.Errorf("got DATA %q; want %q", got, msg)
+		}
+	})
+}
+
+func TestServer_Response_TransferEncoding_chunked(t *testing.T) {
+	const msg = "hi"
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Transfer-Encoding", "chunked") // should be stripped
+		io.WriteString(w, msg)
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"content-type", "text/plain; charset=utf-8"},
+			{"content-length", strconv.Itoa(len(msg))},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+	})
+}
+
+func TestServer_Response_ConnectionHeaders(t *testing.T) {
+	const msg = "hi"
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Connection", "close")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Connection", "keep-alive")
+		w.Header().Set("Upgrade", "websocket")
+		io.WriteString(w, msg)
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"content-type", "text/plain; charset=utf-8"},
+			{"content-length", strconv.Itoa(len(msg))},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+	})
+}
+
+// Header accessed only after the initial write.
+func TestServer_Response_Data_IgnoreHeaderAfterWrite_After(t *testing.T) {
+	const msg = "<html>this is HTML."
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		io.WriteString(w, msg)
+		w.Header().Set("foo", "should be ignored")
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("unexpected END_STREAM")
+		}
+		if !hf.HeadersEnded() {
+			t.Fatal("want END_HEADERS flag")
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"content-type", "text/html; charset=utf-8"},
+			{"content-length", strconv.Itoa(len(msg))},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+	})
+}
+
+// Header accessed before the initial write and later mutated.
+func TestServer_Response_Data_IgnoreHeaderAfterWrite_Overwrite(t *testing.T) {
+	const msg = "<html>this is HTML."
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("foo", "proper value")
+		io.WriteString(w, msg)
+		w.Header().Set("foo", "should be ignored")
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("unexpected END_STREAM")
+		}
+		if !hf.HeadersEnded() {
+			t.Fatal("want END_HEADERS flag")
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"foo", "proper value"},
+			{"content-type", "text/html; charset=utf-8"},
+			{"content-length", strconv.Itoa(len(msg))},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+	})
+}
+
+func TestServer_Response_Data_SniffLenType(t *testing.T) {
+	const msg = "<html>this is HTML."
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		io.WriteString(w, msg)
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("don't want END_STREAM, expecting data")
+		}
+		if !hf.HeadersEnded() {
+			t.Fatal("want END_HEADERS flag")
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"content-type", "text/html; charset=utf-8"},
+			{"content-length", strconv.Itoa(len(msg))},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+		df := st.wantData()
+		if !df.StreamEnded() {
+			t.Error("expected DATA to have END_STREAM flag")
+		}
+		if got := string(df.Data()); got != msg {
+			t.Errorf("got DATA %q; want %q", got, msg)
+		}
+	})
+}
+
+// Test a server-sent-events style handler: each flushed event must
+// reach the client while the handler is still running.
+func TestServer_Response_Flush_Streaming(t *testing.T) {
+	sawEvent := make(chan bool)
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.(http.Flusher).Flush() // implies WriteHeader(200)
+		for i := 0; i < 3; i++ {
+			fmt.Fprintf(w, "data: %d\n\n", i)
+			w.(http.Flusher).Flush()
+			select {
+			case <-sawEvent:
+			case <-time.After(2 * time.Second):
+				return fmt.Errorf("client didn't see event %d before the handler returned", i)
+			}
+		}
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("unexpected END_STREAM flag")
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"content-type", "text/event-stream"},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+		for i := 0; i < 3; i++ {
+			df := st.wantData()
+			if df.StreamEnded() {
+				t.Fatal("unexpected END_STREAM flag")
+			}
+			if got, want := string(df.Data()), fmt.Sprintf("data: %d\n\n", i); got != want {
+				t.Errorf("event %d = %q; want %q", i, got, want)
+			}
+			sawEvent <- true
+		}
+		df := st.wantData()
+		if !df.StreamEnded() || len(df.Data()) != 0 {
+			t.Errorf("final DATA = %d bytes, END_STREAM=%v; want empty with END_STREAM", len(df.Data()), df.StreamEnded())
+		}
+	})
+}
+
+func TestServer_Response_ContentTypeSniff(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler func(http.ResponseWriter)
+		want    string // content-type, or "" for none
+	}{
+		{
+			name: "html",
+			handler: func(w http.ResponseWriter) {
+				io.WriteString(w, "<!DOCTYPE html>")
+				io.WriteString(w, "<title>sniffed</title>")
+			},
+			want: "text/html; charset=utf-8",
+		},
+		{
+			name: "set",
+			handler: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Type", "application/foo")
+				io.WriteString(w, "<!DOCTYPE html>")
+			},
+			want: "application/foo",
+		},
+		{
+			name: "suppressed",
+			handler: func(w http.ResponseWriter) {
+				w.Header()["Content-Type"] = nil
+				io.WriteString(w, "<!DOCTYPE html>")
+			},
+		},
+		{
+			name: "no_content",
+			handler: func(w http.ResponseWriter) {
+				w.WriteHeader(http.StatusNoContent)
+			},
+		},
+	}
+	for _, tt := range tests {
+		testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+			tt.handler(w)
+			return nil
+		}, func(st *serverTester) {
+			getSlash(st)
+			hf := st.wantHeaders()
+			var got string
+			for _, kv := range decodeHeader(t, hf.HeaderBlockFragment()) {
+				if kv[0] == "content-type" {
+					got = kv[1]
+				}
+			}
+			if got != tt.want {
+				t.Errorf("%s: content-type = %q; want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_Response_AutomaticContentLength(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		handler func(http.ResponseWriter)
+		want    string // content-length, or "" for none
+	}{
+		{
+			name:    "one_write",
+			handler: func(w http.ResponseWriter) { io.WriteString(w, "hello") },
+			want:    "5",
+		},
+		{
+			name: "small_writes",
+			handler: func(w http.ResponseWriter) {
+				io.WriteString(w, "hello, ")
+				io.WriteString(w, "world")
+			},
+			want: "12",
+		},
+		{
+			name:    "empty",
+			handler: func(w http.ResponseWriter) {},
+			want:    "0",
+		},
+		{
+			name: "flushed",
+			handler: func(w http.ResponseWriter) {
+				io.WriteString(w, "hello")
+				w.(http.Flusher).Flush()
+			},
+		},
+		{
+			name: "too_big",
+			handler: func(w http.ResponseWriter) {
+				w.Write(make([]byte, handlerChunkWriteSize+1))
+			},
+		},
+		{
+			name:    "head",
+			method:  "HEAD",
+			handler: func(w http.ResponseWriter) {},
+		},
+		{
+			name:    "not_modified",
+			handler: func(w http.ResponseWriter) { w.WriteHeader(http.StatusNotModified) },
+		},
+	}
+	for _, tt := range tests {
+		testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+			tt.handler(w)
+			return nil
+		}, func(st *serverTester) {
+			if tt.method != "" {
+				st.bodylessReq1(":method", tt.method)
+			} else {
+				getSlash(st)
+			}
+			hf := st.wantHeaders()
+			var got string
+			for _, kv := range decodeHeader(t, hf.HeaderBlockFragment()) {
+				if kv[0] == "content-length" {
+					got = kv[1]
+				}
+			}
+			if got != tt.want {
+				t.Errorf("%s: content-length = %q; want %q", tt.name, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestServer_Response_Gzip(t *testing.T) {
+	const body = "Some text that the server ought to compress."
+	tests := []struct {
+		name           string
+		acceptEncoding string
+		handler        func(http.ResponseWriter)
+		wantGzip       bool
+		wantEncoding   string
+	}{
+		{
+			name:           "gzip",
+			acceptEncoding: "gzip, deflate",
+			handler:        func(w http.ResponseWriter) { io.WriteString(w, body) },
+			wantGzip:       true,
+			wantEncoding:   "gzip",
+		},
+		{
+			name:     "not_accepted",
+			handler:  func(w http.ResponseWriter) { io.WriteString(w, body) },
+			wantGzip: false,
+		},
+		{
+			name:           "refused",
+			acceptEncoding: "deflate, gzip;q=0",
+			handler:        func(w http.ResponseWriter) { io.WriteString(w, body) },
+			wantGzip:       false,
+		},
+		{
+			name:           "handler_encoded",
+			acceptEncoding: "gzip",
+			handler: func(w http.ResponseWriter) {
+				w.Header().Set("Content-Encoding", "identity")
+				io.WriteString(w, body)
+			},
+			wantGzip:     false,
+			wantEncoding: "identity",
+		},
+	}
+	for _, tt := range tests {
+		st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+			tt.handler(w)
+		}, func(s *Server) {
+			s.CompressResponses = true
+		})
+		st.greet()
+		if tt.acceptEncoding != "" {
+			st.bodylessReq1("accept-encoding", tt.acceptEncoding)
+		} else {
+			st.bodylessReq1()
+		}
+		hf := st.wantHeaders()
+		h := http.Header{}
+		for _, kv := range decodeHeader(t, hf.HeaderBlockFragment()) {
+			h.Add(kv[0], kv[1])
+		}
+		if got := h.Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Errorf("%s: content-encoding = %q; want %q", tt.name, got, tt.wantEncoding)
+		}
+		if got, want := h.Get("Content-Type"), "text/plain; charset=utf-8"; got != want {
+			t.Errorf("%s: content-type = %q; want %q", tt.name, got, want)
+		}
+		var data []byte
+		for {
+			df := st.wantData()
+			data = append(data, df.Data()...)
+			if df.StreamEnded() {
+				break
+			}
+		}
+		if got, want := h.Get("Content-Length"), strconv.Itoa(len(data)); got != want {
+			t.Errorf("%s: content-length = %q; want %q", tt.name, got, want)
+		}
+		if tt.wantGzip {
+			if got := h.Get("Vary"); got != "Accept-Encoding" {
+				t.Errorf("%s: vary = %q; want Accept-Encoding", tt.name, got)
+			}
+			zr, err := gzip.NewReader(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if data, err = ioutil.ReadAll(zr); err != nil {
+				t.Fatalf("%s: reading gzipped body: %v", tt.name, err)
+			}
+		}
+		if string(data) != body {
+			t.Errorf("%s: body = %q; want %q", tt.name, data, body)
+		}
+		st.Close()
+	}
+}
+
+// Test that Flush sends what the handler has written so far, even
+// while it's being compressed.
+func TestServer_Response_Gzip_Flush(t *testing.T) {
+	flushed := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		<-flushed
+		io.WriteString(w, "second")
+	}, func(s *Server) {
+		s.CompressResponses = true
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1("accept-encoding", "gzip")
+	st.wantHeaders()
+
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			f, err := st.readFrame()
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+			df, ok := f.(*DataFrame)
+			if !ok {
+				pw.CloseWithError(fmt.Errorf("got a %T; want *DataFrame", f))
+				return
+			}
+			pw.Write(df.Data())
+			if df.StreamEnded() {
+				pw.Close()
+				return
+			}
+		}
+	}()
+	zr, err := gzip.NewReader(pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("first"))
+	if _, err := io.ReadFull(zr, buf); err != nil || string(buf) != "first" {
+		t.Fatalf("before the handler finished, read %q, %v; want \"first\"", buf, err)
+	}
+	close(flushed)
+	rest, err := ioutil.ReadAll(zr)
+	if err != nil || string(rest) != "second" {
+		t.Errorf("read rest = %q, %v; want \"second\"", rest, err)
+	}
+}
+
+func TestServer_Response_PseudoHeadersIgnored(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set(":foo", "bar")
+		w.Header().Set(":status", "500")
+		w.Header().Set("Trailer", ":baz")
+		w.Header().Set(http.TrailerPrefix+":quux", "x")
+		_, err := io.WriteString(w, "ok")
+		w.Header().Set(":baz", "x")
+		return err
+	}, func(st *serverTester) {
+		st.addLogFilter("pseudo-headers are the server's")
+		getSlash(st)
+		hf := st.wantHeaders()
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"trailer", ":baz"},
+			{"content-type", "text/plain; charset=utf-8"},
+			{"content-length", "2"},
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+		df := st.wantData()
+		if !df.StreamEnded() {
+			t.Error("DATA didn't end the stream; want no trailers")
+		}
+	})
+}
+
+func TestServer_Response_Header_Flush_MidWrite(t *testing.T) {
+	const msg = "<html>this is HTML"
+	const msg2 = ", and this is the next chunk"
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		io.WriteString(w, msg)
+		w.(http.Flusher).Flush()
+		io.WriteString(w, msg2)
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("unexpected END_STREAM flag")
+		}
+		if !hf.HeadersEnded() {
+			t.Fatal("want END_HEADERS flag")
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"content-type", "text/html; charset=utf-8"}, // sniffed
+			// and no content-length
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+		{
+			df := st.wantData()
+			if df.StreamEnded() {
+				t.Error("unexpected END_STREAM flag")
+			}
+			if got := string(df.Data()); got != msg {
+				t.Errorf("got DATA %q; want %q", got, msg)
+			}
+		}
+		{
+			df := st.wantData()
+			if !df.StreamEnded() {
+				t.Error("wanted END_STREAM flag on last data chunk")
+			}
+			if got := string(df.Data()); got != msg2 {
+				t.Errorf("got DATA %q; want %q", got, msg2)
+			}
+		}
+	})
+}
+
+func TestServer_Response_LargeWrite(t *testing.T) {
+	const size = 1 << 20
+	const maxFrameSize = 16 << 10
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		n, err := w.Write(bytes.Repeat([]byte("a"), size))
+		if err != nil {
+			return fmt.Errorf("Write error: %v", err)
+		}
+		if n != size {
+			return fmt.Errorf("wrong size %d from Write", n)
+		}
+		return nil
+	}, func(st *serverTester) {
+		if err := st.fr.WriteSettings(
+			Setting{SettingInitialWindowSize, 0},
+			Setting{SettingMaxFrameSize, maxFrameSize},
+		); err != nil {
+			t.Fatal(err)
+		}
+		st.wantSettingsAck()
+
+		getSlash(st) // make the single request
+
+		// Give the handler quota to write:
+		if err := st.fr.WriteWindowUpdate(1, size); err != nil {
+			t.Fatal(err)
+		}
+		// Give the handler quota to write to connection-level
+		// window as well
+		if err := st.fr.WriteWindowUpdate(0, size); err != nil {
+			t.Fatal(err)
+		}
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("unexpected END_STREAM flag")
+		}
+		if !hf.HeadersEnded() {
+			t.Fatal("want END_HEADERS flag")
+		}
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		wanth := [][2]string{
+			{":status", "200"},
+			{"content-type", "text/plain; charset=utf-8"}, // sniffed
+			// and no content-length
+		}
+		if !reflect.DeepEqual(goth, wanth) {
+			t.Errorf("Got headers %v; want %v", goth, wanth)
+		}
+		var bytes, frames int
+		for {
+			df := st.wantData()
+			bytes += len(df.Data())
+			frames++
+			for _, b := range df.Data() {
+				if b != 'a' {
+					t.Fatal("non-'a' byte seen in DATA")
+				}
+			}
+			if df.StreamEnded() {
+				break
+			}
+		}
+		if bytes != size {
+			t.Errorf("Got %d bytes; want %d", bytes, size)
+		}
+		if want := int(size / maxFrameSize); frames < want || frames > want*2 {
+			t.Errorf("Got %d frames; want %d", frames, size)
+		}
+	})
+}
+
+// Test that DATA frames grow to, but not past, the MAX_FRAME_SIZE
+// the client advertises.
+func TestServer_Response_LargeWrite_MaxFrameSize(t *testing.T) {
+	const size = 100 << 10
+	const frameSize = 32 << 10
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		_, err := w.Write(bytes.Repeat([]byte("a"), size))
+		return err
+	}, func(st *serverTester) {
+		if err := st.fr.WriteSettings(
+			Setting{SettingInitialWindowSize, size},
+			Setting{SettingMaxFrameSize, frameSize},
+		); err != nil {
+			t.Fatal(err)
+		}
+		st.wantSettingsAck()
+		if err := st.fr.WriteWindowUpdate(0, size); err != nil {
+			t.Fatal(err)
+		}
+
+		getSlash(st)
+		st.wantHeaders()
+		var n, largest int
+		for {
+			df := st.wantData()
+			n += len(df.Data())
+			if l := len(df.Data()); l > largest {
+				largest = l
+			}
+			if df.StreamEnded() {
+				break
+			}
+		}
+		if n != size {
+			t.Errorf("got %d bytes; want %d", n, size)
+		}
+		if largest != frameSize {
+			t.Errorf("largest DATA frame = %d bytes; want %d", largest, frameSize)
+		}
+		// The framer writes up to the same limit.
+		got := make(chan uint32, 1)
+		st.sc.testHookCh <- func() { got <- st.sc.framer.maxWriteSize }
+		if v := <-got; v != frameSize {
+			t.Errorf("framer's max write frame size = %d; want %d", v, frameSize)
+		}
+	})
+}
+
+// Test that a body spanning several DATA frames is reassembled
+// byte-for-byte by the client, in order.
+func TestServer_Response_LargeWrite_Content(t *testing.T) {
+	const size = 100 << 10
+	const maxFrameSize = 16 << 10
+	body := make([]byte, size)
+	for i := range body {
+		body[i] = byte(i % 251)
+	}
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		n, err := w.Write(body)
+		if err != nil {
+			return fmt.Errorf("Write error: %v", err)
+		}
+		if n != size {
+			return fmt.Errorf("wrong size %d from Write", n)
+		}
+		return nil
+	}, func(st *serverTester) {
+		if err := st.fr.WriteSettings(Setting{SettingInitialWindowSize, size}); err != nil {
+			t.Fatal(err)
+		}
+		st.wantSettingsAck()
+		if err := st.fr.WriteWindowUpdate(0, size); err != nil {
+			t.Fatal(err)
+		}
+
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("unexpected END_STREAM flag")
+		}
+		var got []byte
+		var frames int
+		for {
+			df := st.wantData()
+			if len(df.Data()) > maxFrameSize {
+				t.Fatalf("DATA frame of %d bytes exceeds max frame size %d", len(df.Data()), maxFrameSize)
+			}
+			got = append(got, df.Data()...)
+			frames++
+			if df.StreamEnded() {
+				break
+			}
+		}
+		if frames < 2 {
+			t.Errorf("got %d DATA frames; want several", frames)
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("reassembled body (%d bytes) differs from the written body (%d bytes)", len(got), len(body))
+		}
+	})
+}
+
+// Test that the handler can't write more than the client allows
+func TestServer_Response_LargeWrite_FlowControlled(t *testing.T) {
+	const size = 1 << 20
+	const maxFrameSize = 16 << 10
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		w.(http.Flusher).Flush()
+		n, err := w.Write(bytes.Repeat([]byte("a"), size))
+		if err != nil {
+			return fmt.Errorf("Write error: %v", err)
+		}
+		if n != size {
+			return fmt.Errorf("wrong size %d from Write", n)
+		}
+		return nil
+	}, func(st *serverTester) {
+		// Set the window size to something explicit for this test.
+		// It's also how much initial data we expect.
+		const initWindowSize = 123
+		if err := st.fr.WriteSettings(
+			Setting{SettingInitialWindowSize, initWindowSize},
+			Setting{SettingMaxFrameSize, maxFrameSize},
+		); err != nil {
+			t.Fatal(err)
+		}
+		st.wantSettingsAck()
+
+		getSlash(st) // make the single request
+		defer func() { st.fr.WriteRSTStream(1, ErrCodeCancel) }()
+
+		hf := st.wantHeaders()
+		if hf.StreamEnded() {
+			t.Fatal("unexpected END_STREAM flag")
 		}
 		if !hf.HeadersEnded() {
 			t.Fatal("want END_HEADERS flag")
 		}
+
+		df := st.wantData()
+		if got := len(df.Data()); got != initWindowSize {
+			t.Fatalf("Initial window size = %d but got DATA with %d bytes", initWindowSize, got)
+		}
+
+		for _, quota := range []int{1, 13, 127} {
+			if err := st.fr.WriteWindowUpdate(1, uint32(quota)); err != nil {
+				t.Fatal(err)
+			}
+			df := st.wantData()
+			if int(quota) != len(df.Data()) {
+				t.Fatalf("read %d bytes after giving %d quota", len(df.Data()), quota)
+			}
+		}
+
+		if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+			t.Fatal(err)
+		}
 	})
 }
 
-func TestServer_Response_NoData_Header_FooBar(t *testing.T) {
+// Test that the connection-level window also bounds what the handler
+// can write, independent of a generous stream-level window.
+func TestServer_Response_LargeWrite_ConnFlowControlled(t *testing.T) {
+	const size = 1 << 20
+	const maxFrameSize = 16 << 10
 	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		w.Header().Set("Foo-Bar", "some-value")
+		w.(http.Flusher).Flush()
+		n, err := w.Write(bytes.Repeat([]byte("a"), size))
+		if err != nil {
+			return fmt.Errorf("Write error: %v", err)
+		}
+		if n != size {
+			return fmt.Errorf("wrong size %d from Write", n)
+		}
 		return nil
 	}, func(st *serverTester) {
-		getSlash(st)
-		hf := st.wantHeaders()
-		if !hf.StreamEnded() {
-			t.Fatal("want END_STREAM flag")
+		// Plenty of stream-level window; the connection-level
+		// window stays at its initial size.
+		if err := st.fr.WriteSettings(
+			Setting{SettingInitialWindowSize, size},
+			Setting{SettingMaxFrameSize, maxFrameSize},
+		); err != nil {
+			t.Fatal(err)
 		}
-		if !hf.HeadersEnded() {
-			t.Fatal("want END_HEADERS flag")
+		st.wantSettingsAck()
+
+		getSlash(st) // make the single request
+		defer func() { st.fr.WriteRSTStream(1, ErrCodeCancel) }()
+
+		st.wantHeaders()
+
+		var got int
+		for got < initialWindowSize {
+			got += len(st.wantData().Data())
 		}
-		goth := decodeHeader(t, hf.HeaderBlockFragment())
-		wanth := [][2]string{
-			{":status", "200"},
-			{"foo-bar", "some-value"},
-			{"content-type", "text/plain; charset=utf-8"},
-			{"content-length", "0"},
+		if got != initialWindowSize {
+			t.Fatalf("got %d bytes before any connection WINDOW_UPDATE; want %d", got, initialWindowSize)
 		}
-		if !reflect.DeepEqual(goth, wanth) {
-			t.Errorf("Got headers %v; want %v", goth, wanth)
+
+		for _, quota := range []int{1, 13, 127, 5000} {
+			if err := st.fr.WriteWindowUpdate(0, uint32(quota)); err != nil {
+				t.Fatal(err)
+			}
+			df := st.wantData()
+			if quota != len(df.Data()) {
+				t.Fatalf("read %d bytes after giving %d connection quota", len(df.Data()), quota)
+			}
 		}
 	})
 }
 
-func TestServer_Response_Data_Sniff_DoesntOverride(t *testing.T) {
-	const msg = "<html>this is HTML."
+// Test that the handler blocked in a Write is unblocked if the server sends a RST_STREAM.
+func TestServer_Response_RST_Unblocks_LargeWrite(t *testing.T) {
+	const size = 1 << 20
+	const maxFrameSize = 16 << 10
 	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		w.Header().Set("Content-Type", "foo/bar")
-		io.WriteString(w, msg)
-		return nil
+		w.(http.Flusher).Flush()
+		errc := make(chan error, 1)
+		go func() {
+			_, err := w.Write(bytes.Repeat([]byte("a"), size))
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			if err == nil {
+				return errors.New("unexpected nil error from Write in handler")
+			}
+			return nil
+		case <-time.After(2 * time.Second):
+			return errors.New("timeout waiting for Write in handler")
+		}
 	}, func(st *serverTester) {
-		getSlash(st)
+		if err := st.fr.WriteSettings(
+			Setting{SettingInitialWindowSize, 0},
+			Setting{SettingMaxFrameSize, maxFrameSize},
+		); err != nil {
+			t.Fatal(err)
+		}
+		st.wantSettingsAck()
+
+		getSlash(st) // make the single request
+
 		hf := st.wantHeaders()
 		if hf.StreamEnded() {
-			t.Fatal("don't want END_STREAM, expecting data")
+			t.Fatal("unexpected END_STREAM flag")
 		}
 		if !hf.HeadersEnded() {
 			t.Fatal("want END_HEADERS flag")
 		}
-		goth := decodeHeader(t, hf.HeaderBlockFragment())
-		wanth := [][2]string{
-			{":status", "200"},
-			{"content-type", "foo/bar"},
-			{"content-length", strconv.Itoa(len(msg))},
-		}
-		if !reflect.DeepEqual(goth, wanth) {
-			t.Errorf("Got headers %v; want %v", goth, wanth)
-		}
-		df := st.wantData()
-		if !df.StreamEnded() {
-			t.Error("expected DATA to have END_STREAM flag")
-		}
-		if got := string(df.Data()); got != msg {
-			t.Errorf("got DATA %q; want %q", got, msg)
+
+		if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+			t.Fatal(err)
 		}
 	})
 }
 
-func TestServer_Response_TransferEncoding_chunked(t *testing.T) {
-	const msg = "hi"
+func TestServer_Response_Empty_Data_Not_FlowControlled(t *testing.T) {
 	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		w.Header().Set("Transfer-Encoding", "chunked") // should be stripped
-		io.WriteString(w, msg)
+		w.(http.Flusher).Flush()
+		// Nothing; send empty DATA
 		return nil
 	}, func(st *serverTester) {
-		getSlash(st)
+		// Handler gets no data quota:
+		if err := st.fr.WriteSettings(Setting{SettingInitialWindowSize, 0}); err != nil {
+			t.Fatal(err)
+		}
+		st.wantSettingsAck()
+
+		getSlash(st) // make the single request
+
 		hf := st.wantHeaders()
-		goth := decodeHeader(t, hf.HeaderBlockFragment())
-		wanth := [][2]string{
-			{":status", "200"},
-			{"content-type", "text/plain; charset=utf-8"},
-			{"content-length", strconv.Itoa(len(msg))},
+		if hf.StreamEnded() {
+			t.Fatal("unexpected END_STREAM flag")
 		}
-		if !reflect.DeepEqual(goth, wanth) {
-			t.Errorf("Got headers %v; want %v", goth, wanth)
+		if !hf.HeadersEnded() {
+			t.Fatal("want END_HEADERS flag")
+		}
+
+		df := st.wantData()
+		if got := len(df.Data()); got != 0 {
+			t.Fatalf("unexpected %d DATA bytes; want 0", got)
+		}
+		if !df.StreamEnded() {
+			t.Fatal("DATA didn't have END_STREAM")
 		}
 	})
 }
 
-// Header accessed only after the initial write.
-func TestServer_Response_Data_IgnoreHeaderAfterWrite_After(t *testing.T) {
-	const msg = "<html>this is HTML."
+func TestServer_Response_Automatic100Continue(t *testing.T) {
+	const msg = "foo"
+	const reply = "bar"
 	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		io.WriteString(w, msg)
-		w.Header().Set("foo", "should be ignored")
-		return nil
+		if v := r.Header.Get("Expect"); v != "" {
+			t.Errorf("Expect header = %q; want empty", v)
+		}
+		buf := make([]byte, len(msg))
+		// This read should trigger the 100-continue being sent.
+		if n, err := io.ReadFull(r.Body, buf); err != nil || n != len(msg) || string(buf) != msg {
+			return fmt.Errorf("ReadFull = %q, %v; want %q, nil", buf[:n], err, msg)
+		}
+		_, err := io.WriteString(w, reply)
+		return err
 	}, func(st *serverTester) {
-		getSlash(st)
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1, // clients send odd numbers
+			BlockFragment: st.encodeHeader(":method", "POST", "expect", "100-continue"),
+			EndStream:     false,
+			EndHeaders:    true,
+		})
 		hf := st.wantHeaders()
 		if hf.StreamEnded() {
-			t.Fatal("unexpected END_STREAM")
+			t.Fatal("unexpected END_STREAM flag")
 		}
 		if !hf.HeadersEnded() {
 			t.Fatal("want END_HEADERS flag")
 		}
 		goth := decodeHeader(t, hf.HeaderBlockFragment())
 		wanth := [][2]string{
-			{":status", "200"},
-			{"content-type", "text/html; charset=utf-8"},
-			{"content-length", strconv.Itoa(len(msg))},
+			{":status", "100"},
 		}
 		if !reflect.DeepEqual(goth, wanth) {
-			t.Errorf("Got headers %v; want %v", goth, wanth)
+			t.Fatalf("Got headers %v; want %v", goth, wanth)
 		}
-	})
-}
 
-// Header accessed before the initial write and later mutated.
-func TestServer_Response_Data_IgnoreHeaderAfterWrite_Overwrite(t *testing.T) {
-	const msg = "<html>this is HTML."
-	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		w.Header().Set("foo", "proper value")
-		io.WriteString(w, msg)
-		w.Header().Set("foo", "should be ignored")
-		return nil
-	}, func(st *serverTester) {
-		getSlash(st)
-		hf := st.wantHeaders()
+		// Okay, they sent status 100, so we can send our
+		// gigantic and/or sensitive "foo" payload now.
+		st.writeData(1, true, []byte(msg))
+
+		st.wantWindowUpdate(0, uint32(len(msg)))
+
+		hf = st.wantHeaders()
 		if hf.StreamEnded() {
-			t.Fatal("unexpected END_STREAM")
+			t.Fatal("expected data to follow")
 		}
 		if !hf.HeadersEnded() {
 			t.Fatal("want END_HEADERS flag")
 		}
-		goth := decodeHeader(t, hf.HeaderBlockFragment())
-		wanth := [][2]string{
+		goth = decodeHeader(t, hf.HeaderBlockFragment())
+		wanth = [][2]string{
 			{":status", "200"},
-			{"foo", "proper value"},
-			{"content-type", "text/html; charset=utf-8"},
-			{"content-length", strconv.Itoa(len(msg))},
+			{"content-type", "text/plain; charset=utf-8"},
+			{"content-length", strconv.Itoa(len(reply))},
 		}
 		if !reflect.DeepEqual(goth, wanth) {
 			t.Errorf("Got headers %v; want %v", goth, wanth)
 		}
+
+		df := st.wantData()
+		if string(df.Data()) != reply {
+			t.Errorf("Client read %q; want %q", df.Data(), reply)
+		}
+		if !df.StreamEnded() {
+			t.Errorf("expect data stream end")
+		}
 	})
 }
 
-func TestServer_Response_Data_SniffLenType(t *testing.T) {
-	const msg = "<html>this is HTML."
+// A handler that responds before reading the body mustn't send a
+// 100-continue after its final response headers.
+func TestServer_Response_NoContinueAfterHeaders(t *testing.T) {
+	const msg = "foo"
 	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		io.WriteString(w, msg)
+		w.WriteHeader(http.StatusAccepted)
+		w.(http.Flusher).Flush()
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil || string(body) != msg {
+			return fmt.Errorf("ReadAll = %q, %v; want %q, nil", body, err, msg)
+		}
 		return nil
 	}, func(st *serverTester) {
-		getSlash(st)
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(":method", "POST", "expect", "100-continue"),
+			EndStream:     false,
+			EndHeaders:    true,
+		})
 		hf := st.wantHeaders()
-		if hf.StreamEnded() {
-			t.Fatal("don't want END_STREAM, expecting data")
-		}
-		if !hf.HeadersEnded() {
-			t.Fatal("want END_HEADERS flag")
-		}
 		goth := decodeHeader(t, hf.HeaderBlockFragment())
-		wanth := [][2]string{
-			{":status", "200"},
-			{"content-type", "text/html; charset=utf-8"},
-			{"content-length", strconv.Itoa(len(msg))},
-		}
-		if !reflect.DeepEqual(goth, wanth) {
-			t.Errorf("Got headers %v; want %v", goth, wanth)
+		if len(goth) == 0 || goth[0] != [2]string{":status", "202"} {
+			t.Fatalf("first headers = %v; want :status 202", goth)
 		}
+		st.writeData(1, true, []byte(msg))
+		st.wantWindowUpdate(0, uint32(len(msg)))
 		df := st.wantData()
-		if !df.StreamEnded() {
-			t.Error("expected DATA to have END_STREAM flag")
+		if !df.StreamEnded() || len(df.Data()) != 0 {
+			t.Errorf("got DATA %q, END_STREAM=%v; want empty END_STREAM", df.Data(), df.StreamEnded())
 		}
-		if got := string(df.Data()); got != msg {
-			t.Errorf("got DATA %q; want %q", got, msg)
+	})
+}
+
+// A client that sends Expect: 100-continue but ends the stream with
+// its headers isn't sent a 100-continue.
+func TestServer_Response_NoContinueWithoutBody(t *testing.T) {
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		if n, err := r.Body.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			return fmt.Errorf("Read = %d, %v; want 0, EOF", n, err)
+		}
+		_, err := io.WriteString(w, "ok")
+		return err
+	}, func(st *serverTester) {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(":method", "POST", "expect", "100-continue"),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+		hf := st.wantHeaders()
+		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		if len(goth) == 0 || goth[0] != [2]string{":status", "200"} {
+			t.Fatalf("first headers = %v; want :status 200", goth)
 		}
 	})
 }
 
-func TestServer_Response_Header_Flush_MidWrite(t *testing.T) {
-	const msg = "<html>this is HTML"
-	const msg2 = ", and this is the next chunk"
+func TestServer_Response_Informational(t *testing.T) {
 	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		io.WriteString(w, msg)
-		w.(http.Flusher).Flush()
-		io.WriteString(w, msg2)
-		return nil
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Link", "</script.js>; rel=preload; as=script")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Del("Link")
+		w.WriteHeader(http.StatusOK)
+		w.WriteHeader(http.StatusEarlyHints) // too late; ignored
+		_, err := io.WriteString(w, "ok")
+		return err
 	}, func(st *serverTester) {
 		getSlash(st)
-		hf := st.wantHeaders()
-		if hf.StreamEnded() {
-			t.Fatal("unexpected END_STREAM flag")
-		}
-		if !hf.HeadersEnded() {
-			t.Fatal("want END_HEADERS flag")
+
+		// One decoder for the whole stream, as the server's
+		// encoder may refer back to the earlier header blocks.
+		var fields [][2]string
+		dec := hpack.NewDecoder(initialHeaderTableSize, func(f hpack.HeaderField) {
+			fields = append(fields, [2]string{f.Name, f.Value})
+		})
+		decode := func(frag []byte) [][2]string {
+			fields = nil
+			if _, err := dec.Write(frag); err != nil {
+				t.Fatalf("hpack decoding error: %v", err)
+			}
+			if err := dec.Close(); err != nil {
+				t.Fatalf("hpack decoding error: %v", err)
+			}
+			return fields
+		}
+		for _, link := range []string{
+			"</style.css>; rel=preload; as=style",
+			"</script.js>; rel=preload; as=script",
+		} {
+			hf := st.wantHeaders()
+			if hf.StreamEnded() {
+				t.Fatal("unexpected END_STREAM on 103")
+			}
+			goth := decode(hf.HeaderBlockFragment())
+			wanth := [][2]string{
+				{":status", "103"},
+				{"link", link},
+			}
+			if !reflect.DeepEqual(goth, wanth) {
+				t.Fatalf("Got headers %v; want %v", goth, wanth)
+			}
 		}
-		goth := decodeHeader(t, hf.HeaderBlockFragment())
+		hf := st.wantHeaders()
+		goth := decode(hf.HeaderBlockFragment())
 		wanth := [][2]string{
 			{":status", "200"},
-			{"content-type", "text/html; charset=utf-8"}, // sniffed
-			// and no content-length
+			{"content-type", "text/plain; charset=utf-8"},
+			{"content-length", "2"},
 		}
 		if !reflect.DeepEqual(goth, wanth) {
-			t.Errorf("Got headers %v; want %v", goth, wanth)
-		}
-		{
-			df := st.wantData()
-			if df.StreamEnded() {
-				t.Error("unexpected END_STREAM flag")
-			}
-			if got := string(df.Data()); got != msg {
-				t.Errorf("got DATA %q; want %q", got, msg)
-			}
+			t.Fatalf("Got headers %v; want %v", goth, wanth)
 		}
-		{
-			df := st.wantData()
-			if !df.StreamEnded() {
-				t.Error("wanted END_STREAM flag on last data chunk")
-			}
-			if got := string(df.Data()); got != msg2 {
-				t.Errorf("got DATA %q; want %q", got, msg2)
-			}
+		df := st.wantData()
+		if string(df.Data()) != "ok" || !df.StreamEnded() {
+			t.Errorf("got DATA %q, END_STREAM=%v; want \"ok\", true", df.Data(), df.StreamEnded())
 		}
 	})
 }
 
-func TestServer_Response_LargeWrite(t *testing.T) {
-	const size = 1 << 20
-	const maxFrameSize = 16 << 10
+func TestServer_HandlerWriteErrorOnDisconnect(t *testing.T) {
+	errc := make(chan error, 1)
 	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		n, err := w.Write(bytes.Repeat([]byte("a"), size))
-		if err != nil {
-			return fmt.Errorf("Write error: %v", err)
-		}
-		if n != size {
-			return fmt.Errorf("wrong size %d from Write", n)
+		p := []byte("some data.\n")
+		for {
+			_, err := w.Write(p)
+			if err != nil {
+				errc <- err
+				return nil
+			}
 		}
-		return nil
 	}, func(st *serverTester) {
-		if err := st.fr.WriteSettings(
-			Setting{SettingInitialWindowSize, 0},
-			Setting{SettingMaxFrameSize, maxFrameSize},
-		); err != nil {
-			t.Fatal(err)
-		}
-		st.wantSettingsAck()
-
-		getSlash(st) // make the single request
-
-		// Give the handler quota to write:
-		if err := st.fr.WriteWindowUpdate(1, size); err != nil {
-			t.Fatal(err)
-		}
-		// Give the handler quota to write to connection-level
-		// window as well
-		if err := st.fr.WriteWindowUpdate(0, size); err != nil {
-			t.Fatal(err)
-		}
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      1,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     false,
+			EndHeaders:    true,
+		})
 		hf := st.wantHeaders()
 		if hf.StreamEnded() {
 			t.Fatal("unexpected END_STREAM flag")
@@ -1550,275 +4843,663 @@ func TestServer_Response_LargeWrite(t *testing.T) {
 		if !hf.HeadersEnded() {
 			t.Fatal("want END_HEADERS flag")
 		}
-		goth := decodeHeader(t, hf.HeaderBlockFragment())
-		wanth := [][2]string{
-			{":status", "200"},
-			{"content-type", "text/plain; charset=utf-8"}, // sniffed
-			// and no content-length
-		}
-		if !reflect.DeepEqual(goth, wanth) {
-			t.Errorf("Got headers %v; want %v", goth, wanth)
-		}
-		var bytes, frames int
-		for {
-			df := st.wantData()
-			bytes += len(df.Data())
-			frames++
-			for _, b := range df.Data() {
-				if b != 'a' {
-					t.Fatal("non-'a' byte seen in DATA")
-				}
-			}
-			if df.StreamEnded() {
-				break
-			}
+		// Close the connection and wait for the handler to (hopefully) notice.
+		st.cc.Close()
+		select {
+		case <-errc:
+		case <-time.After(5 * time.Second):
+			t.Error("timeout")
 		}
-		if bytes != size {
-			t.Errorf("Got %d bytes; want %d", bytes, size)
+	})
+}
+
+func TestServer_GracefulShutdown(t *testing.T) {
+	inHandler := make(chan bool)
+	release := make(chan bool)
+	var gotLateRequest int32
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/late" {
+			atomic.StoreInt32(&gotLateRequest, 1)
+			return
 		}
-		if want := int(size / maxFrameSize); frames < want || frames > want*2 {
-			t.Errorf("Got %d frames; want %d", frames, size)
+		inHandler <- true
+		<-release
+		io.WriteString(w, "done")
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+	<-inHandler
+
+	shutdownErr := make(chan error, 1)
+	go func() { shutdownErr <- st.ts.Config.Shutdown(context.Background()) }()
+
+	gf := st.wantGoAway()
+	if gf.ErrCode != ErrCodeNo {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeNo)
+	}
+	if gf.LastStreamID != 1 {
+		t.Errorf("GOAWAY last stream ID = %v; want 1", gf.LastStreamID)
+	}
+
+	// A new stream after the GOAWAY is refused.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(":path", "/late"),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	st.wantRSTStream(3, ErrCodeRefusedStream)
+
+	// But the in-flight one completes.
+	close(release)
+	hf := st.wantHeaders()
+	if hf.StreamID != 1 {
+		t.Fatalf("HEADERS on stream %d; want 1", hf.StreamID)
+	}
+	df := st.wantData()
+	if got := string(df.Data()); got != "done" || !df.StreamEnded() {
+		t.Errorf("DATA = %q, END_STREAM=%v; want \"done\" with END_STREAM", got, df.StreamEnded())
+	}
+
+	// And then the server hangs up.
+	if f, err := st.readFrame(); err == nil {
+		t.Fatalf("got frame %v after graceful shutdown; want connection close", f.Header())
+	}
+	select {
+	case err := <-shutdownErr:
+		if err != nil {
+			t.Errorf("Shutdown = %v", err)
 		}
+	case <-time.After(5 * time.Second):
+		t.Error("timeout waiting for Shutdown to return")
+	}
+	if atomic.LoadInt32(&gotLateRequest) != 0 {
+		t.Error("handler ran for stream 3, sent after the GOAWAY")
+	}
+}
+
+func TestServer_GracefulShutdown_Timeout(t *testing.T) {
+	inHandler := make(chan bool)
+	release := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		<-release
+	}, func(s *Server) {
+		s.GracefulShutdownTimeout = 50 * time.Millisecond
 	})
+	defer st.Close()
+	defer close(release)
+	st.greet()
+	st.bodylessReq1()
+	<-inHandler
+
+	go st.ts.Config.Shutdown(context.Background())
+	st.wantGoAway()
+
+	// The handler never finishes, so the connection is
+	// closed once the timeout expires.
+	select {
+	case <-st.sc.doneServing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed after GracefulShutdownTimeout")
+	}
 }
 
-// Test that the handler can't write more than the client allows
-func TestServer_Response_LargeWrite_FlowControlled(t *testing.T) {
-	const size = 1 << 20
-	const maxFrameSize = 16 << 10
-	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		w.(http.Flusher).Flush()
-		n, err := w.Write(bytes.Repeat([]byte("a"), size))
+// Test that an in-flight request's trailers, sent after a graceful
+// GOAWAY, still end its body, and that a new stream whose header
+// block spans a CONTINUATION frame is refused without disturbing
+// the in-flight one.
+func TestServer_GracefulShutdown_HeadersAfterGoAway(t *testing.T) {
+	inHandler := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- true
+		body, err := ioutil.ReadAll(r.Body)
 		if err != nil {
-			return fmt.Errorf("Write error: %v", err)
+			t.Errorf("reading body: %v", err)
 		}
-		if n != size {
-			return fmt.Errorf("wrong size %d from Write", n)
-		}
-		return nil
-	}, func(st *serverTester) {
-		// Set the window size to something explicit for this test.
-		// It's also how much initial data we expect.
-		const initWindowSize = 123
-		if err := st.fr.WriteSettings(
-			Setting{SettingInitialWindowSize, initWindowSize},
-			Setting{SettingMaxFrameSize, maxFrameSize},
-		); err != nil {
-			t.Fatal(err)
+		if got := r.Trailer.Get("Client-Trailer"); got != "x" {
+			t.Errorf("trailer = %q; want x", got)
 		}
-		st.wantSettingsAck()
+		w.Write(body)
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST", "trailer", "Client-Trailer"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	<-inHandler
 
-		getSlash(st) // make the single request
-		defer func() { st.fr.WriteRSTStream(1, ErrCodeCancel) }()
+	go st.ts.Config.Shutdown(context.Background())
+	if gf := st.wantGoAway(); gf.LastStreamID != 1 {
+		t.Errorf("GOAWAY last stream ID = %v; want 1", gf.LastStreamID)
+	}
 
-		hf := st.wantHeaders()
-		if hf.StreamEnded() {
-			t.Fatal("unexpected END_STREAM flag")
+	block := st.encodeHeader(":path", "/late")
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: block[:1],
+		EndStream:     true,
+		EndHeaders:    false,
+	})
+	if err := st.fr.WriteContinuation(3, true, block[1:]); err != nil {
+		t.Fatal(err)
+	}
+	st.wantRSTStream(3, ErrCodeRefusedStream)
+
+	st.writeData(1, false, []byte("hi"))
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeTrailer("client-trailer", "x"),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
 		}
-		if !hf.HeadersEnded() {
-			t.Fatal("want END_HEADERS flag")
+		if _, ok := f.(*WindowUpdateFrame); ok {
+			continue // for the body read
+		}
+		if hf, ok := f.(*HeadersFrame); !ok || hf.StreamID != 1 {
+			t.Fatalf("got %v; want HEADERS on stream 1", f.Header())
 		}
+		break
+	}
+	df := st.wantData()
+	if got := string(df.Data()); got != "hi" || !df.StreamEnded() {
+		t.Errorf("DATA = %q, END_STREAM=%v; want \"hi\" with END_STREAM", got, df.StreamEnded())
+	}
+}
 
-		df := st.wantData()
-		if got := len(df.Data()); got != initWindowSize {
-			t.Fatalf("Initial window size = %d but got DATA with %d bytes", initWindowSize, got)
+func TestServer_GracefulShutdown_LateConn(t *testing.T) {
+	srv := new(Server)
+	srv.startGracefulShutdown()
+	sc := &serverConn{shutdownCh: make(chan struct{})}
+	srv.registerConn(sc)
+	select {
+	case <-sc.shutdownCh:
+	default:
+		t.Error("connection registered after shutdown began wasn't told to shut down")
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	st := newServerTester(t, nil, func(s *Server) {
+		s.IdleTimeout = 50 * time.Millisecond
+	})
+	defer st.Close()
+	st.greet()
+
+	ga := st.wantGoAway()
+	if ga.ErrCode != ErrCodeNo {
+		t.Errorf("GOAWAY code = %v; want NO_ERROR", ga.ErrCode)
+	}
+	select {
+	case <-st.sc.doneServing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle connection not closed")
+	}
+}
+
+// Test that a connection with a stream open outlives the IdleTimeout,
+// and only goes idle once the stream is done.
+func TestServer_IdleTimeout_ActiveStream(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(4 * timeout)
+	}, func(s *Server) {
+		s.IdleTimeout = timeout
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+
+	hf := st.wantHeaders()
+	if !hf.StreamEnded() {
+		t.Fatal("response didn't end the stream")
+	}
+	st.wantGoAway()
+}
+
+// Test that a SETTINGS ACK carrying a payload is a FRAME_SIZE_ERROR.
+func TestServer_SettingsAck_NonEmpty(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.writePreface()
+	st.writeInitialSettings()
+	st.wantSettings()
+	if err := st.fr.WriteRawFrame(FrameSettings, FlagSettingsAck, 0, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatalf("Error while expecting a GOAWAY frame: %v", err)
 		}
-
-		for _, quota := range []int{1, 13, 127} {
-			if err := st.fr.WriteWindowUpdate(1, uint32(quota)); err != nil {
-				t.Fatal(err)
-			}
-			df := st.wantData()
-			if int(quota) != len(df.Data()) {
-				t.Fatalf("read %d bytes after giving %d quota", len(df.Data()), quota)
+		if ga, ok := f.(*GoAwayFrame); ok {
+			if ga.ErrCode != ErrCodeFrameSize {
+				t.Errorf("GOAWAY code = %v; want FRAME_SIZE_ERROR", ga.ErrCode)
 			}
+			return
 		}
+	}
+}
 
-		if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
-			t.Fatal(err)
-		}
+// Test that an empty SETTINGS ACK is accepted and stops the ACK timer.
+func TestServer_SettingsAck_Empty(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, func(s *Server) {
+		s.SettingsAckTimeout = timeout
 	})
+	defer st.Close()
+	st.greet()
+	time.Sleep(2 * timeout)
+	st.bodylessReq1()
+	hf := st.wantHeaders()
+	if !hf.StreamEnded() {
+		t.Error("response HEADERS didn't end the stream")
+	}
 }
 
-// Test that the handler blocked in a Write is unblocked if the server sends a RST_STREAM.
-func TestServer_Response_RST_Unblocks_LargeWrite(t *testing.T) {
-	const size = 1 << 20
-	const maxFrameSize = 16 << 10
-	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		w.(http.Flusher).Flush()
-		errc := make(chan error, 1)
-		go func() {
-			_, err := w.Write(bytes.Repeat([]byte("a"), size))
-			errc <- err
-		}()
-		select {
-		case err := <-errc:
-			if err == nil {
-				return errors.New("unexpected nil error from Write in handler")
-			}
-			return nil
-		case <-time.After(2 * time.Second):
-			return errors.New("timeout waiting for Write in handler")
-		}
-	}, func(st *serverTester) {
-		if err := st.fr.WriteSettings(
-			Setting{SettingInitialWindowSize, 0},
-			Setting{SettingMaxFrameSize, maxFrameSize},
-		); err != nil {
-			t.Fatal(err)
-		}
-		st.wantSettingsAck()
+// Test that a client that never ACKs the server's SETTINGS gets a
+// SETTINGS_TIMEOUT GOAWAY.
+func TestServer_SettingsAck_Timeout(t *testing.T) {
+	st := newServerTester(t, nil, func(s *Server) {
+		s.SettingsAckTimeout = 50 * time.Millisecond
+	})
+	defer st.Close()
+	st.writePreface()
+	st.writeInitialSettings()
+	st.wantSettings()
+	st.wantSettingsAck()
 
-		getSlash(st) // make the single request
+	ga := st.wantGoAway()
+	if ga.ErrCode != ErrCodeSettingsTimeout {
+		t.Errorf("GOAWAY code = %v; want SETTINGS_TIMEOUT", ga.ErrCode)
+	}
+	if got := string(ga.DebugData()); !strings.Contains(got, "SETTINGS ACK") {
+		t.Errorf("GOAWAY debug data = %q; want a SETTINGS ACK timeout", got)
+	}
+}
 
-		hf := st.wantHeaders()
-		if hf.StreamEnded() {
-			t.Fatal("unexpected END_STREAM flag")
-		}
-		if !hf.HeadersEnded() {
-			t.Fatal("want END_HEADERS flag")
-		}
+func TestServer_HealthCheckPing_Timeout(t *testing.T) {
+	closed := make(chan error, 1)
+	st := newServerTester(t, nil, func(s *Server) {
+		s.ReadIdleTimeout = 100 * time.Millisecond
+		s.PingTimeout = 50 * time.Millisecond
+		s.OnConnClose = func(_ ConnInfo, err error) { closed <- err }
+	})
+	defer st.Close()
+	st.greet()
 
-		if err := st.fr.WriteRSTStream(1, ErrCodeCancel); err != nil {
+	pf := st.wantPing()
+	if pf.Flags.Has(FlagPingAck) {
+		t.Fatal("server sent a PING ACK; want a PING")
+	}
+	// Never ACK it.
+	if _, err := st.readFrame(); err != io.EOF {
+		t.Errorf("readFrame = %v; want io.EOF", err)
+	}
+	if err := <-closed; err == nil || !strings.Contains(err.Error(), "PING ACK") {
+		t.Errorf("connection closed with %v; want a PING ACK timeout", err)
+	}
+}
+
+func TestServer_HealthCheckPing_Acked(t *testing.T) {
+	const pingTimeout = 100 * time.Millisecond
+	st := newServerTester(t, nil, func(s *Server) {
+		s.ReadIdleTimeout = 30 * time.Millisecond
+		s.PingTimeout = pingTimeout
+	})
+	defer st.Close()
+	st.greet()
+
+	// Each PING comes once the client's gone quiet for
+	// ReadIdleTimeout, and ACKing it keeps the connection open
+	// well past PingTimeout.
+	start := time.Now()
+	for time.Since(start) < 3*pingTimeout {
+		pf := st.wantPing()
+		if pf.Flags.Has(FlagPingAck) {
+			t.Fatal("server sent a PING ACK; want a PING")
+		}
+		if err := st.fr.WritePing(true, pf.Data); err != nil {
 			t.Fatal(err)
 		}
+	}
+	// A mismatched ACK doesn't count.
+	pf := st.wantPing()
+	pf.Data[0]++
+	if err := st.fr.WritePing(true, pf.Data); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.readFrame(); err != io.EOF {
+		t.Errorf("readFrame after a bad ACK = %v; want io.EOF", err)
+	}
+}
+
+func TestServer_Rejects_BadPreface(t *testing.T) {
+	logger := new(captureLogger)
+	st := newServerTester(t, nil, func(s *Server) {
+		s.Logger = logger
 	})
+	defer st.Close()
+	// The right length, but HTTP/1.1.
+	if _, err := io.WriteString(st.cc, "GET / HTTP/1.1\r\nHost: x\r\n\r\n"[:len(ClientPreface)]); err != nil {
+		t.Fatal(err)
+	}
+	st.wantSettings()
+	gf := st.wantGoAway()
+	if gf.ErrCode != ErrCodeProtocol {
+		t.Errorf("GOAWAY err = %v; want %v", gf.ErrCode, ErrCodeProtocol)
+	}
+	if _, err := st.readFrame(); err != io.EOF {
+		t.Errorf("readFrame after GOAWAY = %v; want io.EOF", err)
+	}
+	if !logger.has("error: ", "bogus greeting") {
+		t.Errorf("bad preface not logged; got %q", logger.messages())
+	}
 }
 
-func TestServer_Response_Empty_Data_Not_FlowControlled(t *testing.T) {
-	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		w.(http.Flusher).Flush()
-		// Nothing; send empty DATA
-		return nil
-	}, func(st *serverTester) {
-		// Handler gets no data quota:
-		if err := st.fr.WriteSettings(Setting{SettingInitialWindowSize, 0}); err != nil {
+// The client's first frame after the preface must be SETTINGS.
+func TestServer_Rejects_FirstFrameNotSettings(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(*Framer) error
+	}{
+		{"ping", func(fr *Framer) error { return fr.WritePing(false, [8]byte{}) }},
+		// One the Framer itself reports as a stream error.
+		{"zero_window_update", func(fr *Framer) error {
+			return fr.WriteRawFrame(FrameWindowUpdate, 0, 1, []byte{0, 0, 0, 0})
+		}},
+	}
+	for _, tt := range tests {
+		st := newServerTester(t, nil)
+		st.writePreface()
+		if err := tt.write(st.fr); err != nil {
 			t.Fatal(err)
 		}
-		st.wantSettingsAck()
-
-		getSlash(st) // make the single request
-
-		hf := st.wantHeaders()
-		if hf.StreamEnded() {
-			t.Fatal("unexpected END_STREAM flag")
+		st.wantSettings()
+		gf := st.wantGoAway()
+		if gf.ErrCode != ErrCodeProtocol {
+			t.Errorf("%s: GOAWAY err = %v; want %v", tt.name, gf.ErrCode, ErrCodeProtocol)
 		}
-		if !hf.HeadersEnded() {
-			t.Fatal("want END_HEADERS flag")
+		if _, err := st.readFrame(); err != io.EOF {
+			t.Errorf("%s: readFrame after GOAWAY = %v; want io.EOF", tt.name, err)
 		}
+		st.Close()
+	}
+}
 
-		df := st.wantData()
-		if got := len(df.Data()); got != 0 {
-			t.Fatalf("unexpected %d DATA bytes; want 0", got)
-		}
-		if !df.StreamEnded() {
-			t.Fatal("DATA didn't have END_STREAM")
-		}
+// Test that a SETTINGS frame whose length isn't a multiple of 6 is a
+// FRAME_SIZE_ERROR that closes the connection.
+func TestServer_Settings_BadLength(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.greet()
+	if err := st.fr.WriteRawFrame(FrameSettings, 0, 0, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if ga := st.wantGoAway(); ga.ErrCode != ErrCodeFrameSize {
+		t.Errorf("GOAWAY code = %v; want FRAME_SIZE_ERROR", ga.ErrCode)
+	}
+	if _, err := st.fr.ReadFrame(); err != io.EOF {
+		t.Errorf("ReadFrame = %v; want io.EOF", err)
+	}
+}
+
+// Test that the header list limit derived from MaxHeaderBytes is
+// advertised, and that a request exceeding it is refused.
+func TestServer_MaxHeaderListSize(t *testing.T) {
+	const maxHeaderBytes = 1 << 10
+	var handlerCalls int32
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&handlerCalls, 1)
+	}, func(ts *httptest.Server) {
+		ts.Config.MaxHeaderBytes = maxHeaderBytes
+	})
+	defer st.Close()
+	st.addLogFilter("exceeds")
+
+	st.writePreface()
+	st.writeInitialSettings()
+	sf := st.wantSettings()
+	limit, ok := sf.Value(SettingMaxHeaderListSize)
+	if !ok || limit < maxHeaderBytes {
+		t.Fatalf("advertised SETTINGS_MAX_HEADER_LIST_SIZE = %v, %v; want at least %v", limit, ok, maxHeaderBytes)
+	}
+	st.writeSettingsAck()
+	st.wantSettingsAck()
+
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader("x-big", strings.Repeat("a", int(limit))),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	st.wantRSTStream(1, ErrCodeProtocol)
+
+	// A normal request still works afterwards.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
 	})
+	if hf := st.wantHeaders(); hf.StreamID != 3 {
+		t.Fatalf("HEADERS on stream %d; want 3", hf.StreamID)
+	}
+	if n := atomic.LoadInt32(&handlerCalls); n != 1 {
+		t.Errorf("handler called %d times; want 1", n)
+	}
 }
 
-func TestServer_Response_Automatic100Continue(t *testing.T) {
-	const msg = "foo"
-	const reply = "bar"
-	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		if v := r.Header.Get("Expect"); v != "" {
-			t.Errorf("Expect header = %q; want empty", v)
-		}
-		buf := make([]byte, len(msg))
-		// This read should trigger the 100-continue being sent.
-		if n, err := io.ReadFull(r.Body, buf); err != nil || n != len(msg) || string(buf) != msg {
-			return fmt.Errorf("ReadFull = %q, %v; want %q, nil", buf[:n], err, msg)
-		}
-		_, err := io.WriteString(w, reply)
-		return err
-	}, func(st *serverTester) {
-		st.writeHeaders(HeadersFrameParam{
-			StreamID:      1, // clients send odd numbers
-			BlockFragment: st.encodeHeader(":method", "POST", "expect", "100-continue"),
-			EndStream:     false,
-			EndHeaders:    true,
-		})
-		hf := st.wantHeaders()
-		if hf.StreamEnded() {
-			t.Fatal("unexpected END_STREAM flag")
-		}
-		if !hf.HeadersEnded() {
-			t.Fatal("want END_HEADERS flag")
-		}
-		goth := decodeHeader(t, hf.HeaderBlockFragment())
-		wanth := [][2]string{
-			{":status", "100"},
-		}
-		if !reflect.DeepEqual(goth, wanth) {
-			t.Fatalf("Got headers %v; want %v", goth, wanth)
-		}
+// Test that a header block the HPACK decoder can't make sense of is a
+// connection error, as the decoder's state can't be trusted after it.
+func TestServer_Rejects_CorruptHeaderBlock(t *testing.T) {
+	tests := []struct {
+		name  string
+		block []byte
+	}{
+		{"index zero", []byte{0x80}},
+		{"index past the tables", []byte{0xff, 0x7f}},
+		{"truncated literal", []byte{0x40, 0x05, 'x'}},
+	}
+	for _, tt := range tests {
+		func() {
+			st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+				t.Errorf("%s: handler called", tt.name)
+			})
+			defer st.Close()
+			st.addLogFilter("error decoding header block")
+			st.greet()
+			st.writeHeaders(HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: tt.block,
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+			if gf := st.wantGoAway(); gf.ErrCode != ErrCodeCompression {
+				t.Errorf("%s: GOAWAY code = %v; want COMPRESSION_ERROR", tt.name, gf.ErrCode)
+			}
+		}()
+	}
+}
 
-		// Okay, they sent status 100, so we can send our
-		// gigantic and/or sensitive "foo" payload now.
-		st.writeData(1, true, []byte(msg))
+// Test that once the client has acknowledged our smaller
+// SETTINGS_HEADER_TABLE_SIZE, a dynamic table size update above it
+// is a COMPRESSION_ERROR, while one within it is fine.
+func TestServer_Rejects_DynamicTableSizeUpdate_AboveAdvertised(t *testing.T) {
+	tests := []struct {
+		update []byte // dynamic table size update, RFC 7541 6.3
+		ok     bool
+	}{
+		{[]byte{0x3f, 0xe1, 0x07}, true},  // 1024
+		{[]byte{0x3f, 0xe1, 0x0f}, false}, // 2048
+	}
+	for _, tt := range tests {
+		func() {
+			st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {}, func(s *Server) {
+				s.MaxDecoderHeaderTableSize = 1024
+			})
+			defer st.Close()
+			st.addLogFilter("error decoding header block")
+			st.writePreface()
+			st.writeInitialSettings()
+			sf := st.wantSettings()
+			if v, ok := sf.Value(SettingHeaderTableSize); !ok || v != 1024 {
+				t.Fatalf("SETTINGS_HEADER_TABLE_SIZE = %v, %v; want 1024, true", v, ok)
+			}
+			st.writeSettingsAck()
+			st.wantSettingsAck()
 
-		st.wantWindowUpdate(0, uint32(len(msg)))
+			st.writeHeaders(HeadersFrameParam{
+				StreamID:      1,
+				BlockFragment: append(tt.update, st.encodeHeader()...),
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+			if !tt.ok {
+				if gf := st.wantGoAway(); gf.ErrCode != ErrCodeCompression {
+					t.Errorf("update % x: GOAWAY code = %v; want COMPRESSION_ERROR", tt.update, gf.ErrCode)
+				}
+				return
+			}
+			hf := st.wantHeaders()
+			if goth := decodeHeader(t, hf.HeaderBlockFragment()); goth[0] != [2]string{":status", "200"} {
+				t.Errorf("update % x: got headers %v; want :status 200", tt.update, goth)
+			}
+		}()
+	}
+}
 
-		hf = st.wantHeaders()
-		if hf.StreamEnded() {
-			t.Fatal("expected data to follow")
-		}
-		if !hf.HeadersEnded() {
-			t.Fatal("want END_HEADERS flag")
-		}
-		goth = decodeHeader(t, hf.HeaderBlockFragment())
-		wanth = [][2]string{
-			{":status", "200"},
-			{"content-type", "text/plain; charset=utf-8"},
-			{"content-length", strconv.Itoa(len(reply))},
-		}
-		if !reflect.DeepEqual(goth, wanth) {
-			t.Errorf("Got headers %v; want %v", goth, wanth)
+// Test that a header block that never ends is cut off after
+// maxHeaderContinuations CONTINUATION frames.
+func TestServer_Rejects_Continuation_Flood(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.addLogFilter("too many CONTINUATION frames")
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    false,
+	})
+	for i := 0; i <= maxHeaderContinuations; i++ {
+		if err := st.fr.WriteContinuation(1, false, nil); err != nil {
+			break // the server may already have hung up
 		}
+	}
+	if gf := st.wantGoAway(); gf.ErrCode != ErrCodeEnhanceYourCalm {
+		t.Errorf("GOAWAY code = %v; want ENHANCE_YOUR_CALM", gf.ErrCode)
+	}
+}
 
-		df := st.wantData()
-		if string(df.Data()) != reply {
-			t.Errorf("Client read %q; want %q", df.Data(), reply)
-		}
-		if !df.StreamEnded() {
-			t.Errorf("expect data stream end")
-		}
+// Test that a header block whose encoded size grows far past the
+// header list limit is cut off, rather than buffered until it ends.
+func TestServer_Rejects_HeaderBlock_TooLarge(t *testing.T) {
+	const maxHeaderBytes = 1 << 10
+	st := newServerTester(t, nil, func(ts *httptest.Server) {
+		ts.Config.MaxHeaderBytes = maxHeaderBytes
 	})
+	defer st.Close()
+	st.addLogFilter("header block from")
+	st.greet()
+
+	block := st.encodeHeader("x-big", strings.Repeat("a", 16*maxHeaderBytes))
+	const chunk = 1 << 10
+	err := st.fr.WriteHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: block[:chunk],
+		EndStream:     true,
+		EndHeaders:    false,
+	})
+	for remain := block[chunk:]; err == nil && len(remain) > 0; {
+		n := chunk
+		if n > len(remain) {
+			n = len(remain)
+		}
+		err = st.fr.WriteContinuation(1, n == len(remain), remain[:n])
+		remain = remain[n:]
+	}
+	if gf := st.wantGoAway(); gf.ErrCode != ErrCodeEnhanceYourCalm {
+		t.Errorf("GOAWAY code = %v; want ENHANCE_YOUR_CALM", gf.ErrCode)
+	}
 }
 
-func TestServer_HandlerWriteErrorOnDisconnect(t *testing.T) {
-	errc := make(chan error, 1)
-	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
-		p := []byte("some data.\n")
-		for {
-			_, err := w.Write(p)
-			if err != nil {
-				errc <- err
-				return nil
-			}
-		}
-	}, func(st *serverTester) {
+// Test that a configured MaxConcurrentStreams is advertised, that a
+// stream beyond it is refused, and that closed streams free up room.
+func TestServer_MaxConcurrentStreams_Refused(t *testing.T) {
+	const maxStreams = 2
+	inHandler := make(chan uint32)
+	leaveHandler := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		inHandler <- w.(*responseWriter).rws.stream.id
+		<-leaveHandler
+	}, func(s *Server) {
+		s.MaxConcurrentStreams = maxStreams
+	})
+	defer st.Close()
+
+	st.writePreface()
+	st.writeInitialSettings()
+	sf := st.wantSettings()
+	if v, ok := sf.Value(SettingMaxConcurrentStreams); !ok || v != maxStreams {
+		t.Errorf("advertised SETTINGS_MAX_CONCURRENT_STREAMS = %v, %v; want %v", v, ok, maxStreams)
+	}
+	st.wantSettingsAck()
+	// Deliberately don't ACK the server's SETTINGS yet: a client
+	// exceeding a limit it may not have seen yet is refused, not
+	// treated as a protocol violation.
+
+	for _, id := range []uint32{1, 3} {
 		st.writeHeaders(HeadersFrameParam{
-			StreamID:      1,
+			StreamID:      id,
 			BlockFragment: st.encodeHeader(),
-			EndStream:     false,
+			EndStream:     true,
 			EndHeaders:    true,
 		})
-		hf := st.wantHeaders()
-		if hf.StreamEnded() {
-			t.Fatal("unexpected END_STREAM flag")
-		}
-		if !hf.HeadersEnded() {
-			t.Fatal("want END_HEADERS flag")
-		}
-		// Close the connection and wait for the handler to (hopefully) notice.
-		st.cc.Close()
-		select {
-		case <-errc:
-		case <-time.After(5 * time.Second):
-			t.Error("timeout")
-		}
+		<-inHandler
+	}
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      5,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	st.wantRSTStream(5, ErrCodeRefusedStream)
+
+	// Finishing a stream makes room for another.
+	leaveHandler <- true
+	st.wantHeaders()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      7,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
 	})
+	if id := <-inHandler; id != 7 {
+		t.Errorf("handler got stream %d; want 7", id)
+	}
+	leaveHandler <- true
+	leaveHandler <- true
+}
+
+func TestServer_MaxConcurrentStreams_Default(t *testing.T) {
+	st := newServerTester(t, nil)
+	defer st.Close()
+	st.writePreface()
+	st.writeInitialSettings()
+	sf := st.wantSettings()
+	if v, ok := sf.Value(SettingMaxConcurrentStreams); !ok || v != defaultMaxStreams {
+		t.Errorf("advertised SETTINGS_MAX_CONCURRENT_STREAMS = %v, %v; want %v", v, ok, defaultMaxStreams)
+	}
 }
 
 func TestServer_Rejects_Too_Many_Streams(t *testing.T) {
@@ -1921,6 +5602,305 @@ func TestServer_Response_ManyHeaders_With_Continuation(t *testing.T) {
 	})
 }
 
+// Test that a header block just over the 16KB minimum frame size is
+// split into HEADERS+CONTINUATION and reassembles to the same headers.
+func TestServer_Response_LargeHeaders_Reassembled(t *testing.T) {
+	const n = 40
+	value := strings.Repeat("v", 500)
+	testServerResponse(t, func(w http.ResponseWriter, r *http.Request) error {
+		h := w.Header()
+		for i := 0; i < n; i++ {
+			h.Add("Set-Cookie", fmt.Sprintf("c%02d=%s", i, value))
+		}
+		return nil
+	}, func(st *serverTester) {
+		getSlash(st)
+		hf := st.wantHeaders()
+		if hf.HeadersEnded() {
+			t.Fatal("got unwanted END_HEADERS flag")
+		}
+		if !hf.StreamEnded() {
+			t.Fatal("want END_STREAM flag on the HEADERS frame")
+		}
+		block := append([]byte(nil), hf.HeaderBlockFragment()...)
+		for {
+			cf := st.wantContinuation()
+			if len(cf.HeaderBlockFragment()) > initialMaxFrameSize {
+				t.Errorf("CONTINUATION fragment of %d bytes", len(cf.HeaderBlockFragment()))
+			}
+			block = append(block, cf.HeaderBlockFragment()...)
+			if cf.HeadersEnded() {
+				break
+			}
+		}
+		var cookies []string
+		for _, kv := range decodeHeader(t, block) {
+			if kv[0] == "set-cookie" {
+				cookies = append(cookies, kv[1])
+			}
+		}
+		if len(cookies) != n {
+			t.Fatalf("got %d set-cookie headers; want %d", len(cookies), n)
+		}
+		for i, c := range cookies {
+			if want := fmt.Sprintf("c%02d=%s", i, value); c != want {
+				t.Errorf("set-cookie %d = %.10q...; want %.10q...", i, c, want)
+			}
+		}
+	})
+}
+
+func TestServer_Response_DisableHuffman(t *testing.T) {
+	value := strings.Repeat("0123456789", 10)
+	var sizes [2]int
+	for i, disable := range []bool{true, false} {
+		func() {
+			st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Id", value)
+			}, func(s *Server) {
+				s.DisableHuffman = disable
+			})
+			defer st.Close()
+			st.greet()
+			getSlash(st)
+			hf := st.wantHeaders()
+			sizes[i] = len(hf.HeaderBlockFragment())
+			goth := decodeHeader(t, hf.HeaderBlockFragment())
+			if !reflect.DeepEqual(goth[1], [2]string{"x-id", value}) {
+				t.Errorf("DisableHuffman=%v: got headers %v; want x-id %q", disable, goth, value)
+			}
+			if got := bytes.Contains(hf.HeaderBlockFragment(), []byte(value)); got != disable {
+				t.Errorf("DisableHuffman=%v: value appears verbatim = %v", disable, got)
+			}
+		}()
+	}
+	if sizes[1] >= sizes[0] {
+		t.Errorf("header block with Huffman is %d bytes; want less than the %d without", sizes[1], sizes[0])
+	}
+}
+
+func TestServer_Response_HeaderTableSize(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Foo", "bar")
+	})
+	defer st.Close()
+	st.writePreface()
+	if err := st.fr.WriteSettings(Setting{SettingHeaderTableSize, 0}); err != nil {
+		t.Fatal(err)
+	}
+	st.wantSettings()
+	st.writeSettingsAck()
+	st.wantSettingsAck()
+
+	var blocks [][]byte
+	for _, id := range []uint32{1, 3} {
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      id,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+		hf := st.wantHeaders()
+		blocks = append(blocks, append([]byte(nil), hf.HeaderBlockFragment()...))
+	}
+
+	// The first block opens with a dynamic table size update
+	// to zero. Nothing gets indexed, so the second one is the
+	// same, less that update.
+	if len(blocks[0]) == 0 || blocks[0][0] != 0x20 {
+		t.Fatalf("first header block = %x; want leading table size update 0x20", blocks[0])
+	}
+	if !bytes.Equal(blocks[0][1:], blocks[1]) {
+		t.Errorf("second header block = %x; want %x", blocks[1], blocks[0][1:])
+	}
+}
+
+func TestServer_Handler_Panic_ResetsStream(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			io.WriteString(w, "partial")
+			panic("boom")
+		}
+		io.WriteString(w, "ok")
+	})
+	defer st.Close()
+	st.addLogFilter("panic serving")
+	st.greet()
+
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":path", "/panic"),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	st.wantRSTStream(1, ErrCodeInternal)
+
+	// The connection is still usable.
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      3,
+		BlockFragment: st.encodeHeader(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	hf := st.wantHeaders()
+	if hf.StreamID != 3 {
+		t.Fatalf("HEADERS on stream %d; want 3", hf.StreamID)
+	}
+	df := st.wantData()
+	if got := string(df.Data()); got != "ok" || !df.StreamEnded() {
+		t.Errorf("DATA = %q, END_STREAM=%v; want \"ok\" with END_STREAM", got, df.StreamEnded())
+	}
+	if got := st.streamState(1); got != stateClosed {
+		t.Errorf("stream 1 state = %v; want closed", got)
+	}
+}
+
+// Streams are forgotten once both sides have ended them, however
+// the request went, so sc.streams doesn't grow with each request.
+func TestServer_Streams_NoLeak(t *testing.T) {
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/read" {
+			io.Copy(ioutil.Discard, r.Body)
+		}
+		io.WriteString(w, "ok")
+	}, func(s *Server) {
+		s.NewWriteScheduler = NewPriorityWriteScheduler
+	})
+	defer st.Close()
+	st.greet()
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		id := 1 + uint32(i)*2
+		switch i % 3 {
+		case 0: // a GET
+			st.writeHeaders(HeadersFrameParam{
+				StreamID:      id,
+				BlockFragment: st.encodeHeader(),
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+		case 1: // a POST whose body is read
+			st.writeHeaders(HeadersFrameParam{
+				StreamID:      id,
+				BlockFragment: st.encodeHeader(":method", "POST", ":path", "/read"),
+				EndStream:     false,
+				EndHeaders:    true,
+			})
+			st.writeData(id, true, []byte("body"))
+		case 2: // a POST the handler answers before it ends
+			st.writeHeaders(HeadersFrameParam{
+				StreamID:      id,
+				BlockFragment: st.encodeHeader(":method", "POST"),
+				EndStream:     false,
+				EndHeaders:    true,
+			})
+		}
+		for ended := false; !ended; {
+			f, err := st.readFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			switch f := f.(type) {
+			case *DataFrame:
+				ended = f.StreamEnded()
+			case *HeadersFrame, *WindowUpdateFrame:
+			default:
+				t.Fatalf("request %d: unexpected frame %v", i, f.Header())
+			}
+		}
+		if i%3 == 2 {
+			st.wantRSTStream(id, ErrCodeCancel)
+		}
+	}
+	st.checkAlive()
+
+	type counts struct {
+		streams int
+		open    uint32
+		queued  bool
+		passes  int // priorityWriteScheduler's per-stream state
+	}
+	ch := make(chan counts, 1)
+	st.sc.testHookCh <- func() {
+		ws := st.sc.writeSched.(*priorityWriteScheduler)
+		ch <- counts{len(st.sc.streams), st.sc.curOpenStreams, !ws.empty(), len(ws.pass)}
+	}
+	if got := <-ch; got != (counts{}) {
+		t.Errorf("after %d requests: %+v; want all zero", n, got)
+	}
+}
+
+// A handler that returns without reading an upload still in
+// progress gets the client told to stop, and the connection's flow
+// control window back for the body it never read.
+func TestServer_Handler_ReturnsEarly_ResetsUpload(t *testing.T) {
+	release := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false, // a large upload follows
+		EndHeaders:    true,
+	})
+	chunk := make([]byte, 16<<10)
+	st.writeData(1, false, chunk)
+	st.writeData(1, false, chunk)
+	st.checkAlive() // once answered, the DATA is buffered
+	close(release)
+
+	if hf := st.wantHeaders(); !hf.StreamEnded() {
+		t.Fatalf("HEADERS without END_STREAM: %v", hf)
+	}
+	st.wantRSTStream(1, ErrCodeCancel)
+	st.wantWindowUpdate(0, uint32(2*len(chunk)))
+	st.checkAlive()
+}
+
+// Likewise for a handler that closes the body instead of reading it.
+func TestServer_Handler_BodyClose_ReturnsConnFlow(t *testing.T) {
+	closed := make(chan bool)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		<-closed
+		r.Body.Close()
+		<-closed
+	})
+	defer st.Close()
+	defer close(closed)
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+	st.writeData(1, false, make([]byte, 1000))
+	st.checkAlive()
+	closed <- true
+
+	for {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wu, ok := f.(*WindowUpdateFrame)
+		if !ok {
+			t.Fatalf("got %v; want WINDOW_UPDATE", f.Header())
+		}
+		if wu.StreamID == 0 {
+			if wu.Increment != 1000 {
+				t.Errorf("conn WINDOW_UPDATE of %d; want 1000", wu.Increment)
+			}
+			return
+		}
+	}
+}
+
 // This previously crashed (reported by Mathieu Lonjaret as observed
 // while using Camlistore) because we got a DATA frame from the client
 // after the handler exited and our logic at the time was wrong,
@@ -1955,6 +5935,10 @@ func TestServer_NoCrash_HandlerClose_Then_ClientClose(t *testing.T) {
 		// it did before.
 		st.writeData(1, true, []byte("foo"))
 
+		// The connection-level window for the discarded DATA
+		// is given back.
+		st.wantWindowUpdate(0, 3)
+
 		// Sent after a peer sends data anyway (admittedly the
 		// previous RST_STREAM might've still been in-flight),
 		// but they'll get the more friendly 'cancel' code
@@ -1977,21 +5961,101 @@ func TestServer_NoCrash_HandlerClose_Then_ClientClose(t *testing.T) {
 		}
 		testHookOnPanicMu.Unlock()
 
-		// Now force the serve loop to end, via closing the connection.
-		st.cc.Close()
-		select {
-		case <-st.sc.doneServing:
-			// Loop has exited.
-			panMu.Lock()
-			got := panicVal
-			panMu.Unlock()
-			if got != nil {
-				t.Errorf("Got panic: %v", got)
-			}
-		case <-time.After(5 * time.Second):
-			t.Error("timeout")
+		// Now force the serve loop to end, via closing the connection.
+		st.cc.Close()
+		select {
+		case <-st.sc.doneServing:
+			// Loop has exited.
+			panMu.Lock()
+			got := panicVal
+			panMu.Unlock()
+			if got != nil {
+				t.Errorf("Got panic: %v", got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("timeout")
+		}
+	})
+}
+
+func TestServer_Request_TLSClientCert(t *testing.T) {
+	gotReq := make(chan *http.Request, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotReq <- r
+	}, optOnlyServer, func(ts *httptest.Server) {
+		ts.Config.TLSConfig = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	})
+	defer st.Close()
+
+	// Present the server's own certificate as the client's.
+	cc, err := tls.Dial("tcp", st.ts.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{NextProtoTLS},
+		Certificates:       st.ts.TLS.Certificates,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.cc = cc
+	st.fr = NewFramer(cc, cc)
+	st.greet()
+	st.bodylessReq1()
+
+	r := <-gotReq
+	if r.TLS == nil {
+		t.Fatal("nil Request.TLS")
+	}
+	if len(r.TLS.PeerCertificates) != 1 {
+		t.Fatalf("got %d peer certificates; want 1", len(r.TLS.PeerCertificates))
+	}
+	if r.TLS.NegotiatedProtocol != NextProtoTLS {
+		t.Errorf("NegotiatedProtocol = %q; want %q", r.TLS.NegotiatedProtocol, NextProtoTLS)
+	}
+}
+
+func TestServer_NextProtos(t *testing.T) {
+	const proto = "h2-draft-test"
+	gotReq := make(chan *http.Request, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		gotReq <- r
+	}, optOnlyServer, func(s *Server) {
+		s.NextProtos = []string{proto}
+	})
+	defer st.Close()
+
+	if _, ok := st.ts.Config.TLSNextProto["h2-14"]; ok {
+		t.Error("h2-14 registered despite Server.NextProtos")
+	}
+	cc, err := tls.Dial("tcp", st.ts.Listener.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{proto},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.cc = cc
+	st.fr = NewFramer(cc, cc)
+	st.greet()
+	st.bodylessReq1()
+
+	r := <-gotReq
+	if r.TLS.NegotiatedProtocol != proto {
+		t.Errorf("NegotiatedProtocol = %q; want %q", r.TLS.NegotiatedProtocol, proto)
+	}
+}
+
+func TestConfigureServer_NextProtos(t *testing.T) {
+	hs := &http.Server{TLSConfig: &tls.Config{NextProtos: []string{"http/1.1", NextProtoTLS}}}
+	ConfigureServer(hs, nil)
+	want := []string{"http/1.1", NextProtoTLS, "h2-14"}
+	if !reflect.DeepEqual(hs.TLSConfig.NextProtos, want) {
+		t.Errorf("NextProtos = %q; want %q", hs.TLSConfig.NextProtos, want)
+	}
+	for _, p := range []string{NextProtoTLS, "h2-14"} {
+		if hs.TLSNextProto[p] == nil {
+			t.Errorf("no TLSNextProto handler for %q", p)
 		}
-	})
+	}
 }
 
 func TestServer_Rejects_TLS10(t *testing.T) { testRejectTLS(t, tls.VersionTLS10) }
@@ -1999,7 +6063,13 @@ func TestServer_Rejects_TLS11(t *testing.T) { testRejectTLS(t, tls.VersionTLS11)
 
 func testRejectTLS(t *testing.T, max uint16) {
 	st := newServerTester(t, nil, func(c *tls.Config) {
+		c.MinVersion = max
 		c.MaxVersion = max
+	}, func(ts *httptest.Server) {
+		// crypto/tls no longer offers anything below TLS 1.2
+		// by default; let the handshake through so the
+		// HTTP/2 server is what refuses it.
+		ts.Config.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS10}
 	})
 	defer st.Close()
 	gf := st.wantGoAway()
@@ -2008,22 +6078,27 @@ func testRejectTLS(t *testing.T, max uint16) {
 	}
 }
 
+// badCipherSuites are prohibited by the HTTP/2 spec.
+var badCipherSuites = []uint16{
+	tls.TLS_RSA_WITH_RC4_128_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+}
+
 func TestServer_Rejects_TLSBadCipher(t *testing.T) {
 	st := newServerTester(t, nil, func(c *tls.Config) {
-		// Only list bad ones:
-		c.CipherSuites = []uint16{
-			tls.TLS_RSA_WITH_RC4_128_SHA,
-			tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_RSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
-			tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
-			tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
-		}
+		// Only list bad ones. TLS 1.3 suites aren't
+		// configurable, so stay on TLS 1.2.
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = badCipherSuites
 	})
 	defer st.Close()
 	gf := st.wantGoAway()
@@ -2032,6 +6107,17 @@ func TestServer_Rejects_TLSBadCipher(t *testing.T) {
 	}
 }
 
+func TestServer_TLSBadCipher_Permitted(t *testing.T) {
+	st := newServerTester(t, nil, func(c *tls.Config) {
+		c.MaxVersion = tls.VersionTLS12
+		c.CipherSuites = badCipherSuites
+	}, func(s *Server) {
+		s.PermitProhibitedCipherSuites = true
+	})
+	defer st.Close()
+	st.greet()
+}
+
 func TestServer_Advertises_Common_Cipher(t *testing.T) {
 	const requiredSuite = tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
 	st := newServerTester(t, nil, func(c *tls.Config) {
@@ -2250,3 +6336,515 @@ func BenchmarkServerPosts(b *testing.B) {
 		}
 	}
 }
+
+// BenchmarkServerGets_NoBody is like BenchmarkServerGets, but the
+// handler does nothing, so the cost is the server's own.
+func BenchmarkServerGets_NoBody(b *testing.B) {
+	b.ReportAllocs()
+
+	st := newServerTester(b, func(w http.ResponseWriter, r *http.Request) {})
+	defer st.Close()
+	st.greet()
+
+	for i := 0; i < b.N; i++ {
+		id := 1 + uint32(i)*2
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      id,
+			BlockFragment: st.encodeHeader(),
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+		if hf := st.wantHeaders(); !hf.StreamEnded() {
+			b.Fatalf("HEADERS didn't have END_STREAM; got %v", hf)
+		}
+	}
+}
+
+// BenchmarkServer_ManyCookies sends requests carrying many
+// "cookie" fields, which the server joins into one Cookie header.
+func BenchmarkServer_ManyCookies(b *testing.B) {
+	const crumbs = 200
+	defer func(old bool) { DebugGoroutines = old }(DebugGoroutines)
+	DebugGoroutines = false
+	b.ReportAllocs()
+
+	st := newServerTester(b, func(w http.ResponseWriter, r *http.Request) {})
+	defer st.Close()
+	st.greet()
+
+	var headers []string
+	for i := 0; i < crumbs; i++ {
+		headers = append(headers, "cookie", fmt.Sprintf("crumb%03d=%s", i, strings.Repeat("v", 20)))
+	}
+	block := st.encodeHeader(headers...)
+	for i := 0; i < b.N; i++ {
+		id := 1 + uint32(i)*2
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      id,
+			BlockFragment: block,
+			EndStream:     true,
+			EndHeaders:    true,
+		})
+		if hf := st.wantHeaders(); !hf.StreamEnded() {
+			b.Fatalf("HEADERS didn't have END_STREAM; got %v", hf)
+		}
+	}
+}
+
+// BenchmarkServer_SmallDataFrames sends a flood of empty DATA frames,
+// which the server reads and processes without writing anything back.
+func BenchmarkServer_SmallDataFrames(b *testing.B) {
+	defer func(old bool) { DebugGoroutines = old }(DebugGoroutines)
+	DebugGoroutines = false
+	b.ReportAllocs()
+
+	done := make(chan bool)
+	st := newServerTester(b, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		close(done)
+	})
+	defer st.Close()
+	st.greet()
+	st.writeHeaders(HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: st.encodeHeader(":method", "POST"),
+		EndStream:     false,
+		EndHeaders:    true,
+	})
+
+	// The frames go out in batches, like a real client's would.
+	bw := bufio.NewWriter(st.cc)
+	fr := NewFramer(bw, nil)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := fr.WriteData(1, false, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := fr.WriteData(1, true, nil); err != nil {
+		b.Fatal(err)
+	}
+	if err := bw.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	<-done
+}
+
+// BenchmarkServerPosts_SmallBody is like BenchmarkServerPosts, but
+// each request has a small body that the handler reads.
+func BenchmarkServerPosts_SmallBody(b *testing.B) {
+	b.ReportAllocs()
+
+	const msg = "Hello, world"
+	body := make([]byte, 64)
+	st := newServerTester(b, func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(ioutil.Discard, r.Body)
+		io.WriteString(w, msg)
+	})
+	defer st.Close()
+	st.greet()
+
+	// Give the server quota to reply. (plus it has the the 64KB)
+	if err := st.fr.WriteWindowUpdate(0, uint32(b.N*len(msg))); err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		id := 1 + uint32(i)*2
+		st.writeHeaders(HeadersFrameParam{
+			StreamID:      id,
+			BlockFragment: st.encodeHeader(":method", "POST"),
+			EndStream:     false,
+			EndHeaders:    true,
+		})
+		st.writeData(id, true, body)
+		for ended := false; !ended; {
+			f, err := st.readFrame()
+			if err != nil {
+				b.Fatal(err)
+			}
+			switch f := f.(type) {
+			case *WindowUpdateFrame, *HeadersFrame:
+				// Returned flow control, and the response.
+			case *DataFrame:
+				ended = f.StreamEnded()
+			default:
+				b.Fatalf("unexpected frame %v", f.Header())
+			}
+		}
+	}
+}
+
+// BenchmarkServer_ConcurrentStreams keeps many streams in flight at
+// once, each of whose handlers writes its headers and then a body,
+// so the handlers compete to hand frames to the serve loop.
+func BenchmarkServer_ConcurrentStreams(b *testing.B) {
+	defer func(old bool) { DebugGoroutines = old }(DebugGoroutines)
+	DebugGoroutines = false
+	b.ReportAllocs()
+
+	const streams = 100
+	body := make([]byte, 512)
+	st := newServerTester(b, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(200)
+		w.(http.Flusher).Flush()
+		w.Write(body)
+	})
+	defer st.Close()
+	st.greet()
+
+	// Write and read in bulk, as a real client would, so the
+	// server's side dominates.
+	bw := bufio.NewWriter(st.cc)
+	fr := NewFramer(bw, bufio.NewReader(st.cc))
+	b.ResetTimer()
+	for n := 0; n < b.N; n += streams {
+		batch := streams
+		if b.N-n < batch {
+			batch = b.N - n
+		}
+		for i := 0; i < batch; i++ {
+			err := fr.WriteHeaders(HeadersFrameParam{
+				StreamID:      1 + uint32(n+i)*2,
+				BlockFragment: st.encodeHeader(),
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := bw.Flush(); err != nil {
+			b.Fatal(err)
+		}
+		var got int
+		for ended := 0; ended < batch; {
+			f, err := fr.ReadFrame()
+			if err != nil {
+				b.Fatal(err)
+			}
+			switch f := f.(type) {
+			case *HeadersFrame:
+			case *DataFrame:
+				got += len(f.Data())
+				if f.StreamEnded() {
+					ended++
+				}
+			default:
+				b.Fatalf("unexpected frame %v", f.Header())
+			}
+		}
+		// Give back the connection-level quota the batch used.
+		if err := fr.WriteWindowUpdate(0, uint32(got)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestServer_Push(t *testing.T) {
+	pushErr := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			pushErr <- w.(http.Pusher).Push("/pushed", &http.PushOptions{
+				Header: http.Header{"Accept-Encoding": {"gzip"}},
+			})
+			io.WriteString(w, "main")
+		case "/pushed":
+			if id, _ := StreamIDFromContext(r.Context()); id != 2 {
+				t.Errorf("pushed request on stream %d; want 2", id)
+			}
+			if got := r.Header.Get("Accept-Encoding"); got != "gzip" {
+				t.Errorf("pushed request Accept-Encoding = %q; want gzip", got)
+			}
+			io.WriteString(w, "pushed")
+		default:
+			t.Errorf("unexpected request for %q", r.URL.Path)
+		}
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1(":authority", "example.com")
+
+	// One decoder for the whole connection, as the server's
+	// encoder may refer back to earlier header blocks.
+	var fields [][2]string
+	dec := hpack.NewDecoder(initialHeaderTableSize, func(f hpack.HeaderField) {
+		fields = append(fields, [2]string{f.Name, f.Value})
+	})
+	decode := func(frag []byte) [][2]string {
+		fields = nil
+		if _, err := dec.Write(frag); err != nil {
+			t.Fatalf("hpack decoding error: %v", err)
+		}
+		if err := dec.Close(); err != nil {
+			t.Fatalf("hpack decoding error: %v", err)
+		}
+		return fields
+	}
+
+	var (
+		gotPromise bool
+		status     = map[uint32]string{}
+		body       = map[uint32]string{}
+		ended      = map[uint32]bool{}
+	)
+	for !ended[1] || !ended[2] {
+		f, err := st.readFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch f := f.(type) {
+		case *PushPromiseFrame:
+			if f.StreamID != 1 || f.PromiseID != 2 || !f.HeadersEnded() {
+				t.Fatalf("PUSH_PROMISE on stream %d promising %d, END_HEADERS=%v; want stream 1 promising 2 with END_HEADERS",
+					f.StreamID, f.PromiseID, f.HeadersEnded())
+			}
+			if ended[2] || status[2] != "" {
+				t.Fatal("PUSH_PROMISE after the pushed response")
+			}
+			gotPromise = true
+			want := [][2]string{
+				{":method", "GET"},
+				{":scheme", "https"},
+				{":authority", "example.com"},
+				{":path", "/pushed"},
+				{"accept-encoding", "gzip"},
+			}
+			if got := decode(f.HeaderBlockFragment()); !reflect.DeepEqual(got, want) {
+				t.Errorf("promised headers = %v; want %v", got, want)
+			}
+		case *HeadersFrame:
+			for _, kv := range decode(f.HeaderBlockFragment()) {
+				if kv[0] == ":status" {
+					status[f.StreamID] = kv[1]
+				}
+			}
+			ended[f.StreamID] = ended[f.StreamID] || f.StreamEnded()
+		case *DataFrame:
+			body[f.StreamID] += string(f.Data())
+			ended[f.StreamID] = ended[f.StreamID] || f.StreamEnded()
+		default:
+			t.Fatalf("unexpected frame %v", f.Header())
+		}
+	}
+	if err := <-pushErr; err != nil {
+		t.Errorf("Push = %v", err)
+	}
+	if !gotPromise {
+		t.Error("no PUSH_PROMISE")
+	}
+	if status[1] != "200" || body[1] != "main" {
+		t.Errorf("stream 1 response = %q %q; want 200 \"main\"", status[1], body[1])
+	}
+	if status[2] != "200" || body[2] != "pushed" {
+		t.Errorf("pushed response = %q %q; want 200 \"pushed\"", status[2], body[2])
+	}
+}
+
+// Test that a promised header block too big for one frame is split
+// so the PUSH_PROMISE, with its promised stream ID, still fits in
+// the default SETTINGS_MAX_FRAME_SIZE.
+func TestServer_Push_LargeHeaderBlock(t *testing.T) {
+	big := strings.Repeat("~", 16<<10) // longer Huffman-encoded, so sent as is
+	pushErr := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/" {
+			pushErr <- w.(http.Pusher).Push("/pushed", &http.PushOptions{
+				Header: http.Header{"X-Big": {big}},
+			})
+		}
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+
+	f, err := st.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pp, ok := f.(*PushPromiseFrame)
+	if !ok {
+		t.Fatalf("got %v; want PUSH_PROMISE", f.Header())
+	}
+	if pp.HeadersEnded() {
+		t.Fatal("PUSH_PROMISE has END_HEADERS; want the block continued")
+	}
+	if pp.Length > minMaxFrameSize {
+		t.Errorf("PUSH_PROMISE length = %d; want at most %d", pp.Length, minMaxFrameSize)
+	}
+	block := append([]byte(nil), pp.HeaderBlockFragment()...)
+	for {
+		cf := st.wantContinuation()
+		block = append(block, cf.HeaderBlockFragment()...)
+		if cf.HeadersEnded() {
+			break
+		}
+	}
+	var got string
+	dec := hpack.NewDecoder(initialHeaderTableSize, func(f hpack.HeaderField) {
+		if f.Name == "x-big" {
+			got = f.Value
+		}
+	})
+	if _, err := dec.Write(block); err != nil {
+		t.Fatal(err)
+	}
+	if got != big {
+		t.Errorf("promised x-big header is %d bytes; want %d", len(got), len(big))
+	}
+	if err := <-pushErr; err != nil {
+		t.Errorf("Push = %v", err)
+	}
+}
+
+// Test that Push fails, without sending anything, once the client
+// has disabled push.
+func TestServer_Push_Disabled(t *testing.T) {
+	pushErr := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		pushErr <- w.(http.Pusher).Push("/pushed", nil)
+	})
+	defer st.Close()
+	st.writePreface()
+	if err := st.fr.WriteSettings(Setting{SettingEnablePush, 0}); err != nil {
+		t.Fatal(err)
+	}
+	st.wantSettings()
+	st.writeSettingsAck()
+	st.wantSettingsAck()
+	st.bodylessReq1()
+
+	hf := st.wantHeaders()
+	if hf.StreamID != 1 || !hf.StreamEnded() {
+		t.Fatalf("got HEADERS for stream %d, ended=%v; want stream 1 ended", hf.StreamID, hf.StreamEnded())
+	}
+	if err := <-pushErr; err != http.ErrNotSupported {
+		t.Errorf("Push = %v; want http.ErrNotSupported", err)
+	}
+}
+
+// Test the pushes Push refuses before sending a PUSH_PROMISE.
+func TestServer_Push_Invalid(t *testing.T) {
+	tests := []struct {
+		target string
+		opts   *http.PushOptions
+	}{
+		{"relative", nil},
+		{"http://example.com/", nil}, // conn is https
+		{"https:///nohost", nil},
+		{"/", &http.PushOptions{Method: "POST"}},
+		{"/", &http.PushOptions{Header: http.Header{":path": {"/x"}}}},
+		{"/", &http.PushOptions{Header: http.Header{"Content-Length": {"5"}}}},
+		{"/", &http.PushOptions{Header: http.Header{"Connection": {"close"}}}},
+	}
+	errs := make(chan error, len(tests))
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		for _, tt := range tests {
+			errs <- w.(http.Pusher).Push(tt.target, tt.opts)
+		}
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+	if hf := st.wantHeaders(); hf.StreamID != 1 {
+		t.Fatalf("got HEADERS for stream %d; want 1", hf.StreamID)
+	}
+	for _, tt := range tests {
+		if err := <-errs; err == nil {
+			t.Errorf("Push(%q, %+v) = nil; want error", tt.target, tt.opts)
+		}
+	}
+}
+
+// Test that a pushed response can't push in turn.
+func TestServer_Push_Recursive(t *testing.T) {
+	pushErr := make(chan error, 1)
+	st := newServerTester(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pushed" {
+			pushErr <- w.(http.Pusher).Push("/again", nil)
+			return
+		}
+		if err := w.(http.Pusher).Push("/pushed", nil); err != nil {
+			t.Errorf("Push = %v", err)
+		}
+	})
+	defer st.Close()
+	st.greet()
+	st.bodylessReq1()
+	select {
+	case err := <-pushErr:
+		if err != ErrRecursivePush {
+			t.Errorf("recursive Push = %v; want ErrRecursivePush", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for pushed handler")
+	}
+}
+
+// benchmarkResponseWriter returns a responseWriter that has
+// already written its header and whose output is discarded.
+func benchmarkResponseWriter() *responseWriter {
+	return &responseWriter{rws: &responseWriterState{
+		wroteHeader: true,
+		bw:          bufio.NewWriterSize(ioutil.Discard, handlerChunkWriteSize),
+	}}
+}
+
+var benchmarkBody = strings.Repeat("a", 1<<10)
+
+func BenchmarkResponseWriter_Write(b *testing.B) {
+	b.ReportAllocs()
+	w := benchmarkResponseWriter()
+	for i := 0; i < b.N; i++ {
+		w.Write([]byte(benchmarkBody))
+	}
+}
+
+func BenchmarkResponseWriter_WriteString(b *testing.B) {
+	b.ReportAllocs()
+	w := benchmarkResponseWriter()
+	for i := 0; i < b.N; i++ {
+		w.WriteString(benchmarkBody)
+	}
+}
+
+func TestServer_CanonicalHeader_ConnCacheBounded(t *testing.T) {
+	defer func(c *headerNameCache) { sharedCanonHeader = c }(sharedCanonHeader)
+	sharedCanonHeader = &headerNameCache{max: 2}
+	sc := &serverConn{serveG: newGoroutineLock()}
+	for i := 0; i < 2+2*maxConnCanonHeaders; i++ {
+		v := fmt.Sprintf("x-test-conn-cache-%d", i)
+		if got, want := sc.canonicalHeader(v), http.CanonicalHeaderKey(v); got != want {
+			t.Fatalf("canonicalHeader(%q) = %q; want %q", v, got, want)
+		}
+	}
+	if len(sc.canonHeader) > maxConnCanonHeaders {
+		t.Errorf("conn cache has %d entries; want at most %d", len(sc.canonHeader), maxConnCanonHeaders)
+	}
+}
+
+// BenchmarkCanonicalHeader_ManyConns canonicalizes the same
+// uncommon header names on many connections, each only once.
+func BenchmarkCanonicalHeader_ManyConns(b *testing.B) {
+	names := []string{
+		"x-forwarded-for",
+		"x-forwarded-proto",
+		"x-request-id",
+		"x-real-ip",
+		"dnt",
+		"upgrade-insecure-requests",
+		"sec-fetch-mode",
+		"sec-fetch-site",
+	}
+	defer func(old bool) { DebugGoroutines = old }(DebugGoroutines)
+	DebugGoroutines = false
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		sc := &serverConn{}
+		for _, v := range names {
+			sc.canonicalHeader(v)
+		}
+	}
+}
@@ -11,6 +11,8 @@ import (
 	"bytes"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/bradfitz/http2/hpack"
@@ -65,10 +67,11 @@ func (s writeSettings) writeFrame(ctx writeContext) error {
 type writeGoAway struct {
 	maxStreamID uint32
 	code        ErrCode
+	debug       string // optional
 }
 
 func (p *writeGoAway) writeFrame(ctx writeContext) error {
-	err := ctx.Framer().WriteGoAway(p.maxStreamID, p.code, nil)
+	err := ctx.Framer().WriteGoAway(p.maxStreamID, p.code, []byte(p.debug))
 	if p.code != 0 {
 		ctx.Flush() // ignore error: we're hanging up on them anyway
 		time.Sleep(50 * time.Millisecond)
@@ -95,12 +98,29 @@ func (se StreamError) writeFrame(ctx writeContext) error {
 	return ctx.Framer().WriteRSTStream(se.StreamID, se.Code)
 }
 
+// handlerPanicRST is the message sent from handler goroutines when
+// the handler panics. The serve goroutine closes the stream when it
+// writes it.
+type handlerPanicRST struct {
+	StreamID uint32
+}
+
+func (hp handlerPanicRST) writeFrame(ctx writeContext) error {
+	return ctx.Framer().WriteRSTStream(hp.StreamID, ErrCodeInternal)
+}
+
 type writePingAck struct{ pf *PingFrame }
 
 func (w writePingAck) writeFrame(ctx writeContext) error {
 	return ctx.Framer().WritePing(true, w.pf.Data)
 }
 
+type writePing struct{ data [8]byte }
+
+func (w writePing) writeFrame(ctx writeContext) error {
+	return ctx.Framer().WritePing(false, w.data)
+}
+
 type writeSettingsAck struct{}
 
 func (writeSettingsAck) writeFrame(ctx writeContext) error {
@@ -113,24 +133,59 @@ type writeResHeaders struct {
 	streamID    uint32
 	httpResCode int
 	h           http.Header // may be nil
+	trailers    []string    // if non-nil, a trailing block of just these keys of h
 	endStream   bool
 
 	contentType   string
 	contentLength string
+
+	// sensitive holds the canonical keys of h to encode with
+	// HPACK's never-indexed representation.
+	sensitive map[string]bool
 }
 
 func (w *writeResHeaders) writeFrame(ctx writeContext) error {
 	enc, buf := ctx.HeaderEncoder()
 	buf.Reset()
+	if w.trailers != nil {
+		for _, k := range w.trailers {
+			if isPseudoHeader(k) {
+				continue
+			}
+			lk := lowerHeader(k)
+			if connHeaders[lk] {
+				// 8.1.2.2, as for the header block below.
+				continue
+			}
+			for _, v := range w.h[k] {
+				enc.WriteField(hpack.HeaderField{Name: lk, Value: v, Sensitive: w.sensitive[k]})
+			}
+		}
+		return writeHeaderBlock(ctx, w.streamID, w.endStream, buf.Bytes())
+	}
 	enc.WriteField(hpack.HeaderField{Name: ":status", Value: httpCodeString(w.httpResCode)})
 	for k, vv := range w.h {
+		if strings.HasPrefix(k, http.TrailerPrefix) {
+			// Sent with the trailers instead.
+			continue
+		}
+		if isPseudoHeader(k) {
+			// Only the server sets pseudo-header fields.
+			continue
+		}
+		if k == SensitiveHeaders {
+			// For us, not the client.
+			continue
+		}
+		sensitive := w.sensitive[k]
 		k = lowerHeader(k)
+		if connHeaders[k] {
+			// 8.1.2.2: "An endpoint MUST NOT generate an HTTP/2
+			// message containing connection-specific header fields."
+			continue
+		}
 		for _, v := range vv {
-			// TODO: more of "8.1.2.2 Connection-Specific Header Fields"
-			if k == "transfer-encoding" && v != "trailers" {
-				continue
-			}
-			enc.WriteField(hpack.HeaderField{Name: k, Value: v})
+			enc.WriteField(hpack.HeaderField{Name: k, Value: v, Sensitive: sensitive})
 		}
 	}
 	if w.contentType != "" {
@@ -145,33 +200,58 @@ func (w *writeResHeaders) writeFrame(ctx writeContext) error {
 		panic("unexpected empty hpack")
 	}
 
-	// For now we're lazy and just pick the minimum MAX_FRAME_SIZE
-	// that all peers must support (16KB). Later we could care
-	// more and send larger frames if the peer advertised it, but
-	// there's little point. Most headers are small anyway (so we
-	// generally won't have CONTINUATION frames), and extra frames
-	// only waste 9 bytes anyway.
-	const maxFrameSize = 16384
+	return writeHeaderBlock(ctx, w.streamID, w.endStream, headerBlock)
+}
+
+// writeHeaderBlock writes the HPACK-encoded headerBlock for streamID
+// as a HEADERS frame followed by as many CONTINUATION frames as
+// needed. END_HEADERS is set only on the final fragment, and
+// END_STREAM (if endStream) only on the HEADERS frame.
+func writeHeaderBlock(ctx writeContext, streamID uint32, endStream bool, headerBlock []byte) error {
+	return splitHeaderBlock(ctx, streamID, headerBlock, maxHeaderFragmentSize, func(frag []byte, endHeaders bool) error {
+		return ctx.Framer().WriteHeaders(HeadersFrameParam{
+			StreamID:      streamID,
+			BlockFragment: frag,
+			EndStream:     endStream,
+			EndHeaders:    endHeaders,
+		})
+	})
+}
 
+// maxHeaderFragmentSize is the largest frame payload a header block
+// fragment is written in.
+//
+// For now we're lazy and just pick the minimum MAX_FRAME_SIZE
+// that all peers must support (16KB). Later we could care
+// more and send larger frames if the peer advertised it, but
+// there's little point. Most headers are small anyway (so we
+// generally won't have CONTINUATION frames), and extra frames
+// only waste 9 bytes anyway.
+const maxHeaderFragmentSize = 16384
+
+// splitHeaderBlock writes headerBlock for streamID, its first
+// fragment of at most firstMax bytes with writeFirst and the rest as
+// CONTINUATION frames. firstMax leaves room for whatever else the
+// first frame's payload carries.
+func splitHeaderBlock(ctx writeContext, streamID uint32, headerBlock []byte, firstMax int, writeFirst func(frag []byte, endHeaders bool) error) error {
 	first := true
 	for len(headerBlock) > 0 {
+		max := maxHeaderFragmentSize
+		if first {
+			max = firstMax
+		}
 		frag := headerBlock
-		if len(frag) > maxFrameSize {
-			frag = frag[:maxFrameSize]
+		if len(frag) > max {
+			frag = frag[:max]
 		}
 		headerBlock = headerBlock[len(frag):]
 		endHeaders := len(headerBlock) == 0
 		var err error
 		if first {
 			first = false
-			err = ctx.Framer().WriteHeaders(HeadersFrameParam{
-				StreamID:      w.streamID,
-				BlockFragment: frag,
-				EndStream:     w.endStream,
-				EndHeaders:    endHeaders,
-			})
+			err = writeFirst(frag, endHeaders)
 		} else {
-			err = ctx.Framer().WriteContinuation(w.streamID, endHeaders, frag)
+			err = ctx.Framer().WriteContinuation(streamID, endHeaders, frag)
 		}
 		if err != nil {
 			return err
@@ -180,6 +260,47 @@ func (w *writeResHeaders) writeFrame(ctx writeContext) error {
 	return nil
 }
 
+// writePushPromise is a request to write a PUSH_PROMISE and 0+
+// CONTINUATION frames promising a pushed response to the request it
+// describes.
+type writePushPromise struct {
+	streamID uint32 // the stream of the request doing the pushing
+	method   string
+	url      *url.URL
+	h        http.Header
+
+	// promisedID is the pushed stream's ID. It's allocated by
+	// the serve loop just before the frame is written, so that
+	// promised IDs go out in increasing order.
+	promisedID uint32
+}
+
+func (w *writePushPromise) writeFrame(ctx writeContext) error {
+	enc, buf := ctx.HeaderEncoder()
+	buf.Reset()
+	enc.WriteField(hpack.HeaderField{Name: ":method", Value: w.method})
+	enc.WriteField(hpack.HeaderField{Name: ":scheme", Value: w.url.Scheme})
+	enc.WriteField(hpack.HeaderField{Name: ":authority", Value: w.url.Host})
+	enc.WriteField(hpack.HeaderField{Name: ":path", Value: w.url.RequestURI()})
+	for k, vv := range w.h {
+		k = lowerHeader(k)
+		for _, v := range vv {
+			enc.WriteField(hpack.HeaderField{Name: k, Value: v})
+		}
+	}
+	// The PUSH_PROMISE payload also carries the 4-byte promised
+	// stream ID.
+	firstMax := maxHeaderFragmentSize - 4
+	return splitHeaderBlock(ctx, w.streamID, buf.Bytes(), firstMax, func(frag []byte, endHeaders bool) error {
+		return ctx.Framer().WritePushPromise(PushPromiseParam{
+			StreamID:      w.streamID,
+			PromiseID:     w.promisedID,
+			BlockFragment: frag,
+			EndHeaders:    endHeaders,
+		})
+	})
+}
+
 type writeReqHeaders struct {
 	streamID uint32
 	scheme string
@@ -221,39 +342,13 @@ func (w *writeReqHeaders) writeFrame(ctx writeContext) error {
 		panic("unexpected empty hpack")
 	}
 
-	// For now we're lazy and just pick the minimum MAX_FRAME_SIZE
-	// that all peers must support (16KB). Later we could care
-	// more and send larger frames if the peer advertised it, but
-	// there's little point. Most headers are small anyway (so we
-	// generally won't have CONTINUATION frames), and extra frames
-	// only waste 9 bytes anyway.
-	const maxFrameSize = 16384
+	return writeHeaderBlock(ctx, w.streamID, w.endStream, headerBlock)
+}
 
-	first := true
-	for len(headerBlock) > 0 {
-		frag := headerBlock
-		if len(frag) > maxFrameSize {
-			frag = frag[:maxFrameSize]
-		}
-		headerBlock = headerBlock[len(frag):]
-		endHeaders := len(headerBlock) == 0
-		var err error
-		if first {
-			first = false
-			err = ctx.Framer().WriteHeaders(HeadersFrameParam{
-				StreamID:      w.streamID,
-				BlockFragment: frag,
-				EndStream:     w.endStream,
-				EndHeaders:    endHeaders,
-			})
-		} else {
-			err = ctx.Framer().WriteContinuation(w.streamID, endHeaders, frag)
-		}
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+// isPseudoHeader reports whether k names an HTTP/2 pseudo-header
+// field, which a handler's header map mustn't supply.
+func isPseudoHeader(k string) bool {
+	return strings.HasPrefix(k, ":")
 }
 
 type write100ContinueHeadersFrame struct {
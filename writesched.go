@@ -39,8 +39,124 @@ func (wm frameWriteMsg) String() string {
 	return fmt.Sprintf("[frameWriteMsg stream=%d, ch=%v, type: %v]", streamID, wm.done != nil, des)
 }
 
+// WriteScheduler decides the order in which a server connection's
+// queued frames are written. Frames not tied to a stream, such as
+// SETTINGS ACKs, always go first, and a stream's own frames are
+// always written in order; the scheduler picks which stream goes
+// next. Its methods are only called from the connection's serve
+// goroutine.
+//
+// WriteScheduler is sealed: its methods are unexported, so the only
+// implementations are those returned by this package's
+// New*WriteScheduler functions, and it serves to choose among them
+// with Server.NewWriteScheduler. They work on the connection's
+// internal frame and stream state, which isn't part of the API.
+type WriteScheduler interface {
+	// add queues wm to be written.
+	add(wm frameWriteMsg)
+
+	// addWindowUpdate is like add for a WINDOW_UPDATE, but may
+	// fold it into one that's still queued.
+	addWindowUpdate(wm frameWriteMsg)
+
+	// take returns the next frame to write and removes it
+	// from the scheduler, or reports false if nothing can be
+	// written now.
+	take() (wm frameWriteMsg, ok bool)
+
+	// forgetStream drops the frames queued for a closed
+	// stream, telling any writers waiting on them.
+	forgetStream(id uint32)
+
+	// setMaxFrameSize sets the maximum DATA frame size the
+	// peer accepts.
+	setMaxFrameSize(n uint32)
+
+	// empty reports whether no frames are queued.
+	empty() bool
+}
+
+// NewFIFOWriteScheduler returns a WriteScheduler that writes
+// streams' frames in the order they were queued, passing over only
+// DATA that flow control holds back, until it may be sent. It's the
+// default, and the most predictable: a baseline to compare the
+// others against.
+func NewFIFOWriteScheduler() WriteScheduler {
+	return new(fifoWriteScheduler)
+}
+
+// fifoWriteScheduler is a writeScheduler that takes from the stream
+// whose next frame was queued first.
+type fifoWriteScheduler struct {
+	writeScheduler
+
+	// order has a stream's ID for each of its queued frames, in
+	// the order they were queued.
+	order []uint32
+}
+
+func (ws *fifoWriteScheduler) add(wm frameWriteMsg) {
+	ws.writeScheduler.add(wm)
+	if wm.stream != nil {
+		ws.order = append(ws.order, wm.stream.id)
+	}
+}
+
+func (ws *fifoWriteScheduler) addWindowUpdate(wm frameWriteMsg) {
+	if !ws.mergeWindowUpdate(wm) {
+		ws.add(wm)
+	}
+}
+
+func (ws *fifoWriteScheduler) take() (wm frameWriteMsg, ok bool) {
+	if ws.maxFrameSize == 0 {
+		panic("internal error: ws.maxFrameSize not initialized or invalid")
+	}
+	if !ws.zero.empty() {
+		return ws.zero.shift(), true
+	}
+	for i, id := range ws.order {
+		q := ws.sq[id]
+		if !q.firstIsNoCost() && ws.streamWritableBytes(q) == 0 {
+			continue
+		}
+		n := len(q.s)
+		wm, ok = ws.takeFrom(id, q)
+		if len(q.s) < n {
+			// Not just part of a DATA frame; the whole
+			// frame is written.
+			copy(ws.order[i:], ws.order[i+1:])
+			ws.order = ws.order[:len(ws.order)-1]
+		}
+		return wm, ok
+	}
+	return
+}
+
+func (ws *fifoWriteScheduler) forgetStream(id uint32) {
+	ws.writeScheduler.forgetStream(id)
+	n := 0
+	for _, v := range ws.order {
+		if v != id {
+			ws.order[n] = v
+			n++
+		}
+	}
+	ws.order = ws.order[:n]
+}
+
+// NewRoundRobinWriteScheduler returns a WriteScheduler that's fair
+// to all streams regardless of their priority: those with frames
+// ready take turns writing one frame each.
+func NewRoundRobinWriteScheduler() WriteScheduler {
+	return new(writeScheduler)
+}
+
 // writeScheduler tracks pending frames to write, priorities, and decides
 // the next one to use. It is not thread-safe.
+//
+// It's the round-robin WriteScheduler: streams with DATA ready take
+// turns in stream ID order.
 type writeScheduler struct {
 	// zero are frames not associated with a specific stream.
 	// They're sent before any stream-specific freams.
@@ -62,8 +178,14 @@ type writeScheduler struct {
 
 	// pool of empty queues for reuse.
 	queuePool []*writeQueue
+
+	// lastID is the stream most recently given a DATA frame,
+	// where the next round-robin turn starts from.
+	lastID uint32
 }
 
+func (ws *writeScheduler) setMaxFrameSize(n uint32) { ws.maxFrameSize = n }
+
 func (ws *writeScheduler) putEmptyQueue(q *writeQueue) {
 	if len(q.s) != 0 {
 		panic("queue must be empty")
@@ -92,6 +214,35 @@ func (ws *writeScheduler) add(wm frameWriteMsg) {
 	}
 }
 
+// addWindowUpdate is like add, but folds wm into the last queued
+// frame if that's also an unwritten WINDOW_UPDATE nobody waits on,
+// so a run of small reads costs a single frame.
+func (ws *writeScheduler) addWindowUpdate(wm frameWriteMsg) {
+	if !ws.mergeWindowUpdate(wm) {
+		ws.add(wm)
+	}
+}
+
+// mergeWindowUpdate does addWindowUpdate's folding, and reports
+// whether wm could be folded in.
+func (ws *writeScheduler) mergeWindowUpdate(wm frameWriteMsg) bool {
+	q := &ws.zero
+	if wm.stream != nil {
+		q = ws.sq[wm.stream.id]
+	}
+	if q != nil && len(q.s) > 0 && wm.done == nil {
+		last := &q.s[len(q.s)-1]
+		prev, ok := last.write.(writeWindowUpdate)
+		wu := wm.write.(writeWindowUpdate)
+		if ok && last.done == nil && prev.streamID == wu.streamID && prev.n+wu.n < 1<<31 {
+			prev.n += wu.n
+			last.write = prev
+			return true
+		}
+	}
+	return false
+}
+
 func (ws *writeScheduler) streamQueue(streamID uint32) *writeQueue {
 	if q, ok := ws.sq[streamID]; ok {
 		return q
@@ -143,10 +294,23 @@ func (ws *writeScheduler) take() (wm frameWriteMsg, ok bool) {
 	}
 	defer ws.zeroCanSend()
 
-	// TODO: find the best queue
-	q := ws.canSend[0]
-
-	return ws.takeFrom(q.streamID(), q)
+	// Round-robin: the next stream after the last one served,
+	// wrapping around to the lowest.
+	var next, first *writeQueue
+	for _, q := range ws.canSend {
+		id := q.streamID()
+		if first == nil || id < first.streamID() {
+			first = q
+		}
+		if id > ws.lastID && (next == nil || id < next.streamID()) {
+			next = q
+		}
+	}
+	if next == nil {
+		next = first
+	}
+	ws.lastID = next.streamID()
+	return ws.takeFrom(ws.lastID, next)
 }
 
 // zeroCanSend is defered from take.
@@ -239,6 +403,7 @@ func (ws *writeScheduler) forgetStream(id uint32) {
 
 	// But keep it for others later.
 	for i := range q.s {
+		q.s[i].replyToWriter(errStreamBroken)
 		q.s[i] = frameWriteMsg{}
 	}
 	q.s = q.s[:0]
@@ -284,3 +449,141 @@ func (q *writeQueue) firstIsNoCost() bool {
 	}
 	return true
 }
+
+// NewPriorityWriteScheduler returns a WriteScheduler that orders
+// streams by the priorities clients give them in HEADERS and
+// PRIORITY frames (RFC 7540 section 5.3): a stream's dependents
+// are only written when it has nothing ready itself, and sibling
+// streams share the connection in proportion to their weights.
+func NewPriorityWriteScheduler() WriteScheduler {
+	return &priorityWriteScheduler{
+		pass: make(map[uint32]int64),
+		vt:   make(map[uint32]int64),
+	}
+}
+
+// priorityWriteScheduler is a writeScheduler that picks the stream
+// to write by walking the dependency tree from the root. At each
+// level it chooses the child with the lowest pass, the bytes it's
+// been given divided by its weight, whose subtree has a frame ready.
+type priorityWriteScheduler struct {
+	writeScheduler
+
+	// pass is each stream's virtual time. vt is, per parent
+	// stream ID (0 for the root), the pass its last picked child
+	// started from. A child behind that, say from being idle,
+	// starts from there too, rather than making up for lost time.
+	pass map[uint32]int64
+	vt   map[uint32]int64
+
+	path []*stream // reused by take
+}
+
+func (ws *priorityWriteScheduler) take() (wm frameWriteMsg, ok bool) {
+	if ws.maxFrameSize == 0 {
+		panic("internal error: ws.maxFrameSize not initialized or invalid")
+	}
+	if !ws.zero.empty() {
+		return ws.zero.shift(), true
+	}
+	if len(ws.canSend) != 0 {
+		panic("should be empty")
+	}
+	for _, q := range ws.sq {
+		if q.firstIsNoCost() || ws.streamWritableBytes(q) > 0 {
+			ws.canSend = append(ws.canSend, q)
+		}
+	}
+	if len(ws.canSend) == 0 {
+		return
+	}
+	defer ws.zeroCanSend()
+
+	q := ws.pick()
+	wm, ok = ws.takeFrom(q.streamID(), q)
+	var n int64
+	if wd, isData := wm.write.(*writeData); isData {
+		n = int64(len(wd.p))
+	}
+	var parentID uint32
+	for _, st := range ws.path {
+		start := ws.pass[st.id]
+		if vt := ws.vt[parentID]; start < vt {
+			start = vt
+		}
+		ws.vt[parentID] = start
+		ws.pass[st.id] = start + n*256/(int64(st.weight)+1)
+		parentID = st.id
+	}
+	for i := range ws.path {
+		ws.path[i] = nil
+	}
+	ws.path = ws.path[:0]
+	return wm, ok
+}
+
+// pick returns the queue in canSend to write from, leaving the
+// streams on the way down to it from the root in path.
+func (ws *priorityWriteScheduler) pick() *writeQueue {
+	var parent *stream // nil is the root
+	var parentID uint32
+	cands := ws.canSend
+	for {
+		var best *stream
+		var bestPass int64
+		vt := ws.vt[parentID]
+		for _, q := range cands {
+			c := childOn(q.head().stream, parent)
+			p := ws.pass[c.id]
+			if p < vt {
+				p = vt
+			}
+			if best == nil || p < bestPass || p == bestPass && c.id < best.id {
+				best, bestPass = c, p
+			}
+		}
+		ws.path = append(ws.path, best)
+		n := 0
+		for _, q := range cands {
+			st := q.head().stream
+			if st == best {
+				return q
+			}
+			if childOn(st, parent) == best {
+				cands[n] = q
+				n++
+			}
+		}
+		cands = cands[:n]
+		parent, parentID = best, best.id
+	}
+}
+
+// childOn returns the child of parent (nil for the root) that st
+// descends from, or st itself. Closed streams are skipped, as if
+// their dependents depended on their parents instead.
+func childOn(st, parent *stream) *stream {
+	for {
+		p := openParent(st)
+		if p == parent {
+			return st
+		}
+		st = p
+	}
+}
+
+// openParent returns the closest ancestor of st that's not closed,
+// or nil for the root.
+func openParent(st *stream) *stream {
+	p := st.parent
+	for p != nil && p.state == stateClosed {
+		p = p.parent
+	}
+	return p
+}
+
+func (ws *priorityWriteScheduler) forgetStream(id uint32) {
+	ws.writeScheduler.forgetStream(id)
+	delete(ws.pass, id)
+	delete(ws.vt, id)
+}
@@ -0,0 +1,240 @@
+// Copyright 2014 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// See https://code.google.com/p/go/source/browse/CONTRIBUTORS
+// Licensed under the same terms as Go itself:
+// https://code.google.com/p/go/source/browse/LICENSE
+
+package http2
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestWriteScheduler_AddWindowUpdate(t *testing.T) {
+	ws := &writeScheduler{maxFrameSize: initialMaxFrameSize}
+	st := &stream{id: 1}
+	wu := func(st *stream, n uint32) frameWriteMsg {
+		var id uint32
+		if st != nil {
+			id = st.id
+		}
+		return frameWriteMsg{write: writeWindowUpdate{streamID: id, n: n}, stream: st}
+	}
+	ws.addWindowUpdate(wu(nil, 10))
+	ws.addWindowUpdate(wu(st, 1))
+	ws.addWindowUpdate(wu(nil, 20))
+	ws.addWindowUpdate(wu(st, 2))
+	ws.add(frameWriteMsg{write: writeSettingsAck{}})
+	ws.addWindowUpdate(wu(nil, 30))
+	ws.addWindowUpdate(wu(nil, 1<<31-1)) // would overflow the one before
+
+	var got []writeFramer
+	for {
+		wm, ok := ws.take()
+		if !ok {
+			break
+		}
+		got = append(got, wm.write)
+	}
+	want := []writeFramer{
+		writeWindowUpdate{streamID: 0, n: 30},
+		writeSettingsAck{},
+		writeWindowUpdate{streamID: 0, n: 30},
+		writeWindowUpdate{streamID: 0, n: 1<<31 - 1},
+		writeWindowUpdate{streamID: 1, n: 3},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d frames %v; want %v", len(got), got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("frame %d = %#v; want %#v", i, got[i], want[i])
+		}
+	}
+}
+
+// newSchedStream returns an open stream for scheduler tests, with
+// room to write whatever's queued for it.
+func newSchedStream(id uint32, parent *stream, weight uint8, conn *flow) *stream {
+	st := &stream{id: id, state: stateOpen, parent: parent, weight: weight}
+	st.flow.conn = conn
+	st.flow.add(1 << 30)
+	return st
+}
+
+// takeData takes n frames from ws and returns the stream IDs of the
+// DATA frames among them, in order.
+func takeData(t *testing.T, ws WriteScheduler, n int) []uint32 {
+	var ids []uint32
+	for i := 0; i < n; i++ {
+		wm, ok := ws.take()
+		if !ok {
+			t.Fatalf("take %d: nothing ready", i)
+		}
+		if wd, ok := wm.write.(*writeData); ok {
+			ids = append(ids, wd.streamID)
+		}
+	}
+	return ids
+}
+
+func TestPriorityWriteScheduler_Weights(t *testing.T) {
+	ws := NewPriorityWriteScheduler()
+	ws.setMaxFrameSize(1000)
+	conn := &flow{n: 1 << 30}
+	heavy := newSchedStream(1, nil, 47, conn) // weight 48
+	light := newSchedStream(3, nil, 15, conn) // weight 16
+	for _, st := range []*stream{heavy, light} {
+		ws.add(frameWriteMsg{stream: st, write: &writeData{streamID: st.id, p: make([]byte, 100000)}})
+	}
+
+	ids := takeData(t, ws, 40)
+	count := map[uint32]int{}
+	for i, id := range ids {
+		count[id]++
+		// The weights are 3:1, so each run of four frames
+		// should hold one of the light stream's.
+		if (i+1)%4 == 0 && count[3] != (i+1)/4 {
+			t.Fatalf("after %d frames, light stream had %d; want %d (order %v)", i+1, count[3], (i+1)/4, ids)
+		}
+	}
+	if count[1] != 30 || count[3] != 10 {
+		t.Errorf("frames per stream = %v; want 30 for stream 1, 10 for stream 3", count)
+	}
+}
+
+func TestPriorityWriteScheduler_Dependency(t *testing.T) {
+	ws := NewPriorityWriteScheduler()
+	ws.setMaxFrameSize(1000)
+	conn := &flow{n: 1 << 30}
+	parent := newSchedStream(1, nil, defaultStreamWeight, conn)
+	child := newSchedStream(3, parent, defaultStreamWeight, conn)
+	ws.add(frameWriteMsg{stream: child, write: &writeData{streamID: 3, p: make([]byte, 3000)}})
+	ws.add(frameWriteMsg{stream: parent, write: &writeData{streamID: 1, p: make([]byte, 2000)}})
+
+	// The child only gets to write once its parent has nothing
+	// left, or is closed.
+	ids := takeData(t, ws, 3)
+	if want := []uint32{1, 1, 3}; !reflect.DeepEqual(ids, want) {
+		t.Fatalf("DATA order = %v; want %v", ids, want)
+	}
+	ws.add(frameWriteMsg{stream: parent, write: &writeData{streamID: 1, p: make([]byte, 1000)}})
+	if ids := takeData(t, ws, 1); ids[0] != 1 {
+		t.Fatalf("wrote stream %d; want parent, which is ready again", ids[0])
+	}
+	parent.state = stateClosed
+	ws.forgetStream(1)
+	if ids := takeData(t, ws, 2); !reflect.DeepEqual(ids, []uint32{3, 3}) {
+		t.Fatalf("after closing the parent, DATA order = %v; want [3 3]", ids)
+	}
+	if _, ok := ws.take(); ok {
+		t.Error("frames left over")
+	}
+}
+
+func TestRoundRobinWriteScheduler(t *testing.T) {
+	ws := NewRoundRobinWriteScheduler()
+	ws.setMaxFrameSize(1000)
+	conn := &flow{n: 1 << 30}
+	// Priorities make no difference.
+	a := newSchedStream(1, nil, 255, conn)
+	b := newSchedStream(3, a, defaultStreamWeight, conn)
+	c := newSchedStream(5, nil, 0, conn)
+	for _, st := range []*stream{c, a, b} {
+		ws.add(frameWriteMsg{stream: st, write: &writeData{streamID: st.id, p: make([]byte, 100000)}})
+	}
+
+	ids := takeData(t, ws, 30)
+	for i, id := range ids {
+		if want := uint32(1 + i%3*2); id != want {
+			t.Fatalf("DATA frame %d from stream %d; want %d (order %v)", i, id, want, ids)
+		}
+	}
+
+	// A stream joining mid-cycle gets its turn in ID order.
+	d := newSchedStream(2, nil, defaultStreamWeight, conn)
+	ws.add(frameWriteMsg{stream: d, write: &writeData{streamID: 2, p: make([]byte, 100000)}})
+	if ids, want := takeData(t, ws, 4), []uint32{1, 2, 3, 5}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("DATA order = %v; want %v", ids, want)
+	}
+}
+
+func TestFIFOWriteScheduler(t *testing.T) {
+	ws := NewFIFOWriteScheduler()
+	ws.setMaxFrameSize(1000)
+	conn := &flow{n: 1 << 30}
+	a := newSchedStream(1, nil, 255, conn)
+	b := newSchedStream(3, nil, 0, conn)
+	c := newSchedStream(5, a, defaultStreamWeight, conn)
+	blocked := &stream{id: 7, state: stateOpen} // no flow control window
+	blocked.flow.conn = conn
+
+	type queued struct {
+		st *stream
+		w  writeFramer
+	}
+	in := []queued{
+		{b, &writeResHeaders{streamID: 3, httpResCode: 200}},
+		{blocked, &writeData{streamID: 7, p: make([]byte, 10)}},
+		{a, &writeResHeaders{streamID: 1, httpResCode: 200}},
+		{c, &writeData{streamID: 5, p: make([]byte, 500)}},
+		{a, &writeData{streamID: 1, p: make([]byte, 1500)}}, // split in two
+		{b, &writeData{streamID: 3, p: make([]byte, 100), endStream: true}},
+		{c, writeWindowUpdate{streamID: 5, n: 10}},
+		{a, &writeData{streamID: 1, p: nil, endStream: true}},
+		{c, writeWindowUpdate{streamID: 5, n: 20}}, // folded into the one before
+	}
+	for _, v := range in {
+		wm := frameWriteMsg{stream: v.st, write: v.w}
+		if _, ok := v.w.(writeWindowUpdate); ok {
+			ws.addWindowUpdate(wm)
+		} else {
+			ws.add(wm)
+		}
+	}
+	ws.add(frameWriteMsg{write: writeSettingsAck{}}) // not a stream's; goes first
+
+	want := []string{
+		"SETTINGS ACK",
+		"HEADERS 3",
+		"HEADERS 1",
+		"DATA 5 500",
+		"DATA 1 1000",
+		"DATA 1 500",
+		"DATA 3 100",
+		"WINDOW_UPDATE 5 30",
+		"DATA 1 0",
+	}
+	var got []string
+	for {
+		wm, ok := ws.take()
+		if !ok {
+			break
+		}
+		switch w := wm.write.(type) {
+		case writeSettingsAck:
+			got = append(got, "SETTINGS ACK")
+		case *writeResHeaders:
+			got = append(got, fmt.Sprintf("HEADERS %d", w.streamID))
+		case *writeData:
+			got = append(got, fmt.Sprintf("DATA %d %d", w.streamID, len(w.p)))
+		case writeWindowUpdate:
+			got = append(got, fmt.Sprintf("WINDOW_UPDATE %d %d", w.streamID, w.n))
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("frames in order:\n%q\nwant:\n%q", got, want)
+	}
+
+	// Stream 7's DATA waited for flow control.
+	blocked.flow.add(10)
+	if ids := takeData(t, ws, 1); !reflect.DeepEqual(ids, []uint32{7}) {
+		t.Errorf("after the window opened, DATA from %v; want [7]", ids)
+	}
+	if !ws.empty() {
+		t.Error("frames left over")
+	}
+}